@@ -0,0 +1,195 @@
+// Package certstore holds the TLS certificate used by pfsd and reloads it
+// from disk when it is replaced, so that short lived certificates can be
+// rotated without restarting pfsd.
+package certstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pp2p/paranoid/logger"
+)
+
+// Log used by certstore
+var Log *logger.ParanoidLogger
+
+// Store serves the most recently loaded certificate to both the TLS server
+// and outgoing TLS connections.
+type Store struct {
+	certFile string
+	keyFile  string
+
+	lock        sync.RWMutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+
+	// If set, peers must present a certificate signed by one of these
+	// authorities and servers are only trusted if they do the same.
+	peerCAs *x509.CertPool
+}
+
+// New creates a Store and loads the certificate and key pair. An error is
+// returned if they can not be loaded.
+func New(certFile, keyFile string) (*Store, error) {
+	s := &Store{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func modTime(file string) (time.Time, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// Reload reads the certificate and key pair from disk. If they can not be
+// loaded the previous certificate is kept and an error is returned.
+func (s *Store) Reload() error {
+	certModTime, err := modTime(s.certFile)
+	if err != nil {
+		return fmt.Errorf("could not stat %s: %v", s.certFile, err)
+	}
+	keyModTime, err := modTime(s.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not stat %s: %v", s.keyFile, err)
+	}
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS key pair: %v", err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cert = &cert
+	s.certModTime = certModTime
+	s.keyModTime = keyModTime
+	return nil
+}
+
+// changed reports whether either file was modified since the last successful
+// load.
+func (s *Store) changed() bool {
+	certModTime, err := modTime(s.certFile)
+	if err != nil {
+		return false
+	}
+	keyModTime, err := modTime(s.keyFile)
+	if err != nil {
+		return false
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return !certModTime.Equal(s.certModTime) || !keyModTime.Equal(s.keyModTime)
+}
+
+// Watch checks the certificate and key files every interval and reloads them
+// when either changes. It returns when quit is closed.
+func (s *Store) Watch(interval time.Duration, quit chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case _, ok := <-quit:
+			if !ok {
+				return
+			}
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+			if err := s.Reload(); err != nil {
+				// The files may be part way through being replaced, so the
+				// reload is attempted again on the next tick.
+				Log.Warn("Unable to reload TLS certificate:", err)
+			} else {
+				Log.Info("Reloaded TLS certificate from", s.certFile)
+			}
+		}
+	}
+}
+
+// LoadPeerCA reads a PEM encoded file of certificate authorities. Once loaded,
+// certificates presented by clients are verified against them and outgoing
+// connections to peers only trust servers signed by them.
+func (s *Store) LoadPeerCA(caFile string) error {
+	pemCerts, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return fmt.Errorf("no certificates found in %s", caFile)
+	}
+	s.peerCAs = pool
+	return nil
+}
+
+// VerifiesPeers returns true if a peer certificate authority has been loaded
+func (s *Store) VerifiesPeers() bool {
+	return s.peerCAs != nil
+}
+
+// Certificate returns the currently loaded certificate
+func (s *Store) Certificate() *tls.Certificate {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.cert
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (s *Store) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.Certificate(), nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate
+func (s *Store) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return s.Certificate(), nil
+}
+
+// ServerConfig returns a TLS configuration for servers which always presents
+// the current certificate. If a peer certificate authority is loaded, client
+// certificates are verified against it. Clients without a certificate are
+// still accepted, as the raft connections sharing the server do not present
+// one, so handlers must check for a verified certificate themselves.
+func (s *Store) ServerConfig() *tls.Config {
+	config := &tls.Config{
+		GetCertificate: s.GetCertificate,
+	}
+	if s.peerCAs != nil {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.ClientCAs = s.peerCAs
+	}
+	return config
+}
+
+// ClientConfig returns a TLS configuration for connecting to serverName which
+// presents the current certificate if the server asks for one.
+func (s *Store) ClientConfig(serverName string, skipVerify bool) *tls.Config {
+	return &tls.Config{
+		ServerName:           serverName,
+		InsecureSkipVerify:   skipVerify,
+		GetClientCertificate: s.GetClientCertificate,
+	}
+}
+
+// PeerConfig is like ClientConfig but, if a peer certificate authority is
+// loaded, only trusts servers with a certificate signed by it.
+func (s *Store) PeerConfig(serverName string, skipVerify bool) *tls.Config {
+	config := s.ClientConfig(serverName, skipVerify)
+	config.RootCAs = s.peerCAs
+	return config
+}
@@ -0,0 +1,103 @@
+// +build !integration
+
+package certstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pp2p/paranoid/logger"
+)
+
+func TestMain(m *testing.M) {
+	Log = logger.New("certstore", "pfsd", os.DevNull)
+	os.Exit(m.Run())
+}
+
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commonName(t *testing.T, s *Store) string {
+	cert, err := x509.ParseCertificate(s.Certificate().Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Subject.CommonName
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certstoretest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := path.Join(dir, "cert.pem")
+	keyFile := path.Join(dir, "key.pem")
+
+	writeTestCert(t, certFile, keyFile, "first")
+	s, err := New(certFile, keyFile)
+	if err != nil {
+		t.Fatal("Unable to create store:", err)
+	}
+	if s.changed() {
+		t.Error("Store reports a change before the files were replaced")
+	}
+
+	writeTestCert(t, certFile, keyFile, "second")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	if !s.changed() {
+		t.Error("Store did not notice the replaced certificate")
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal("Unable to reload:", err)
+	}
+	if cn := commonName(t, s); cn != "second" {
+		t.Error("Incorrect certificate after reload. Expected: second Got:", cn)
+	}
+
+	// A broken key pair must not replace the working certificate.
+	ioutil.WriteFile(keyFile, []byte("garbage"), 0600)
+	if err := s.Reload(); err == nil {
+		t.Error("Expected an error reloading a broken key pair")
+	}
+	if cn := commonName(t, s); cn != "second" {
+		t.Error("Certificate replaced by a failed reload. Got:", cn)
+	}
+}
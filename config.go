@@ -0,0 +1,216 @@
+// config.go contains support for loading pfsd settings from a file
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pp2p/pfsd/keyman"
+)
+
+// duration allows time.Duration values to be written as strings such as
+// "90s" or "3m" in the configuration file.
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be given as strings such as \"30s\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// config is the structure of the file given with -config. Every key matches
+// the command line flag of the same name, and flags given on the command line
+// take precedence over values from the file.
+type config struct {
+	Cert               string `json:"cert"`
+	Key                string `json:"key"`
+	CAFile             string `json:"ca_file"`
+	SkipVerification   bool   `json:"skip_verification"`
+	InsecureKeyRelease bool   `json:"insecure_key_release"`
+	ParanoidDir        string `json:"paranoid_dir"`
+	MountDir           string `json:"mount_dir"`
+	DiscoveryAddr      string `json:"discovery_addr"`
+	DiscoveryPool      string `json:"discovery_pool"`
+	PoolPassword       string `json:"pool_password"`
+	PoolPasswordFile   string `json:"pool_password_file"`
+	Interface          string `json:"interface"`
+	AllowOther         bool   `json:"allow_other"`
+	StatfsBlockSize    int    `json:"statfs_block_size"`
+
+	PieceKeyFile        string `json:"piece_key_file"`
+	PiecePassphraseFile string `json:"piece_passphrase_file"`
+	KeyPassphraseFile   string `json:"key_passphrase_file"`
+	ThresholdPolicy     string `json:"threshold_policy"`
+
+	GenerationJoinTimeout  duration `json:"generation_join_timeout"`
+	JoinSendKeysInterval   duration `json:"join_send_keys_interval"`
+	UnlockTimeout          duration `json:"unlock_timeout"`
+	CertReloadInterval     duration `json:"cert_reload_interval"`
+	PeerPingTimeout        duration `json:"peer_ping_timeout"`
+	PeerPingInterval       duration `json:"peer_ping_interval"`
+	KeyPieceVerifyInterval duration `json:"key_piece_verify_interval"`
+}
+
+// flagValues returns the values set in the file, keyed by flag name.
+func (c *config) flagValues() map[string]string {
+	values := map[string]string{
+		"cert":               c.Cert,
+		"key":                c.Key,
+		"ca_file":            c.CAFile,
+		"paranoid_dir":       c.ParanoidDir,
+		"mount_dir":          c.MountDir,
+		"discovery_addr":     c.DiscoveryAddr,
+		"discovery_pool":     c.DiscoveryPool,
+		"pool_password":      c.PoolPassword,
+		"pool_password_file": c.PoolPasswordFile,
+		"interface":          c.Interface,
+
+		"piece_key_file":        c.PieceKeyFile,
+		"piece_passphrase_file": c.PiecePassphraseFile,
+		"key_passphrase_file":   c.KeyPassphraseFile,
+		"threshold_policy":      c.ThresholdPolicy,
+	}
+	if c.SkipVerification {
+		values["skip_verification"] = strconv.FormatBool(c.SkipVerification)
+	}
+	if c.InsecureKeyRelease {
+		values["insecure_key_release"] = strconv.FormatBool(c.InsecureKeyRelease)
+	}
+	if c.AllowOther {
+		values["allow_other"] = strconv.FormatBool(c.AllowOther)
+	}
+	if c.StatfsBlockSize != 0 {
+		values["statfs_block_size"] = strconv.Itoa(c.StatfsBlockSize)
+	}
+	durations := map[string]duration{
+		"generation_join_timeout":   c.GenerationJoinTimeout,
+		"join_send_keys_interval":   c.JoinSendKeysInterval,
+		"unlock_timeout":            c.UnlockTimeout,
+		"cert_reload_interval":      c.CertReloadInterval,
+		"peer_ping_timeout":         c.PeerPingTimeout,
+		"peer_ping_interval":        c.PeerPingInterval,
+		"key_piece_verify_interval": c.KeyPieceVerifyInterval,
+	}
+	for name, d := range durations {
+		if d.Duration != 0 {
+			values[name] = d.String()
+		}
+	}
+	return values
+}
+
+// readConfig parses the configuration file at the given path. Unknown keys
+// are treated as errors so that typos do not go unnoticed.
+func readConfig(configPath string) (*config, error) {
+	file, err := os.Open(configPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	c := new(config)
+	dec := json.NewDecoder(file)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", configPath, err)
+	}
+
+	if c.PoolPassword != "" {
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			return nil, fmt.Errorf("%s contains a pool password and must not be accessible by group or others",
+				configPath)
+		}
+	}
+	return c, nil
+}
+
+// loadConfig reads the configuration file, if one was given, and applies its
+// values to every flag which was not set explicitly on the command line.
+func loadConfig(configPath string) error {
+	if configPath == "" {
+		return nil
+	}
+	c, err := readConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+	for name, value := range c.flagValues() {
+		if value == "" || setOnCommandLine[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value for %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// validateFlags checks the final settings and returns every problem found, so
+// that they can all be reported before startup.
+func validateFlags() []error {
+	var errs []error
+	if *paranoidDirFlag == "" {
+		errs = append(errs, errors.New("paranoid directory must be provided"))
+	}
+	if *mountDirFlag == "" {
+		errs = append(errs, errors.New("mount point must be provided"))
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		errs = append(errs, errors.New("cert and key must be provided together"))
+	}
+	if *pieceKeyFile != "" && *piecePassphraseFile != "" {
+		errs = append(errs, errors.New("only one of piece_key_file and piece_passphrase_file may be given"))
+	}
+	if *caFile != "" && *certFile == "" {
+		errs = append(errs, errors.New("ca_file requires a cert and key"))
+	}
+	if *caFile != "" && *skipVerify {
+		errs = append(errs, errors.New("ca_file can not be used together with skip_verification"))
+	}
+	if *discoveryPasswordFlag != "" && *poolPasswordFile != "" {
+		errs = append(errs, errors.New("only one of pool_password and pool_password_file may be given"))
+	}
+	if *thresholdPolicy != "" {
+		if _, err := keyman.ParseThresholdPolicy(*thresholdPolicy); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if *statfsBlockSize != 0 && (*statfsBlockSize < 512 || *statfsBlockSize > 1<<20 ||
+		*statfsBlockSize&(*statfsBlockSize-1) != 0) {
+		errs = append(errs, errors.New("statfs_block_size must be a power of two between 512 and 1048576"))
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		getter, ok := f.Value.(flag.Getter)
+		if !ok {
+			return
+		}
+		if d, ok := getter.Get().(time.Duration); ok && d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be a positive duration", f.Name))
+		}
+	})
+	return errs
+}
@@ -0,0 +1,68 @@
+// +build !integration
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, contents string, perm os.FileMode) string {
+	dir, err := ioutil.TempDir("", "pfsdconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := path.Join(dir, "pfsd.json")
+	if err := ioutil.WriteFile(configPath, []byte(contents), perm); err != nil {
+		t.Fatal(err)
+	}
+	return configPath
+}
+
+func TestReadConfig(t *testing.T) {
+	configPath := writeTestConfig(t, `{
+		"paranoid_dir": "/tmp/pfs",
+		"mount_dir": "/tmp/mnt",
+		"pool_password": "secret",
+		"unlock_timeout": "90s",
+		"statfs_block_size": 4096
+	}`, 0600)
+	defer os.RemoveAll(path.Dir(configPath))
+
+	c, err := readConfig(configPath)
+	if err != nil {
+		t.Fatal("Unable to read config:", err)
+	}
+	if c.UnlockTimeout.Duration != 90*time.Second {
+		t.Error("Incorrect unlock timeout. Expected: 1m30s Got:", c.UnlockTimeout)
+	}
+	values := c.flagValues()
+	if values["paranoid_dir"] != "/tmp/pfs" || values["unlock_timeout"] != "1m30s" ||
+		values["statfs_block_size"] != "4096" {
+		t.Error("Incorrect flag values:", values)
+	}
+	if _, ok := values["peer_ping_interval"]; ok {
+		t.Error("Unset durations should not be returned as flag values")
+	}
+}
+
+func TestReadConfigUnknownKey(t *testing.T) {
+	configPath := writeTestConfig(t, `{"paranoid_directory": "/tmp/pfs"}`, 0600)
+	defer os.RemoveAll(path.Dir(configPath))
+
+	if _, err := readConfig(configPath); err == nil {
+		t.Error("Expected an error for an unknown key")
+	}
+}
+
+func TestReadConfigPasswordPermissions(t *testing.T) {
+	configPath := writeTestConfig(t, `{"pool_password": "secret"}`, 0644)
+	defer os.RemoveAll(path.Dir(configPath))
+
+	if _, err := readConfig(configPath); err == nil {
+		t.Error("Expected an error for a world readable file containing a password")
+	}
+}
@@ -55,7 +55,7 @@ func pingPeers() {
 	defer globals.Wait.Done()
 	// Ping as soon as this node joins
 	pnetclient.Ping()
-	timer := time.NewTimer(peerPingInterval)
+	timer := time.NewTimer(*peerPingInterval)
 	defer timer.Stop()
 	for {
 		select {
@@ -65,14 +65,14 @@ func pingPeers() {
 			}
 		case <-timer.C:
 			pnetclient.Ping()
-			timer.Reset(peerPingInterval)
+			timer.Reset(*peerPingInterval)
 		}
 	}
 }
 
 //JoinCluster sends a request to all peers to request to be added to the cluster
 func JoinCluster(password string) error {
-	timer := time.NewTimer(peerPingTimeOut)
+	timer := time.NewTimer(*peerPingTimeOut)
 	defer timer.Stop()
 	for {
 		select {
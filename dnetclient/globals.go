@@ -1,20 +1,22 @@
 package dnetclient
 
 import (
-	"crypto/tls"
+	"flag"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 
 	"github.com/pp2p/paranoid/logger"
-	"github.com/pp2p/paranoid/pfsd/globals"
+	"github.com/pp2p/pfsd/globals"
 )
 
-const peerPingTimeOut time.Duration = time.Minute * 3
-const peerPingInterval time.Duration = time.Minute
-
 var (
+	peerPingTimeOut = flag.Duration("peer_ping_timeout", time.Minute*3,
+		"timeout for joining the raft cluster through known peers")
+	peerPingInterval = flag.Duration("peer_ping_interval", time.Minute,
+		"interval at which known peers are pinged")
+
 	discoveryCommonName string
 
 	// Log is used to log dnetclient messages
@@ -25,10 +27,7 @@ func dialDiscovery() (*grpc.ClientConn, error) {
 	var opts []grpc.DialOption
 	opts = append(opts, grpc.WithTimeout(2*time.Second))
 	if globals.TLSEnabled {
-		creds := credentials.NewTLS(&tls.Config{
-			ServerName:         discoveryCommonName,
-			InsecureSkipVerify: globals.TLSSkipVerify,
-		})
+		creds := credentials.NewTLS(globals.Certificates.ClientConfig(discoveryCommonName, globals.TLSSkipVerify))
 		opts = append(opts, grpc.WithTransportCredentials(creds))
 	} else {
 		opts = append(opts, grpc.WithInsecure())
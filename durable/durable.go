@@ -0,0 +1,72 @@
+// Package durable writes files so that they survive crashes and power loss
+// intact. It is used for every file pfsd keeps in the meta directory.
+package durable
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// crashPoint is called after each step of WriteFile. Tests replace it to stop
+// a write part way through, leaving the files as a crash would.
+var crashPoint = func(step string) error { return nil }
+
+// WriteFile replaces the contents of filename with data. The data is written
+// to filename-new, which is synced to disk before being renamed over
+// filename, after which the directory is synced as well. After a crash the
+// file therefore holds either its old contents or data, never a mix or an
+// empty file.
+func WriteFile(filename string, data []byte, perm os.FileMode) error {
+	newFile := filename + "-new"
+	file, err := os.OpenFile(newFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %s", newFile, err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = crashPoint("write")
+		if err != nil {
+			file.Close()
+			return err
+		}
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// We ignore the following error because if both file operations fail they are very
+		// likely caused by the same thing, so one error will give information for both.
+		os.Remove(newFile)
+		return fmt.Errorf("unable to write %s: %s", newFile, err)
+	}
+	if err = crashPoint("sync"); err != nil {
+		return err
+	}
+
+	err = os.Rename(newFile, filename)
+	if err != nil {
+		os.Remove(newFile)
+		return fmt.Errorf("unable to rename %s to %s: %s", newFile, filename, err)
+	}
+	if err = crashPoint("rename"); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(filename))
+}
+
+// SyncDir flushes the entries of a directory to disk, so that files created or
+// renamed in it are not lost.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %s", dir, err)
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("unable to sync %s: %s", dir, err)
+	}
+	return nil
+}
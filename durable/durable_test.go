@@ -0,0 +1,97 @@
+// +build !integration
+
+package durable
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+var errCrash = errors.New("simulated crash")
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durabletest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "attributes")
+
+	if err := WriteFile(filename, []byte("first"), 0600); err != nil {
+		t.Fatal("Unable to write file:", err)
+	}
+	if err := WriteFile(filename, []byte("second"), 0600); err != nil {
+		t.Fatal("Unable to write file:", err)
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "second" {
+		t.Error("Incorrect contents. Expected: second Got:", string(contents))
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Error("Incorrect permissions. Expected: 0600 Got:", info.Mode().Perm())
+	}
+	if _, err := os.Stat(filename + "-new"); !os.IsNotExist(err) {
+		t.Error("Temporary file was left behind")
+	}
+}
+
+// TestWriteFileCrash stops a write after every step and checks that the file
+// holds either the old or the new contents, and that writing again succeeds.
+func TestWriteFileCrash(t *testing.T) {
+	defer func() {
+		crashPoint = func(step string) error { return nil }
+	}()
+
+	expected := map[string]string{
+		"write":  "old",
+		"sync":   "old",
+		"rename": "new",
+	}
+	for step, want := range expected {
+		dir, err := ioutil.TempDir("", "durabletest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		filename := path.Join(dir, "pieces")
+
+		crashPoint = func(string) error { return nil }
+		if err := WriteFile(filename, []byte("old"), 0600); err != nil {
+			t.Fatal("Unable to write file:", err)
+		}
+
+		crashStep := step
+		crashPoint = func(s string) error {
+			if s == crashStep {
+				return errCrash
+			}
+			return nil
+		}
+		if err := WriteFile(filename, []byte("new"), 0600); err != errCrash {
+			t.Fatalf("Expected a crash after %s. Got: %v", step, err)
+		}
+
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("Unable to read file after crash after %s: %s", step, err)
+		}
+		if string(contents) != want {
+			t.Errorf("Incorrect contents after crash after %s. Expected: %s Got: %s", step, want, contents)
+		}
+
+		crashPoint = func(string) error { return nil }
+		if err := WriteFile(filename, []byte("recovered"), 0600); err != nil {
+			t.Errorf("Unable to write file after crash after %s: %s", step, err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package globals
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"sync"
+
+	"github.com/pp2p/pfsd/durable"
+)
+
+var attributesLock sync.Mutex
+
+// ReadFileSystemAttributes reads the attributes from the meta directory
+func ReadFileSystemAttributes() (*FileSystemAttributes, error) {
+	attributesLock.Lock()
+	defer attributesLock.Unlock()
+
+	attributesJSON, err := ioutil.ReadFile(path.Join(ParanoidDir, "meta", "attributes"))
+	if err != nil {
+		return nil, err
+	}
+	attributes := &FileSystemAttributes{}
+	err = json.Unmarshal(attributesJSON, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return attributes, nil
+}
+
+// SaveFileSystemAttributes writes the attributes to the meta directory
+func SaveFileSystemAttributes(attributes *FileSystemAttributes) error {
+	attributesLock.Lock()
+	defer attributesLock.Unlock()
+
+	attributesJSON, err := json.Marshal(attributes)
+	if err != nil {
+		return err
+	}
+
+	return durable.WriteFile(path.Join(ParanoidDir, "meta", "attributes"), attributesJSON, 0600)
+}
@@ -2,12 +2,10 @@ package globals
 
 import (
 	"crypto/rand"
-	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
-	"os"
-	"path"
+	"sort"
 	"sync"
 	"time"
 
@@ -15,6 +13,7 @@ import (
 
 	"github.com/pp2p/paranoid/logger"
 	"github.com/pp2p/paranoid/raft"
+	"github.com/pp2p/pfsd/certstore"
 	"github.com/pp2p/pfsd/keyman"
 )
 
@@ -40,10 +39,14 @@ func (n Node) String() string {
 
 // FileSystemAttributes stores the information written onto the disk
 type FileSystemAttributes struct {
-	Encrypted     bool       `json:"encrypted"`
-	KeyGenerated  bool       `json:"keygenerated"`
-	NetworkOff    bool       `json:"networkoff"`
-	EncryptionKey keyman.Key `json:"encryptionkey,omitempty"` //The encryption key is only saved to file in this manner if networking is turned off
+	Encrypted       bool                   `json:"encrypted"`
+	KeyGenerated    bool                   `json:"keygenerated"`
+	NetworkOff      bool                   `json:"networkoff"`
+	WrappedKey      *keyman.WrappedKey     `json:"wrappedkey,omitempty"` //The encryption key is only saved to file if networking is turned off
+	ThresholdPolicy keyman.ThresholdPolicy `json:"thresholdpolicy"`
+	// The fingerprint of the encryption key, against which a key recovered
+	// from backup shares is checked
+	KeyFingerprint []byte `json:"keyfingerprint,omitempty"`
 }
 
 // RaftNetworkServer is an instance of the network server
@@ -84,6 +87,13 @@ var TLSEnabled bool
 // it connects to
 var TLSSkipVerify bool
 
+// Certificates holds the TLS certificate of this node if TLS is enabled
+var Certificates *certstore.Store
+
+// InsecureKeyRelease allows held key pieces to be released to peers which can
+// not be authenticated, because no peer certificate authority was given
+var InsecureKeyRelease bool
+
 // PoolPasswordHash used to connect to the pool
 var PoolPasswordHash []byte
 
@@ -91,7 +101,7 @@ var PoolPasswordHash []byte
 var PoolPasswordSalt []byte
 
 // SetPoolPasswordHash generates and sets a new password hash from the password
-func SetPoolPasswordHash(password string) error {
+func SetPoolPasswordHash(password []byte) error {
 	PoolPasswordHash = make([]byte, 0)
 	PoolPasswordSalt = make([]byte, PasswordSaltLength)
 	n, err := io.ReadFull(rand.Reader, PoolPasswordSalt)
@@ -102,8 +112,13 @@ func SetPoolPasswordHash(password string) error {
 		return errors.New("unable to read correct number of bytes from random number generator")
 	}
 
-	if password != "" {
-		PoolPasswordHash, err = bcrypt.GenerateFromPassword(append(PoolPasswordSalt, []byte(password)...), bcrypt.DefaultCost)
+	if len(password) != 0 {
+		salted := make([]byte, 0, len(PoolPasswordSalt)+len(password))
+		salted = append(append(salted, PoolPasswordSalt...), password...)
+		PoolPasswordHash, err = bcrypt.GenerateFromPassword(salted, bcrypt.DefaultCost)
+		for i := range salted {
+			salted[i] = 0
+		}
 		return err
 	}
 	return nil
@@ -171,8 +186,110 @@ var Encrypted bool
 // KeyGenerated is set to true when the key is generated
 var KeyGenerated bool
 
-// EncryptionKey stores the actual key used for encryption
-var EncryptionKey *keyman.Key
+var (
+	encryptionKey     *keyman.Key
+	encryptionKeyLock sync.Mutex
+)
+
+// SetEncryptionKey sets the key used for encryption once it has been
+// generated or rebuilt
+func SetEncryptionKey(key *keyman.Key) {
+	encryptionKeyLock.Lock()
+	defer encryptionKeyLock.Unlock()
+	encryptionKey = key
+}
+
+// GetEncryptionKey returns the key used for encryption. It returns nil while
+// the key is not known, for example while the filesystem is locked.
+func GetEncryptionKey() *keyman.Key {
+	encryptionKeyLock.Lock()
+	defer encryptionKeyLock.Unlock()
+	return encryptionKey
+}
+
+// ThresholdPolicy decides how many key pieces are needed to unlock the
+// filesystem
+var ThresholdPolicy keyman.ThresholdPolicy
+
+// LockState describes whether the key of an encrypted filesystem is still
+// being collected from peers
+type LockState struct {
+	Locked bool
+	Since  time.Time
+	// Why the last attempt to unlock failed
+	Reason string
+}
+
+var (
+	lockState     LockState
+	lockStateLock sync.Mutex
+)
+
+// SetLockState records whether the filesystem is locked
+func SetLockState(locked bool, reason string) {
+	lockStateLock.Lock()
+	defer lockStateLock.Unlock()
+	if locked != lockState.Locked {
+		lockState.Since = time.Now()
+	}
+	lockState.Locked = locked
+	lockState.Reason = reason
+}
+
+// GetLockState returns whether the filesystem is locked
+func GetLockState() LockState {
+	lockStateLock.Lock()
+	defer lockStateLock.Unlock()
+	return lockState
+}
+
+// Locked returns true while the filesystem can not be used because its key
+// has not been rebuilt
+func Locked() bool {
+	return GetLockState().Locked
+}
+
+// Operations on the filesystem are counted, so that locking it can wait for
+// the ones in progress to finish.
+var (
+	operationsLock sync.Mutex
+	operationsDone = sync.NewCond(&operationsLock)
+	operations     int
+)
+
+// BeginOperation returns false if the filesystem is locked. Otherwise
+// EndOperation must be called once the operation has finished.
+func BeginOperation() bool {
+	operationsLock.Lock()
+	defer operationsLock.Unlock()
+	if Locked() {
+		return false
+	}
+	operations++
+	return true
+}
+
+// EndOperation records that an operation started with BeginOperation has
+// finished
+func EndOperation() {
+	operationsLock.Lock()
+	defer operationsLock.Unlock()
+	operations--
+	if operations == 0 {
+		operationsDone.Broadcast()
+	}
+}
+
+// LockOperations locks the filesystem and waits for the operations in
+// progress to finish
+func LockOperations(reason string) {
+	operationsLock.Lock()
+	defer operationsLock.Unlock()
+	SetLockState(true, reason)
+	for operations > 0 {
+		operationsDone.Wait()
+	}
+}
 
 var keyPieceStoreLock sync.Mutex
 
@@ -237,27 +354,57 @@ func (ks KeyPieceStore) DeleteGeneration(generation int64) error {
 	return ks.SaveToDisk()
 }
 
-// SaveToDisk saves all the keypieces in the meta directory
-func (ks KeyPieceStore) SaveToDisk() error {
-	piecePath := path.Join(ParanoidDir, "meta", "pieces-new")
-	file, err := os.Create(piecePath)
-	if err != nil {
-		Log.Errorf("Unable to open %s for storing pieces: %s", piecePath, file)
-		return fmt.Errorf("Unable to open %s for storing pieces: %s", piecePath, file)
+// RecordOwnerCommonNames sets the owner common name of every piece which has
+// none and whose owner is in owners, a map from UUID to common name. The
+// store is only saved if a piece changed.
+func (ks KeyPieceStore) RecordOwnerCommonNames(owners map[string]string) error {
+	keyPieceStoreLock.Lock()
+	defer keyPieceStoreLock.Unlock()
+
+	changed := false
+	for _, pieces := range ks {
+		for owner, piece := range pieces {
+			if cn, ok := owners[owner]; ok && piece.OwnerCommonName == "" {
+				piece.OwnerCommonName = cn
+				changed = true
+			}
+		}
 	}
-	defer file.Close()
-	enc := gob.NewEncoder(file)
-	err = enc.Encode(ks)
-	if err != nil {
-		Log.Error("Failed encoding KeyPieceStore to GOB:", err)
-		return fmt.Errorf("failed encoding KeyPieceStore to GOB: %s", err)
+	if !changed {
+		return nil
 	}
-	err = os.Rename(piecePath, path.Join(ParanoidDir, "meta", "pieces"))
-	if err != nil {
-		Log.Error("Failed to save KeyPieceStore to file:", err)
-		return fmt.Errorf("Failed to save KeyPieceStore to file: %s", err)
+	return ks.SaveToDisk()
+}
+
+// HeldPiece describes a held key piece without its data
+type HeldPiece struct {
+	Generation int64
+	Owner      string
+	Seq        int64
+}
+
+// ListPieces describes every held key piece, ordered by generation and owner.
+func (ks KeyPieceStore) ListPieces() []HeldPiece {
+	keyPieceStoreLock.Lock()
+	defer keyPieceStoreLock.Unlock()
+
+	var held []HeldPiece
+	for generation, pieces := range ks {
+		for owner, piece := range pieces {
+			held = append(held, HeldPiece{
+				Generation: generation,
+				Owner:      owner,
+				Seq:        piece.Seq,
+			})
+		}
 	}
-	return nil
+	sort.Slice(held, func(i, j int) bool {
+		if held[i].Generation != held[j].Generation {
+			return held[i].Generation < held[j].Generation
+		}
+		return held[i].Owner < held[j].Owner
+	})
+	return held
 }
 
 // HeldKeyPieces is an instance of KeyPieceStore
@@ -0,0 +1,329 @@
+package globals
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+
+	"github.com/pp2p/pfsd/durable"
+	"github.com/pp2p/pfsd/keyman"
+)
+
+// The pieces file is framed by keyman.EncodeFile. Its payload is
+//
+//	KEK source (1 byte) | salt (16 bytes) | sealed JSON encoding of []pieceRecord
+//
+// and the magic, version, KEK source and salt are authenticated along with the
+// sealed data. Version 1 files were not framed and sealed a gob encoding of the
+// KeyPieceStore after the same header. Files written before the header was
+// introduced are a plain gob encoding. Both are converted when loaded.
+const (
+	pieceFileMagic              = "PFKP"
+	pieceFileVersion       byte = 2
+	pieceFileSealedGob     byte = 1
+	pieceFileHeaderLen          = len(pieceFileMagic) + 2 + keyman.SaltSize
+	pieceFilePayloadPrefix      = 1 + keyman.SaltSize
+
+	kekFromKeyFile    byte = 1
+	kekFromPassphrase byte = 2
+)
+
+// pieceRecord is the stored form of a held KeyPiece. Fields may only be added
+// if they can be left out, anything else changes together with
+// pieceFileVersion.
+type pieceRecord struct {
+	Generation      int64    `json:"generation"`
+	Owner           string   `json:"owner"`
+	OwnerCommonName string   `json:"owner_common_name,omitempty"`
+	Data            []byte   `json:"data"`
+	Fingerprint     []byte   `json:"fingerprint"`
+	Prime           []byte   `json:"prime"`
+	Seq             int64    `json:"seq"`
+	Commitments     [][]byte `json:"commitments,omitempty"`
+}
+
+func (ks KeyPieceStore) toRecords() []pieceRecord {
+	records := []pieceRecord{}
+	for generation, pieces := range ks {
+		for owner, piece := range pieces {
+			record := pieceRecord{
+				Generation:      generation,
+				Owner:           owner,
+				OwnerCommonName: piece.OwnerCommonName,
+				Data:            piece.Data,
+				Fingerprint:     piece.ParentFingerprint[:],
+				Seq:             piece.Seq,
+			}
+			if piece.Prime != nil {
+				record.Prime = piece.Prime.Bytes()
+			}
+			for _, c := range piece.Commitments {
+				record.Commitments = append(record.Commitments, c.Bytes())
+			}
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func storeFromRecords(records []pieceRecord) (KeyPieceStore, error) {
+	store := make(KeyPieceStore)
+	for _, record := range records {
+		if len(record.Fingerprint) != 32 {
+			return nil, fmt.Errorf("key piece of %s has an invalid fingerprint", record.Owner)
+		}
+		piece := &keyman.KeyPiece{
+			Data:            record.Data,
+			Prime:           new(big.Int).SetBytes(record.Prime),
+			Seq:             record.Seq,
+			OwnerCommonName: record.OwnerCommonName,
+		}
+		copy(piece.ParentFingerprint[:], record.Fingerprint)
+		for _, c := range record.Commitments {
+			piece.Commitments = append(piece.Commitments, new(big.Int).SetBytes(c))
+		}
+		if _, ok := store[record.Generation]; !ok {
+			store[record.Generation] = make(KeyPieceMap)
+		}
+		store[record.Generation][record.Owner] = piece
+	}
+	return store, nil
+}
+
+// pieceFileAAD returns the data authenticated along with the sealed pieces.
+func pieceFileAAD(version, source byte, salt []byte) []byte {
+	aad := append([]byte(pieceFileMagic), version, source)
+	return append(aad, salt...)
+}
+
+// pieceSealer holds the key-encryption-key protecting the pieces file
+type pieceSealer struct {
+	source byte
+	salt   []byte
+	kek    []byte
+}
+
+var sealer *pieceSealer
+
+func piecesPath() string {
+	return path.Join(ParanoidDir, "meta", "pieces")
+}
+
+// readPieceFileHeader returns the KEK source and salt recorded in the pieces
+// file. ok is false if the file does not exist or has no header.
+func readPieceFileHeader() (source byte, salt []byte, ok bool, err error) {
+	data, err := ioutil.ReadFile(piecesPath())
+	if os.IsNotExist(err) {
+		return 0, nil, false, nil
+	}
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if !keyman.HasMagic(pieceFileMagic, data) {
+		return 0, nil, false, nil
+	}
+	if len(data) >= pieceFileHeaderLen && data[len(pieceFileMagic)] == pieceFileSealedGob {
+		header := data[len(pieceFileMagic):pieceFileHeaderLen]
+		return header[1], header[2:], true, nil
+	}
+	_, payload, err := keyman.DecodeFile(pieceFileMagic, data)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if len(payload) < pieceFilePayloadPrefix {
+		return 0, nil, false, keyman.ErrCorruptFile
+	}
+	return payload[0], payload[1:pieceFilePayloadPrefix], true, nil
+}
+
+// UsePieceKeyFile seals the key pieces with a random key-encryption-key read
+// from keyFile. If keyFile does not exist a new key is generated and saved.
+// Keeping the file outside the paranoid directory means a copy of that
+// directory alone is not enough to read the pieces.
+func UsePieceKeyFile(keyFile string) error {
+	kek, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		kek, err = keyman.GenerateKEK()
+		if err != nil {
+			return fmt.Errorf("unable to generate piece key: %s", err)
+		}
+		err = durable.WriteFile(keyFile, kek, 0600)
+		if err != nil {
+			return fmt.Errorf("unable to save piece key: %s", err)
+		}
+		Log.Info("Generated new piece key", keyFile)
+	} else if err != nil {
+		return fmt.Errorf("unable to read piece key: %s", err)
+	}
+	if len(kek) != keyman.KEKSize {
+		return fmt.Errorf("piece key %s has incorrect length %d", keyFile, len(kek))
+	}
+	sealer = &pieceSealer{
+		source: kekFromKeyFile,
+		salt:   make([]byte, keyman.SaltSize),
+		kek:    kek,
+	}
+	return nil
+}
+
+// UsePiecePassphrase seals the key pieces with a key-encryption-key derived
+// from passphrase. The salt of an existing pieces file is reused.
+func UsePiecePassphrase(passphrase []byte) error {
+	source, salt, ok, err := readPieceFileHeader()
+	if err != nil {
+		return fmt.Errorf("unable to read pieces file: %s", err)
+	}
+	if !ok || source != kekFromPassphrase {
+		salt, err = keyman.GenerateSalt()
+		if err != nil {
+			return fmt.Errorf("unable to generate salt: %s", err)
+		}
+	}
+	kek, err := keyman.DeriveKEK(passphrase, salt)
+	if err != nil {
+		return fmt.Errorf("unable to derive piece key: %s", err)
+	}
+	sealer = &pieceSealer{
+		source: kekFromPassphrase,
+		salt:   salt,
+		kek:    kek,
+	}
+	return nil
+}
+
+// SaveToDisk seals all the keypieces and saves them in the meta directory
+func (ks KeyPieceStore) SaveToDisk() error {
+	if sealer == nil {
+		Log.Error("Unable to save KeyPieceStore: no piece key configured")
+		return errors.New("unable to save KeyPieceStore: no piece key configured")
+	}
+
+	plaintext, err := json.Marshal(ks.toRecords())
+	if err != nil {
+		Log.Error("Failed encoding KeyPieceStore:", err)
+		return fmt.Errorf("failed encoding KeyPieceStore: %s", err)
+	}
+
+	aad := pieceFileAAD(pieceFileVersion, sealer.source, sealer.salt)
+	sealed, err := keyman.Seal(sealer.kek, plaintext, aad)
+	if err != nil {
+		Log.Error("Failed sealing KeyPieceStore:", err)
+		return fmt.Errorf("failed sealing KeyPieceStore: %s", err)
+	}
+	payload := append([]byte{sealer.source}, sealer.salt...)
+	payload = append(payload, sealed...)
+
+	err = durable.WriteFile(piecesPath(), keyman.EncodeFile(pieceFileMagic, pieceFileVersion, payload), 0600)
+	if err != nil {
+		Log.Error("Failed to save KeyPieceStore to file:", err)
+		return fmt.Errorf("failed to save KeyPieceStore to file: %s", err)
+	}
+	return nil
+}
+
+// LoadKeyPieces reads the pieces file from the meta directory into
+// HeldKeyPieces. A file in an older format is rewritten straight away.
+func LoadKeyPieces() error {
+	if sealer == nil {
+		return errors.New("no piece key configured")
+	}
+	data, err := ioutil.ReadFile(piecesPath())
+	if err != nil {
+		return err
+	}
+
+	var store KeyPieceStore
+	legacy := true
+	switch {
+	case !keyman.HasMagic(pieceFileMagic, data):
+		store, err = decodePieceGob(data)
+	case len(data) > len(pieceFileMagic) && data[len(pieceFileMagic)] == pieceFileSealedGob:
+		if len(data) < pieceFileHeaderLen {
+			return keyman.ErrCorruptFile
+		}
+		header := data[:pieceFileHeaderLen]
+		if err = checkPieceSource(header[len(pieceFileMagic)+1]); err != nil {
+			return err
+		}
+		var plaintext []byte
+		plaintext, err = keyman.Open(sealer.kek, data[pieceFileHeaderLen:], header)
+		if err != nil {
+			return err
+		}
+		store, err = decodePieceGob(plaintext)
+	default:
+		legacy = false
+		store, err = decodePieceFile(data)
+	}
+	if err != nil {
+		return err
+	}
+
+	keyPieceStoreLock.Lock()
+	defer keyPieceStoreLock.Unlock()
+	for generation, pieces := range store {
+		HeldKeyPieces[generation] = pieces
+	}
+	if legacy {
+		Log.Info("Converting pieces file to the current format")
+		return HeldKeyPieces.SaveToDisk()
+	}
+	return nil
+}
+
+// checkPieceSource makes sure the pieces file was sealed with the kind of
+// key-encryption-key that has been configured.
+func checkPieceSource(source byte) error {
+	if source == sealer.source {
+		return nil
+	}
+	if source == kekFromPassphrase {
+		return errors.New("pieces file is protected by a passphrase but none was given")
+	}
+	return errors.New("pieces file is protected by a key file but a passphrase was given")
+}
+
+// decodePieceFile opens a pieces file in the current format.
+func decodePieceFile(data []byte) (KeyPieceStore, error) {
+	version, payload, err := keyman.DecodeFile(pieceFileMagic, data)
+	if err != nil {
+		return nil, err
+	}
+	if version != pieceFileVersion {
+		return nil, fmt.Errorf("unsupported pieces file version %d", version)
+	}
+	if len(payload) < pieceFilePayloadPrefix {
+		return nil, keyman.ErrCorruptFile
+	}
+	source, salt := payload[0], payload[1:pieceFilePayloadPrefix]
+	if err := checkPieceSource(source); err != nil {
+		return nil, err
+	}
+	plaintext, err := keyman.Open(sealer.kek, payload[pieceFilePayloadPrefix:], pieceFileAAD(version, source, salt))
+	if err != nil {
+		return nil, err
+	}
+
+	var records []pieceRecord
+	err = json.Unmarshal(plaintext, &records)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding KeyPiece data: %s", err)
+	}
+	return storeFromRecords(records)
+}
+
+// decodePieceGob decodes the gob encoding used by older pieces files.
+func decodePieceGob(data []byte) (KeyPieceStore, error) {
+	store := make(KeyPieceStore)
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&store)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding GOB KeyPiece data: %s", err)
+	}
+	return store, nil
+}
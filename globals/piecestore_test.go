@@ -0,0 +1,221 @@
+// +build !integration
+
+package globals
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pp2p/paranoid/logger"
+	"github.com/pp2p/pfsd/keyman"
+)
+
+// The files in testdata hold the same two pieces in each format the pieces
+// file has had, sealed with the key in testdata/piece.key where the format is
+// sealed. Only the current format records owner common names and
+// commitments.
+const testPieceKey = "testdata/piece.key"
+
+func TestMain(m *testing.M) {
+	Log = logger.New("globals", "pfsd", os.DevNull)
+	os.Exit(m.Run())
+}
+
+func fingerprint(b byte) (f [32]byte) {
+	for i := range f {
+		f[i] = b
+	}
+	return f
+}
+
+func testPieces(current bool) KeyPieceStore {
+	a := &keyman.KeyPiece{
+		Data:              []byte("piece of node-a"),
+		ParentFingerprint: fingerprint(0xa1),
+		Prime:             big.NewInt(7919),
+		Seq:               1,
+	}
+	b := &keyman.KeyPiece{
+		Data:              []byte("piece of node-b"),
+		ParentFingerprint: fingerprint(0xb2),
+		Prime:             big.NewInt(104729),
+		Seq:               2,
+	}
+	if current {
+		a.Commitments = []*big.Int{big.NewInt(3), big.NewInt(5)}
+		a.OwnerCommonName = "a.example.com"
+	}
+	return KeyPieceStore{
+		1: KeyPieceMap{"node-a": a},
+		2: KeyPieceMap{"node-b": b},
+	}
+}
+
+func samePiece(a, b *keyman.KeyPiece) bool {
+	if !bytes.Equal(a.Data, b.Data) || a.ParentFingerprint != b.ParentFingerprint ||
+		a.Prime.Cmp(b.Prime) != 0 || a.Seq != b.Seq || a.OwnerCommonName != b.OwnerCommonName ||
+		len(a.Commitments) != len(b.Commitments) {
+		return false
+	}
+	for i := range a.Commitments {
+		if a.Commitments[i].Cmp(b.Commitments[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func checkPieces(t *testing.T, expected KeyPieceStore) {
+	if len(HeldKeyPieces) != len(expected) {
+		t.Fatalf("Expected %d generations, got %d", len(expected), len(HeldKeyPieces))
+	}
+	for generation, pieces := range expected {
+		for owner, piece := range pieces {
+			held := HeldKeyPieces.GetPiece(generation, owner)
+			if held == nil {
+				t.Errorf("No piece of %s in generation %d", owner, generation)
+			} else if !samePiece(held, piece) {
+				t.Errorf("Piece of %s in generation %d is %+v, expected %+v", owner, generation, held, piece)
+			}
+		}
+	}
+}
+
+// setupPieceStore creates a paranoid directory holding the given pieces file
+// and seals pieces with the test key.
+func setupPieceStore(t *testing.T, fixture string) func() {
+	dir, err := ioutil.TempDir("", "piecestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path.Join(dir, "meta"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	ParanoidDir = dir
+	HeldKeyPieces = make(KeyPieceStore)
+	if fixture != "" {
+		data, err := ioutil.ReadFile(path.Join("testdata", fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(piecesPath(), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := UsePieceKeyFile(testPieceKey); err != nil {
+		t.Fatal("Could not use piece key:", err)
+	}
+	return func() {
+		os.RemoveAll(dir)
+		HeldKeyPieces = make(KeyPieceStore)
+		sealer = nil
+	}
+}
+
+// reloadPieces forgets the held pieces and loads them from disk again.
+func reloadPieces(t *testing.T) {
+	HeldKeyPieces = make(KeyPieceStore)
+	if err := LoadKeyPieces(); err != nil {
+		t.Fatal("Could not reload pieces:", err)
+	}
+}
+
+func TestLoadLegacyPieces(t *testing.T) {
+	for _, fixture := range []string{"pieces-gob", "pieces-v1"} {
+		cleanup := setupPieceStore(t, fixture)
+		if err := LoadKeyPieces(); err != nil {
+			t.Fatalf("Could not load %s: %v", fixture, err)
+		}
+		checkPieces(t, testPieces(false))
+
+		data, err := ioutil.ReadFile(piecesPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version, _, err := keyman.DecodeFile(pieceFileMagic, data); err != nil || version != pieceFileVersion {
+			t.Errorf("%s was not converted: version %d, error %v", fixture, version, err)
+		}
+		reloadPieces(t)
+		checkPieces(t, testPieces(false))
+		cleanup()
+	}
+}
+
+func TestLoadPieces(t *testing.T) {
+	cleanup := setupPieceStore(t, "pieces-v2")
+	defer cleanup()
+	if err := LoadKeyPieces(); err != nil {
+		t.Fatal("Could not load pieces:", err)
+	}
+	checkPieces(t, testPieces(true))
+}
+
+func TestPiecesRoundTrip(t *testing.T) {
+	cleanup := setupPieceStore(t, "")
+	defer cleanup()
+	for generation, pieces := range testPieces(true) {
+		for owner, piece := range pieces {
+			if err := HeldKeyPieces.AddPiece(generation, owner, piece); err != nil {
+				t.Fatal("Could not add piece:", err)
+			}
+		}
+	}
+	reloadPieces(t)
+	checkPieces(t, testPieces(true))
+
+	if err := HeldKeyPieces.DeletePiece(2, "node-b"); err != nil {
+		t.Fatal("Could not delete piece:", err)
+	}
+	reloadPieces(t)
+	expected := testPieces(true)
+	delete(expected, 2)
+	checkPieces(t, expected)
+}
+
+func TestPiecesWrongKey(t *testing.T) {
+	for _, fixture := range []string{"pieces-v1", "pieces-v2"} {
+		cleanup := setupPieceStore(t, fixture)
+		sealer.kek = bytes.Repeat([]byte{0x24}, keyman.KEKSize)
+		if err := LoadKeyPieces(); err == nil {
+			t.Errorf("%s was opened with the wrong key", fixture)
+		}
+		if len(HeldKeyPieces) != 0 {
+			t.Errorf("Pieces were loaded from %s with the wrong key", fixture)
+		}
+		cleanup()
+	}
+}
+
+func TestPiecesWrongSource(t *testing.T) {
+	cleanup := setupPieceStore(t, "pieces-v2")
+	defer cleanup()
+	if err := UsePiecePassphrase([]byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadKeyPieces(); err == nil {
+		t.Error("Pieces sealed with a key file were opened with a passphrase")
+	}
+}
+
+func TestTruncatedPieces(t *testing.T) {
+	for _, fixture := range []string{"pieces-gob", "pieces-v1", "pieces-v2"} {
+		data, err := ioutil.ReadFile(path.Join("testdata", fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, length := range []int{len(pieceFileMagic) + 1, pieceFileHeaderLen, len(data) - 1} {
+			cleanup := setupPieceStore(t, "")
+			if err := ioutil.WriteFile(piecesPath(), data[:length], 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := LoadKeyPieces(); err == nil {
+				t.Errorf("%s truncated to %d bytes was loaded", fixture, length)
+			}
+			cleanup()
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package intercom
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/rpc"
@@ -11,6 +12,8 @@ import (
 
 	"github.com/pp2p/paranoid/raft"
 	"github.com/pp2p/pfsd/globals"
+	"github.com/pp2p/pfsd/keyman"
+	"github.com/pp2p/pfsd/pnetclient"
 )
 
 // Message constants
@@ -18,6 +21,22 @@ const (
 	StatusNetworkOff string = "Networking disabled"
 )
 
+// PassphraseChanged is called by ChangePassphrase with the new passphrase
+// before the rewrapped key is saved, so that pfsd can use it when it next
+// starts. If saving fails it is called again with the old passphrase.
+var PassphraseChanged func(passphrase []byte) error
+
+// BeginPassphraseChange is called by ChangePassphrase before the key is
+// rewrapped, and the function it returns once the key has been saved. It
+// fails while the key is being rotated, as the new key is wrapped with the
+// passphrase given when the rotation was started.
+var BeginPassphraseChange func() (end func(), err error)
+
+// RotateKey is called by RotateKey to start rotating the encryption key. The
+// filesystem is locked before it returns. The passphrase is only needed if
+// networking is disabled.
+var RotateKey func(passphrase []byte) error
+
 // IntercomServer listens on a Unix socket to respond to questions asked by
 // external applications.
 type IntercomServer struct{}
@@ -31,6 +50,11 @@ type StatusResponse struct {
 	Status    string
 	TLSActive bool
 	Port      int
+	// Locked is true while the key of an encrypted filesystem is still being
+	// collected from peers
+	Locked      bool
+	LockedSince time.Time
+	LockReason  string
 }
 
 // ListNodesResponse with all Nodes
@@ -38,6 +62,46 @@ type ListNodesResponse struct {
 	Nodes []raft.Node
 }
 
+// ChangePassphraseRequest with the current and new filesystem passphrase
+type ChangePassphraseRequest struct {
+	OldPassphrase []byte
+	NewPassphrase []byte
+}
+
+// RotateKeyRequest with the passphrase of an encrypted filesystem with
+// networking disabled
+type RotateKeyRequest struct {
+	Passphrase []byte
+}
+
+// BackupKeyRequest with the number of backup shares to create and the number
+// needed to recover the key
+type BackupKeyRequest struct {
+	Shares         int64
+	RequiredShares int64
+}
+
+// BackupKeyResponse with the printable backup shares
+type BackupKeyResponse struct {
+	Shares []string
+}
+
+// KeyStateResponse with a copy of the key state machine
+type KeyStateResponse struct {
+	State keyman.StateSummary
+}
+
+// HeldPiecesResponse with the key pieces held by this node
+type HeldPiecesResponse struct {
+	Pieces []globals.HeldPiece
+}
+
+// ReplicationResponse with the replication state of the key pieces of this
+// node
+type ReplicationResponse struct {
+	Status pnetclient.ReplicationStatus
+}
+
 // ConfirmUp is simple method that paranoid-cli uses to ping PFSD
 func (s *IntercomServer) ConfirmUp(req *EmptyMessage, resp *EmptyMessage) error {
 	return nil
@@ -45,6 +109,13 @@ func (s *IntercomServer) ConfirmUp(req *EmptyMessage, resp *EmptyMessage) error
 
 // Status provides health data for the current node.
 func (s *IntercomServer) Status(req *EmptyMessage, resp *StatusResponse) error {
+	lockState := globals.GetLockState()
+	resp.Locked = lockState.Locked
+	if lockState.Locked {
+		resp.LockedSince = lockState.Since
+		resp.LockReason = lockState.Reason
+	}
+
 	if globals.NetworkOff {
 		resp.Uptime = time.Since(globals.BootTime)
 		resp.Status = StatusNetworkOff
@@ -58,27 +129,39 @@ func (s *IntercomServer) Status(req *EmptyMessage, resp *StatusResponse) error {
 	}
 
 	resp.Uptime = time.Since(globals.BootTime)
-	if globals.RaftNetworkServer != nil {
-		switch globals.RaftNetworkServer.State.GetCurrentState() {
-		case raft.FOLLOWER:
-			resp.Status = "Follower"
-		case raft.CANDIDATE:
-			resp.Status = "Candidate"
-		case raft.LEADER:
-			resp.Status = "Leader"
-		case raft.INACTIVE:
-			resp.Status = "Raft Inactive"
-		}
-	} else {
-		resp.Status = "Networking Disabled"
-	}
+	resp.Status = raftStatus()
 	resp.TLSActive = globals.TLSEnabled
 	resp.Port = thisport
 	return nil
 }
 
+// raftStatus describes the state of raft on this node. Raft is only running
+// while the filesystem is unlocked.
+func raftStatus() string {
+	if !globals.BeginOperation() {
+		return "Raft Inactive"
+	}
+	defer globals.EndOperation()
+	if globals.RaftNetworkServer == nil {
+		return "Networking Disabled"
+	}
+	switch globals.RaftNetworkServer.State.GetCurrentState() {
+	case raft.FOLLOWER:
+		return "Follower"
+	case raft.CANDIDATE:
+		return "Candidate"
+	case raft.LEADER:
+		return "Leader"
+	}
+	return "Raft Inactive"
+}
+
 // ListNodes that pfsd is connected to
 func (s *IntercomServer) ListNodes(req *EmptyMessage, resp *ListNodesResponse) error {
+	if !globals.BeginOperation() {
+		return errors.New("filesystem is locked")
+	}
+	defer globals.EndOperation()
 	if globals.RaftNetworkServer == nil {
 		return fmt.Errorf("Networking Disabled")
 	}
@@ -86,6 +169,129 @@ func (s *IntercomServer) ListNodes(req *EmptyMessage, resp *ListNodesResponse) e
 	return nil
 }
 
+// ChangePassphrase rewraps the key of an encrypted filesystem with networking
+// disabled using a new passphrase. The data itself does not need to be
+// re-encrypted as the key does not change.
+func (s *IntercomServer) ChangePassphrase(req *ChangePassphraseRequest, resp *EmptyMessage) error {
+	if !globals.NetworkOff || !globals.Encrypted {
+		return errors.New("only the key of an encrypted filesystem with networking disabled has a passphrase")
+	}
+	if len(req.NewPassphrase) == 0 {
+		return errors.New("new passphrase must not be empty")
+	}
+	if globals.Locked() {
+		return errors.New("filesystem is locked")
+	}
+	if BeginPassphraseChange != nil {
+		end, err := BeginPassphraseChange()
+		if err != nil {
+			return fmt.Errorf("unable to change passphrase: %s", err)
+		}
+		defer end()
+	}
+
+	attributes, err := globals.ReadFileSystemAttributes()
+	if err != nil {
+		Log.Error("Could not read file system attributes:", err)
+		return fmt.Errorf("failed reading file system attributes: %s", err)
+	}
+	if attributes.WrappedKey == nil {
+		return errors.New("no encryption key is stored for this filesystem")
+	}
+	key, err := keyman.UnwrapKey(attributes.WrappedKey, req.OldPassphrase)
+	if err != nil {
+		return errors.New("current passphrase is incorrect")
+	}
+	attributes.WrappedKey, err = keyman.WrapKey(key, req.NewPassphrase)
+	if err != nil {
+		Log.Error("Could not wrap key with new passphrase:", err)
+		return fmt.Errorf("failed wrapping key: %s", err)
+	}
+	if PassphraseChanged != nil {
+		err = PassphraseChanged(req.NewPassphrase)
+		if err != nil {
+			Log.Error("Could not store new passphrase:", err)
+			return fmt.Errorf("failed storing new passphrase: %s", err)
+		}
+	}
+	err = globals.SaveFileSystemAttributes(attributes)
+	if err != nil {
+		Log.Error("Could not save file system attributes:", err)
+		if PassphraseChanged != nil {
+			if err := PassphraseChanged(req.OldPassphrase); err != nil {
+				Log.Error("Could not restore old passphrase:", err)
+			}
+		}
+		return fmt.Errorf("failed saving file system attributes: %s", err)
+	}
+	Log.Info("Filesystem passphrase changed")
+	return nil
+}
+
+// BackupKey splits the key of an unlocked encrypted filesystem into printable
+// shares which can be stored offline and used to recover the key if too few
+// nodes are left to unlock it.
+func (s *IntercomServer) BackupKey(req *BackupKeyRequest, resp *BackupKeyResponse) error {
+	if !globals.Encrypted {
+		return errors.New("filesystem is not encrypted")
+	}
+	key := globals.GetEncryptionKey()
+	if key == nil {
+		return errors.New("filesystem is locked")
+	}
+
+	shares, err := keyman.GenerateBackupShares(key, req.Shares, req.RequiredShares)
+	if err != nil {
+		Log.Error("Could not create key backup shares:", err)
+		return fmt.Errorf("failed creating backup shares: %s", err)
+	}
+	resp.Shares = shares
+	Log.Infof("Created %d key backup shares, %d of which are needed to recover the key",
+		req.Shares, req.RequiredShares)
+	return nil
+}
+
+// RotateKey replaces the encryption key of this node with a new one. The
+// rotation is offline: the filesystem is locked before RotateKey returns, and
+// stays locked until every file has been re-encrypted. The new key is then
+// shared with the other nodes through a new generation. The progress is shown
+// by Status.
+func (s *IntercomServer) RotateKey(req *RotateKeyRequest, resp *EmptyMessage) error {
+	if RotateKey == nil {
+		return errors.New("key rotation is not available")
+	}
+	err := RotateKey(req.Passphrase)
+	if err != nil {
+		Log.Error("Could not rotate key:", err)
+		return fmt.Errorf("failed rotating key: %s", err)
+	}
+	return nil
+}
+
+// KeyState returns the generations tracked by the key state machine, including
+// which owners have pieces held by which nodes.
+func (s *IntercomServer) KeyState(req *EmptyMessage, resp *KeyStateResponse) error {
+	if keyman.StateMachine == nil {
+		return errors.New("key state machine is not running")
+	}
+	resp.State = keyman.StateMachine.Summary()
+	return nil
+}
+
+// HeldPieces lists the key pieces held by this node. The pieces themselves
+// are not returned.
+func (s *IntercomServer) HeldPieces(req *EmptyMessage, resp *HeldPiecesResponse) error {
+	resp.Pieces = globals.HeldKeyPieces.ListPieces()
+	return nil
+}
+
+// Replication reports how well the key pieces of this node are replicated,
+// including any under-replicated generations.
+func (s *IntercomServer) Replication(req *EmptyMessage, resp *ReplicationResponse) error {
+	resp.Status = pnetclient.GetReplicationStatus()
+	return nil
+}
+
 // RunServer starts the intercom server on a socket stored in the specified
 // meta directory
 func RunServer(metaDir string) {
@@ -100,6 +306,11 @@ func RunServer(metaDir string) {
 	if err != nil {
 		Log.Fatalf("Failed to listen on %s: %s\n", socketPath, err)
 	}
+	// The socket gives access to the key backup, so only the owner may use it.
+	err = os.Chmod(socketPath, 0600)
+	if err != nil {
+		Log.Fatalf("Failed to set permissions of %s: %s\n", socketPath, err)
+	}
 	globals.Wait.Add(1)
 	go func() {
 		defer globals.Wait.Done()
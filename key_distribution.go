@@ -1,9 +1,12 @@
 package main
 
 import (
-	"encoding/gob"
+	"errors"
+	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,7 +18,8 @@ import (
 )
 
 const unlockQueryInterval time.Duration = time.Second * 10
-const unlockTimeout time.Duration = time.Minute * 10
+const minUnlockRetryInterval time.Duration = time.Second * 30
+const maxUnlockRetryInterval time.Duration = time.Minute * 10
 const lockWaitDuration time.Duration = time.Minute * 1
 
 type keyResponse struct {
@@ -35,20 +39,89 @@ func requestKeyPiece(uuid string, generation int64, recievedPieceChan chan keyRe
 	}
 }
 
-// Unlock the state machine. This might fail terribly
-func Unlock() {
+// errUnlockStopped is returned by Unlock when pfsd is shutting down
+var errUnlockStopped = errors.New("pfsd is shutting down")
+
+// unlockInBackground retries Unlock until it succeeds or pfsd stops. The
+// filesystem stays locked in the meantime. Once unlocked, an interrupted key
+// rotation is resumed, raft is started and the node rejoins the cluster.
+func unlockInBackground(password string) {
+	defer globals.Wait.Done()
+	delay := minUnlockRetryInterval
+	for {
+		err := Unlock()
+		if err == nil {
+			err = resumeKeyRotation(nil)
+			if err == errUnlockStopped {
+				return
+			}
+			if err != nil {
+				log.Fatal("Unable to resume key rotation:", err)
+			}
+			err = restartWithRaft()
+			if err == errUnlockStopped {
+				return
+			}
+			if err != nil {
+				log.Fatal("Unable to start raft:", err)
+			}
+			globals.SetLockState(false, "")
+			log.Info("Successfully unlocked system.")
+			joinCluster(password)
+			return
+		}
+		if err == errUnlockStopped {
+			return
+		}
+		globals.SetLockState(true, err.Error())
+		log.Warnf("Unable to unlock system, retrying in %s: %s", delay, err)
+
+		select {
+		case _, ok := <-globals.Quit:
+			if !ok {
+				return
+			}
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxUnlockRetryInterval {
+			delay = maxUnlockRetryInterval
+		}
+	}
+}
+
+// Unlock the filesystem by collecting enough key pieces from its peers to
+// rebuild the key. It gives up after unlockTimeout.
+func Unlock() error {
 	timer := time.NewTimer(0)
 	defer timer.Stop()
-	timeout := time.After(unlockTimeout)
+	timeout := time.After(*unlockTimeout)
 
 	generation := keyman.StateMachine.GetCurrentGeneration()
 	if generation == -1 {
-		log.Fatal("Failed to unlock system, not part of a generation")
+		return errors.New("not part of a generation")
 	}
 
 	peers, err := keyman.StateMachine.GetNodes(generation)
 	if err != nil {
-		log.Fatal("Failed to unlock system:", err)
+		return err
+	}
+	// Nodes outside the generation may hold a piece in place of a member.
+	holders, err := keyman.StateMachine.GetHolders(generation, globals.ThisNode.UUID)
+	if err != nil {
+		return err
+	}
+	for _, holder := range holders {
+		found := false
+		for _, v := range peers {
+			if v == holder {
+				found = true
+				break
+			}
+		}
+		if !found {
+			peers = append(peers, holder)
+		}
 	}
 	for i := 0; i < len(peers); i++ {
 		if peers[i] == globals.ThisNode.UUID {
@@ -57,19 +130,59 @@ func Unlock() {
 		}
 	}
 
-	var pieces []*keyman.KeyPiece
-	pieces = append(pieces, globals.HeldKeyPieces.GetPiece(generation, globals.ThisNode.UUID))
+	threshold, err := keyman.StateMachine.GetThreshold(generation)
+	if err != nil {
+		return err
+	}
+
+	ownPiece := globals.HeldKeyPieces.GetPiece(generation, globals.ThisNode.UUID)
+	if ownPiece == nil {
+		return errors.New("the key piece of this node is missing")
+	}
+	if len(ownPiece.Commitments) == 0 {
+		log.Warn("Key pieces of generation", generation, "have no commitments and can not be verified")
+	}
+	var pieces []keyman.SuppliedPiece
+	pieces = append(pieces, keyman.SuppliedPiece{Holder: globals.ThisNode.UUID, Piece: ownPiece})
+
+	// A generation of a single node, or with a fixed threshold of one piece,
+	// does not need any peers.
+	if threshold <= 1 {
+		return useKeyPieces(pieces, threshold)
+	}
 
 	recievedPieceChan := make(chan keyResponse, len(peers))
 	var keyRequestWait sync.WaitGroup
+	// Requests still in flight when this returns must not block forever.
+	defer func() {
+		done := make(chan bool)
+		go func() {
+			keyRequestWait.Wait()
+			close(done)
+		}()
+		go func() {
+			for {
+				select {
+				case <-recievedPieceChan:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}()
 
 	for {
 		select {
+		case _, ok := <-globals.Quit:
+			if !ok {
+				return errUnlockStopped
+			}
 		case <-timeout:
-			log.Fatal("Failed to unlock system before timeout")
+			return fmt.Errorf("only %d of %d key pieces collected before timeout", len(pieces), threshold)
 		case <-timer.C:
 			if len(peers) == 0 {
-				log.Fatal("No peers to request peers from")
+				return fmt.Errorf("no peers left to request key pieces from, %d of %d collected",
+					len(pieces), threshold)
 			}
 			for i := 0; i < len(peers); i++ {
 				keyRequestWait.Add(1)
@@ -79,63 +192,111 @@ func Unlock() {
 					requestKeyPiece(peers[x], generation, recievedPieceChan)
 				}()
 			}
+			globals.SetLockState(true, fmt.Sprintf("%d of %d key pieces collected", len(pieces), threshold))
 			timer.Reset(unlockQueryInterval)
 		case keyData := <-recievedPieceChan:
 			for i := 0; i < len(peers); i++ {
 				if peers[i] == keyData.uuid {
-					pieces = append(pieces, keyData.piece)
 					peers = append(peers[:i], peers[i+1:]...)
-					key, err := keyman.RebuildKey(pieces)
-					if err != nil {
-						log.Warn("Could not rebuild key:", err)
+					if err := keyman.VerifyPieceFrom(keyData.piece, ownPiece); err != nil {
+						log.Warnf("Rejecting key piece from node %s: %s", keyData.uuid, err)
 						break
 					}
-					globals.EncryptionKey = key
-					cipherB, err := encryption.GenerateAESCipherBlock(globals.EncryptionKey.GetBytes())
-					if err != nil {
-						log.Fatal("unable to generate cipher block:", err)
+					pieces = append(pieces, keyman.SuppliedPiece{Holder: keyData.uuid, Piece: keyData.piece})
+					if int64(len(pieces)) < threshold {
+						break
 					}
-					encryption.SetCipher(cipherB)
-
-					done := make(chan bool, 1)
-					go func() {
-						keyRequestWait.Wait()
-						done <- true
-					}()
-					for {
-						select {
-						case <-recievedPieceChan:
-						case <-done:
-							log.Info("Successfully unlocked system.")
-							return
-						}
+					if err := useKeyPieces(pieces, threshold); err != nil {
+						log.Warn("Could not rebuild key:", err)
+						break
 					}
+					return nil
 				}
 			}
 		}
 	}
 }
 
+// useKeyPieces rebuilds the key from the collected pieces and starts using it.
+func useKeyPieces(pieces []keyman.SuppliedPiece, threshold int64) error {
+	key, badHolders, err := keyman.RecoverKey(pieces, threshold)
+	for _, holder := range badHolders {
+		log.Warnf("Node %s supplied an incorrect key piece", holder)
+	}
+	if err != nil {
+		return err
+	}
+	cipherB, err := encryption.GenerateAESCipherBlock(key.GetBytes())
+	if err != nil {
+		return fmt.Errorf("unable to generate cipher block: %s", err)
+	}
+	encryption.SetCipher(cipherB)
+	globals.SetEncryptionKey(key)
+	return nil
+}
+
 // LoadPieces from the meta directory
 func LoadPieces() {
 	if _, err := os.Stat(path.Join(globals.ParanoidDir, "meta", "pieces")); os.IsNotExist(err) {
 		log.Info("Filesystem not locked. Will not attepmt to load KeyPieces.")
 		return
 	}
-	piecePath := path.Join(globals.ParanoidDir, "meta", "pieces")
-	file, err := os.Open(piecePath)
+	err := globals.LoadKeyPieces()
 	if err != nil {
-		// If the file doesn't exist, ignore it, because it could just be the first run.
-		if os.IsNotExist(err) {
-			log.V(1).Infof("KeyPiece GOB file %s does not exist.", piecePath)
-			return
+		log.Fatal("Unable to load KeyPieces:", err)
+	}
+}
+
+// setupPieceSealing configures the key used to protect the key pieces stored
+// in the meta directory. A key file next to the pieces does not protect them
+// from anyone able to read the paranoid directory, so one may only be given
+// outside it, and the default in meta/ is refused for encrypted filesystems
+// which hold pieces.
+func setupPieceSealing() error {
+	if *piecePassphraseFile != "" {
+		passphrase, err := readSecretFile(*piecePassphraseFile)
+		if err != nil {
+			return fmt.Errorf("could not read piece passphrase file: %v", err)
+		}
+		defer zeroBytes(passphrase)
+		return globals.UsePiecePassphrase(passphrase)
+	}
+
+	if *pieceKeyFile != "" {
+		inside, err := inParanoidDir(*pieceKeyFile)
+		if err != nil {
+			return fmt.Errorf("could not resolve piece key file: %v", err)
 		}
-		log.Fatalf("Unable to open %s for reading pieces: %s", piecePath, file)
+		if inside {
+			return fmt.Errorf("piece key file %s must not be stored in the paranoid directory", *pieceKeyFile)
+		}
+		return globals.UsePieceKeyFile(*pieceKeyFile)
+	}
+
+	attributes, err := globals.ReadFileSystemAttributes()
+	if err != nil {
+		return fmt.Errorf("could not read file system attributes: %v", err)
+	}
+	if attributes.Encrypted && !attributes.NetworkOff {
+		return errors.New("key pieces of an encrypted filesystem must be protected with a piece_key_file " +
+			"outside the paranoid directory or a piece_passphrase_file")
+	}
+	return globals.UsePieceKeyFile(path.Join(globals.ParanoidDir, "meta", "piece_key"))
+}
+
+// inParanoidDir reports whether file is inside the paranoid directory.
+func inParanoidDir(file string) (bool, error) {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return false, err
+	}
+	dir, err := filepath.Abs(globals.ParanoidDir)
+	if err != nil {
+		return false, err
 	}
-	defer file.Close()
-	dec := gob.NewDecoder(file)
-	err = dec.Decode(&globals.HeldKeyPieces)
+	rel, err := filepath.Rel(dir, file)
 	if err != nil {
-		log.Fatal("Failed decoding GOB KeyPiece data:", err)
+		return false, err
 	}
+	return rel != ".." && !strings.HasPrefix(rel, "../"), nil
 }
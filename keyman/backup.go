@@ -0,0 +1,163 @@
+// Printable backup shares of a key, for recovery when too few nodes are left
+// to unlock a filesystem.
+
+package keyman
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// BackupSharePrefix starts every backup share.
+const BackupSharePrefix = "PFSD1"
+
+const (
+	backupShareVersion  byte = 2
+	groupOrderVersion   byte = 1 // Shares modulo GroupOrder, which are much longer
+	backupChecksumSize       = 4
+	backupShareHeader        = 1 + 4 + 2 + 2 + 32 // version, backup ID, seq, required, fingerprint
+	backupShareGroupLen      = 8
+)
+
+var backupEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// backupPrime is the smallest prime above 2^256. Shares are split modulo it
+// rather than GroupOrder, so that each share is no larger than the key. They
+// are not verified against commitments, which would need the larger group.
+var backupPrime = new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(297))
+
+var backupModulus = mustModulus(backupPrime)
+
+// ErrBackupShareChecksum is returned when a backup share has been mistyped or
+// damaged.
+var ErrBackupShareChecksum = errors.New("backup share checksum does not match, check for typing errors")
+
+// BackupShare is a KeyPiece decoded from a backup share.
+type BackupShare struct {
+	Piece          *KeyPiece
+	RequiredShares int64
+	// Random identifier shared by every share of one backup, as shares of
+	// two backups of the same key can not be combined.
+	BackupID uint32
+}
+
+// GenerateBackupShares splits a key into numShares printable shares, any
+// requiredShares of which rebuild the key.
+func GenerateBackupShares(key *Key, numShares, requiredShares int64) ([]string, error) {
+	if numShares > 0xffff || requiredShares > 0xffff {
+		return nil, errors.New("too many backup shares requested")
+	}
+	pieces, _, err := splitKey(key, numShares, requiredShares, backupModulus, backupPrime)
+	if err != nil {
+		return nil, err
+	}
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, fmt.Errorf("could not generate backup ID: %s", err)
+	}
+	shares := make([]string, len(pieces))
+	for i, piece := range pieces {
+		shares[i] = encodeBackupShare(piece, requiredShares, id)
+	}
+	return shares, nil
+}
+
+func encodeBackupShare(piece *KeyPiece, requiredShares int64, id [4]byte) string {
+	var buf bytes.Buffer
+	buf.WriteByte(backupShareVersion)
+	buf.Write(id[:])
+	binary.Write(&buf, binary.BigEndian, uint16(piece.Seq))
+	binary.Write(&buf, binary.BigEndian, uint16(requiredShares))
+	buf.Write(piece.ParentFingerprint[:])
+	buf.Write(piece.Data)
+	checksum := sha256.Sum256(buf.Bytes())
+	buf.Write(checksum[:backupChecksumSize])
+
+	encoded := backupEncoding.EncodeToString(buf.Bytes())
+	groups := []string{BackupSharePrefix}
+	for len(encoded) > backupShareGroupLen {
+		groups = append(groups, encoded[:backupShareGroupLen])
+		encoded = encoded[backupShareGroupLen:]
+	}
+	groups = append(groups, encoded)
+	return strings.Join(groups, "-")
+}
+
+// DecodeBackupShare parses a share created by GenerateBackupShares. Case,
+// whitespace and dashes are ignored so that typed in shares are accepted.
+func DecodeBackupShare(share string) (*BackupShare, error) {
+	share = strings.ToUpper(strings.Join(strings.Fields(share), ""))
+	share = strings.Replace(share, "-", "", -1)
+	if !strings.HasPrefix(share, BackupSharePrefix) {
+		return nil, errors.New("not a pfsd backup share")
+	}
+	data, err := backupEncoding.DecodeString(strings.TrimPrefix(share, BackupSharePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup share: %s", err)
+	}
+	if len(data) <= backupShareHeader+backupChecksumSize {
+		return nil, errors.New("backup share is too short")
+	}
+
+	body := data[:len(data)-backupChecksumSize]
+	checksum := sha256.Sum256(body)
+	if !bytes.Equal(checksum[:backupChecksumSize], data[len(body):]) {
+		return nil, ErrBackupShareChecksum
+	}
+	var prime *big.Int
+	switch body[0] {
+	case backupShareVersion:
+		prime = backupPrime
+	case groupOrderVersion:
+		prime = GroupOrder
+	default:
+		return nil, fmt.Errorf("unsupported backup share version %d", body[0])
+	}
+
+	piece := &KeyPiece{
+		Data:  append([]byte(nil), body[backupShareHeader:]...),
+		Prime: prime,
+		Seq:   int64(binary.BigEndian.Uint16(body[5:7])),
+	}
+	copy(piece.ParentFingerprint[:], body[9:backupShareHeader])
+	if err := CheckPiece(piece); err != nil {
+		return nil, err
+	}
+	return &BackupShare{
+		Piece:          piece,
+		RequiredShares: int64(binary.BigEndian.Uint16(body[7:9])),
+		BackupID:       binary.BigEndian.Uint32(body[1:5]),
+	}, nil
+}
+
+// RecoverFromBackupShares rebuilds a key from decoded backup shares. Shares
+// must all come from the same split and there must be enough of them.
+func RecoverFromBackupShares(shares []*BackupShare) (*Key, error) {
+	if len(shares) == 0 {
+		return nil, ErrNotEnoughPieces
+	}
+	seen := make(map[int64]bool)
+	pieces := make([]*KeyPiece, 0, len(shares))
+	for _, v := range shares {
+		if v.BackupID != shares[0].BackupID || v.RequiredShares != shares[0].RequiredShares ||
+			v.Piece.ParentFingerprint != shares[0].Piece.ParentFingerprint {
+			return nil, errors.New("backup shares do not all come from the same backup")
+		}
+		if seen[v.Piece.Seq] {
+			return nil, fmt.Errorf("backup share %d was given more than once", v.Piece.Seq)
+		}
+		seen[v.Piece.Seq] = true
+		pieces = append(pieces, v.Piece)
+	}
+	if int64(len(pieces)) < shares[0].RequiredShares {
+		return nil, ErrNotEnoughPieces
+	}
+	return RebuildKey(pieces)
+}
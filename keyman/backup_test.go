@@ -0,0 +1,91 @@
+// +build !integration
+
+package keyman
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBackupShares(t *testing.T) {
+	key, err := GenerateKey(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := GenerateBackupShares(key, 5, 3)
+	if err != nil {
+		t.Fatal("Unable to generate backup shares:", err)
+	}
+
+	var decoded []*BackupShare
+	for _, share := range []string{shares[4], strings.ToLower(shares[1]), strings.Replace(shares[2], "-", " ", -1)} {
+		backupShare, err := DecodeBackupShare(share)
+		if err != nil {
+			t.Fatal("Unable to decode backup share:", err)
+		}
+		decoded = append(decoded, backupShare)
+	}
+	recovered, err := RecoverFromBackupShares(decoded)
+	if err != nil {
+		t.Fatal("Unable to recover key:", err)
+	}
+	if recovered.GetFingerprint() != key.GetFingerprint() {
+		t.Error("Recovered the wrong key")
+	}
+
+	if _, err := RecoverFromBackupShares(decoded[:2]); err != ErrNotEnoughPieces {
+		t.Error("Expected ErrNotEnoughPieces. Got:", err)
+	}
+
+	// Shares are meant to be written down, so they must stay short.
+	if length := len(strings.Replace(shares[0], "-", "", -1)); length > 130 {
+		t.Error("Backup share is too long:", length, "characters")
+	}
+}
+
+func TestBackupShareTypo(t *testing.T) {
+	key, err := GenerateKey(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := GenerateBackupShares(key, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share := []byte(shares[0])
+	i := len(BackupSharePrefix) + 3
+	if share[i] == 'A' {
+		share[i] = 'B'
+	} else {
+		share[i] = 'A'
+	}
+	if _, err := DecodeBackupShare(string(share)); err != ErrBackupShareChecksum {
+		t.Error("Expected ErrBackupShareChecksum. Got:", err)
+	}
+}
+
+func TestBackupSharesFromDifferentBackups(t *testing.T) {
+	key, err := GenerateKey(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := GenerateBackupShares(key, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := GenerateBackupShares(key, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := DecodeBackupShare(first[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := DecodeBackupShare(second[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RecoverFromBackupShares([]*BackupShare{a, b}); err == nil {
+		t.Error("Expected an error combining shares of different backups")
+	}
+}
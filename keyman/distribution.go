@@ -6,15 +6,17 @@
 package keyman
 
 import (
-	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"math/big"
+
+	"filippo.io/bigmod"
 )
 
-// PrimeSize determines the size of the prime number to be used when creating
-// the key
+// PrimeSize is the size of the random prime used by KeyPieces generated
+// before commitments were added. New KeyPieces use GroupOrder instead.
 const PrimeSize int = 320 // 40 bytes
 
 // KeyPiece stores the individual information about a piece of the key
@@ -23,6 +25,12 @@ type KeyPiece struct {
 	ParentFingerprint [32]byte // The SHA-256 fingerprint of the key it was generated from.
 	Prime             *big.Int // The prime number used in the generation of this KeyPiece.
 	Seq               int64    // Where f(Seq) = Data, for some polynomial f
+	// Commitments to the coefficients of f, shared by every piece of the key.
+	// Empty for pieces received over the network and older pieces.
+	Commitments []*big.Int
+	// The common name of the owner of a piece held for another node, as
+	// authenticated when the piece was received. It is not sent to others.
+	OwnerCommonName string
 }
 
 // FingerMismatchError is rained when the key fingerprint does not match
@@ -36,99 +44,196 @@ func (e *FingerMismatchError) Error() string {
 }
 
 // GeneratePieces from key. The number is defined by numPieces. requiredPieces
-// is the number of KeyPieces needed to reconstruct the original key.
+// is the number of KeyPieces needed to reconstruct the original key. Every
+// piece carries the commitments needed by VerifyPiece. All arithmetic on the
+// key and the coefficients is done in constant time.
 func GeneratePieces(key *Key, numPieces, requiredPieces int64) ([]*KeyPiece, error) {
+	pieces, coefficients, err := splitKey(key, numPieces, requiredPieces, orderModulus, GroupOrder)
+	if err != nil {
+		return nil, err
+	}
+	commitments := commit(coefficients)
+	for _, v := range pieces {
+		v.Commitments = commitments
+	}
+	return pieces, nil
+}
+
+// splitKey splits key into numPieces pieces modulo prime, any requiredPieces
+// of which rebuild it. The coefficients of the polynomial are returned so that
+// they can be committed to.
+func splitKey(key *Key, numPieces, requiredPieces int64, m *bigmod.Modulus, prime *big.Int) ([]*KeyPiece, []*bigmod.Nat, error) {
 	// Some input validation
 	if requiredPieces > numPieces {
-		return nil, errors.New("requiredPieces cannot be longer than numPieces")
+		return nil, nil, errors.New("requiredPieces cannot be longer than numPieces")
 	}
 	if requiredPieces <= 0 || numPieces <= 0 {
-		return nil, errors.New("requiredPieces or numPieces cannot be less than or equal to 0")
+		return nil, nil, errors.New("requiredPieces or numPieces cannot be less than or equal to 0")
 	}
 
-	var keyBig big.Int
-	keyBig.SetBytes(key.GetBytes())
-	prime, _ := rand.Prime(rand.Reader, PrimeSize)
-	coefficients := make([]*big.Int, requiredPieces)
-	coefficients[0] = &keyBig
+	secret, err := secretElement(key.GetBytes(), m)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not use key: %s", err)
+	}
+	coefficients := make([]*bigmod.Nat, requiredPieces)
+	coefficients[0] = secret
 	// I can't believe I have to cast the number 1 to a 64-bit integer ...
 	for i := int64(1); i < requiredPieces; i++ {
-		tmp, _ := rand.Int(rand.Reader, prime)
-		coefficients[i] = tmp
+		coefficients[i], err = randomElement(m)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not generate coefficient: %s", err)
+		}
 	}
 
 	pieces := make([]*KeyPiece, numPieces)
 	for x := int64(1); x <= numPieces; x++ {
-		total := big.NewInt(0)
-		for i := int64(0); i < requiredPieces; i++ {
-			// This computes (coefficient)(x^i)
-			degreeTotal := new(big.Int).Mul(coefficients[i], new(big.Int).Exp(big.NewInt(x), big.NewInt(i), nil))
-			total.Add(total, degreeTotal)
+		// Horner's method: f(x) = a0 + x(a1 + x(a2 + ...))
+		xElement := publicElement(big.NewInt(x), m)
+		total := copyElement(coefficients[requiredPieces-1], m)
+		for i := requiredPieces - 2; i >= 0; i-- {
+			total.Mul(xElement, m)
+			total.Add(coefficients[i], m)
 		}
-		total.Mod(total, prime)
 		pieces[x-1] = &KeyPiece{
-			Data:              total.Bytes(),
+			Data:              total.Bytes(m),
 			ParentFingerprint: key.GetFingerprint(),
 			Prime:             prime,
 			Seq:               x,
 		}
 	}
-	return pieces, nil
+	return pieces, coefficients, nil
 }
 
 // RebuildKey from a set of KeyPieces. This function will succeed iff
-// len(pieces) >= requiredPieces from the Generate function.
+// len(pieces) >= requiredPieces from the Generate function. Pieces created
+// with their own random prime, before GroupOrder was used, are supported.
 func RebuildKey(pieces []*KeyPiece) (*Key, error) {
+	m, err := checkPieceSet(pieces)
+	if err != nil {
+		return nil, err
+	}
+	// The key is f(0)
+	secret, err := interpolate(pieces, 0, m)
+	if err != nil {
+		return nil, err
+	}
+	return keyFromSecret(secret.Bytes(m), pieces[0].ParentFingerprint)
+}
+
+// ExtendPieces returns the piece at seq of the polynomial the given pieces
+// were generated from, so that a piece can be replaced without splitting the
+// key again. As many pieces are needed as to rebuild the key. The new piece
+// is checked against the commitments of the pieces, so pieces without
+// commitments can not be extended.
+func ExtendPieces(pieces []*KeyPiece, seq int64) (*KeyPiece, error) {
+	m, err := checkPieceSet(pieces)
+	if err != nil {
+		return nil, err
+	}
+	if seq < 1 {
+		return nil, fmt.Errorf("invalid piece sequence number %d", seq)
+	}
+	commitments := pieces[0].Commitments
+	if len(commitments) == 0 {
+		return nil, errors.New("key pieces without commitments can not be extended")
+	}
+	if int64(len(pieces)) < int64(len(commitments)) {
+		return nil, ErrNotEnoughPieces
+	}
+	data, err := interpolate(pieces, seq, m)
+	if err != nil {
+		return nil, err
+	}
+	piece := &KeyPiece{
+		Data:              data.Bytes(m),
+		ParentFingerprint: pieces[0].ParentFingerprint,
+		Prime:             pieces[0].Prime,
+		Seq:               seq,
+		Commitments:       commitments,
+	}
+	if err := VerifyPiece(piece, commitments); err != nil {
+		return nil, fmt.Errorf("key pieces are not from the same split: %s", err)
+	}
+	return piece, nil
+}
+
+// checkPieceSet checks that pieces can be interpolated together and returns
+// the modulus of their prime.
+func checkPieceSet(pieces []*KeyPiece) (*bigmod.Modulus, error) {
+	if len(pieces) == 0 {
+		return nil, errors.New("no key pieces given")
+	}
 	fingerprint := pieces[0].ParentFingerprint
+	prime := pieces[0].Prime
+	seen := make(map[int64]bool)
 	for _, v := range pieces {
 		if v.ParentFingerprint != fingerprint {
 			return nil, errors.New("not all pieces come from the same key")
 		}
+		if v.Prime == nil || prime == nil || v.Prime.Cmp(prime) != 0 {
+			return nil, errors.New("not all pieces use the same prime")
+		}
+		if v.Seq < 1 || seen[v.Seq] {
+			return nil, fmt.Errorf("invalid or repeated piece sequence number %d", v.Seq)
+		}
+		seen[v.Seq] = true
 	}
+	return newModulus(prime)
+}
+
+// interpolate uses Lagrange interpolation to find f(x) for the polynomial f
+// the pieces lie on. The Lagrange basis only depends on the public sequence
+// numbers, so it is computed with math/big. The sum over the secret outputs
+// is not.
+func interpolate(pieces []*KeyPiece, x int64, m *bigmod.Modulus) (*bigmod.Nat, error) {
 	prime := pieces[0].Prime
-	inputs := make([]int64, len(pieces))
-	outputs := make([]*big.Int, len(pieces))
-	for i, v := range pieces {
-		inputs[i] = v.Seq
-		var tmp big.Int
-		tmp.SetBytes(v.Data)
-		outputs[i] = &tmp
-	}
-
-	// Use Lagrange interpolation to find out the key, which is f(0)
-	sum := big.NewInt(0)
-	for i := int64(0); i < int64(len(pieces)); i++ {
+	sum := publicElement(big.NewInt(0), m)
+	for i := range pieces {
 		numerator := big.NewInt(1)
 		denominator := big.NewInt(1)
-		for j := int64(0); j < int64(len(pieces)); j++ {
+		for j := range pieces {
 			if j == i {
 				continue
 			}
-			startpos := pieces[i].Seq
-			nextpos := pieces[j].Seq
-			// Go doesn't let you chain big.Int operations, so we have to have
-			// several separate statements instead.
-			numerator.Mul(numerator, big.NewInt(-nextpos))
+			numerator.Mul(numerator, big.NewInt(x-pieces[j].Seq))
 			numerator.Mod(numerator, prime)
-			denominator.Mul(denominator, big.NewInt(startpos-nextpos))
+			denominator.Mul(denominator, big.NewInt(pieces[i].Seq-pieces[j].Seq))
 			denominator.Mod(denominator, prime)
 		}
-		output := outputs[i]
-		tmp := new(big.Int).Mul(output, numerator)
-		tmp.Mul(tmp, denominator.ModInverse(denominator, prime))
-		tmp.Mod(tmp, prime)
-		sum.Add(sum, prime)
-		sum.Add(sum, tmp)
-		sum.Mod(sum, prime)
-	}
-	keyBytes := sum.Bytes()
-	keyFingerprint := sha256.Sum256(keyBytes)
-	if keyFingerprint != pieces[0].ParentFingerprint {
-		// Even if the key is wrong, we return it, for debugging purposes.
-		return &Key{keyBytes, keyFingerprint}, &FingerMismatchError{pieces[0].ParentFingerprint, keyFingerprint}
-	}
-	return &Key{
-		bytes:       keyBytes,
-		fingerprint: keyFingerprint,
-	}, nil
+		if denominator.ModInverse(denominator, prime) == nil {
+			return nil, errors.New("key pieces can not be interpolated")
+		}
+		basis := numerator.Mul(numerator, denominator)
+
+		output, err := secretElement(pieces[i].Data, m)
+		if err != nil {
+			return nil, fmt.Errorf("key piece %d: %s", pieces[i].Seq, err)
+		}
+		output.Mul(publicElement(basis, m), m)
+		sum.Add(output, m)
+	}
+	return sum, nil
+}
+
+// keyFromSecret returns the key of one of the AES key sizes which matches the
+// fingerprint. The secret is zero-extended to the size of the modulus, so the
+// key is found in its last bytes.
+func keyFromSecret(secret []byte, fingerprint [32]byte) (*Key, error) {
+	var keyBytes []byte
+	var keyFingerprint [32]byte
+	for _, size := range []int{32, 24, 16} {
+		if len(secret) < size {
+			continue
+		}
+		keyBytes = append([]byte(nil), secret[len(secret)-size:]...)
+		keyFingerprint = sha256.Sum256(keyBytes)
+		if subtle.ConstantTimeCompare(keyFingerprint[:], fingerprint[:]) == 1 {
+			return &Key{
+				bytes:       keyBytes,
+				fingerprint: keyFingerprint,
+			}, nil
+		}
+	}
+	// Even if the key is wrong, we return it, for debugging purposes.
+	return &Key{keyBytes, keyFingerprint}, &FingerMismatchError{fingerprint, keyFingerprint}
 }
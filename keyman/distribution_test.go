@@ -3,6 +3,9 @@
 package keyman
 
 import (
+	"bytes"
+	"crypto/rand"
+	"math/big"
 	"os"
 	"testing"
 
@@ -69,3 +72,213 @@ func TestUnsortedKeyPieces(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestVerifyPiece(t *testing.T) {
+	if !GroupOrder.ProbablyPrime(20) || !GroupModulus.ProbablyPrime(20) {
+		t.Fatal("Group modulus is not a safe prime")
+	}
+	if new(big.Int).Exp(GroupGenerator, GroupOrder, GroupModulus).Cmp(big.NewInt(1)) != 0 {
+		t.Fatal("Group generator does not generate a subgroup of order GroupOrder")
+	}
+
+	key, err := GenerateKey(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces, err := GeneratePieces(key, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, piece := range pieces {
+		if err := VerifyPiece(piece, pieces[0].Commitments); err != nil {
+			t.Error("Valid piece", piece.Seq, "failed verification:", err)
+		}
+	}
+
+	corrupt := *pieces[1]
+	data := new(big.Int).SetBytes(corrupt.Data)
+	corrupt.Data = data.Add(data, big.NewInt(1)).Bytes()
+	if err := VerifyPiece(&corrupt, pieces[0].Commitments); err != ErrInvalidPiece {
+		t.Error("Expected ErrInvalidPiece for a corrupt piece. Got:", err)
+	}
+
+	other, err := GeneratePieces(key, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyPiece(other[1], pieces[0].Commitments); err != ErrInvalidPiece {
+		t.Error("Expected ErrInvalidPiece for a piece of another split. Got:", err)
+	}
+
+	if err := VerifyPieceFrom(pieces[1], pieces[0]); err != nil {
+		t.Error("Valid piece failed verification against a trusted piece:", err)
+	}
+	if err := VerifyPieceFrom(other[1], pieces[0]); err != ErrInvalidPiece {
+		t.Error("Expected ErrInvalidPiece for a piece of another split. Got:", err)
+	}
+	otherKey, err := GenerateKey(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPieces, err := GeneratePieces(otherKey, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyPieceFrom(otherPieces[1], pieces[0]); err == nil {
+		t.Error("Piece of another key passed verification")
+	}
+}
+
+func TestExtendPieces(t *testing.T) {
+	key, err := GenerateKey(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces, err := GeneratePieces(key, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extended, err := ExtendPieces([]*KeyPiece{pieces[0], pieces[2], pieces[4]}, 2)
+	if err != nil {
+		t.Fatal("Unable to extend pieces:", err)
+	}
+	if !bytes.Equal(extended.Data, pieces[1].Data) {
+		t.Error("Extended piece does not match the piece generated with the key")
+	}
+	extended, err = ExtendPieces(pieces[:3], 9)
+	if err != nil {
+		t.Fatal("Unable to extend pieces:", err)
+	}
+	rebuilt, err := RebuildKey([]*KeyPiece{pieces[3], pieces[4], extended})
+	if err != nil || rebuilt.GetFingerprint() != key.GetFingerprint() {
+		t.Error("Unable to rebuild the key with an extended piece:", err)
+	}
+
+	if _, err := ExtendPieces(pieces[:2], 9); err != ErrNotEnoughPieces {
+		t.Error("Expected ErrNotEnoughPieces. Got:", err)
+	}
+	other, err := GeneratePieces(key, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExtendPieces([]*KeyPiece{pieces[0], pieces[1], other[2]}, 9); err == nil {
+		t.Error("Extended pieces of different splits")
+	}
+}
+
+func TestRecoverKey(t *testing.T) {
+	key, err := GenerateKey(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces, err := GeneratePieces(key, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	holders := []string{"a", "b", "c", "d", "e"}
+	var supplied []SuppliedPiece
+	for i, piece := range pieces {
+		supplied = append(supplied, SuppliedPiece{Holder: holders[i], Piece: piece})
+	}
+
+	corrupt := *pieces[1]
+	data := new(big.Int).SetBytes(corrupt.Data)
+	corrupt.Data = data.Add(data, big.NewInt(1)).Bytes()
+	supplied[1].Piece = &corrupt
+
+	recovered, badHolders, err := RecoverKey(supplied, 3)
+	if err != nil {
+		t.Fatal("Unable to recover key:", err)
+	}
+	if recovered.GetFingerprint() != key.GetFingerprint() {
+		t.Error("Recovered the wrong key")
+	}
+	if len(badHolders) != 1 || badHolders[0] != "b" {
+		t.Error("Incorrect bad holders. Expected: [b] Got:", badHolders)
+	}
+
+	if _, _, err := RecoverKey(supplied[:2], 3); err != ErrNotEnoughPieces {
+		t.Error("Expected ErrNotEnoughPieces. Got:", err)
+	}
+}
+
+// generateLegacyPieces splits a key the way pieces were generated before
+// GroupOrder was used, with a random prime for every split.
+func generateLegacyPieces(t *testing.T, key *Key, numPieces, requiredPieces int64) []*KeyPiece {
+	prime, err := rand.Prime(rand.Reader, PrimeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coefficients := []*big.Int{new(big.Int).SetBytes(key.GetBytes())}
+	for i := int64(1); i < requiredPieces; i++ {
+		c, err := rand.Int(rand.Reader, prime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		coefficients = append(coefficients, c)
+	}
+	var pieces []*KeyPiece
+	for x := int64(1); x <= numPieces; x++ {
+		total := big.NewInt(0)
+		for i, c := range coefficients {
+			total.Add(total, new(big.Int).Mul(c, new(big.Int).Exp(big.NewInt(x), big.NewInt(int64(i)), nil)))
+		}
+		total.Mod(total, prime)
+		pieces = append(pieces, &KeyPiece{
+			Data:              total.Bytes(),
+			ParentFingerprint: key.GetFingerprint(),
+			Prime:             prime,
+			Seq:               x,
+		})
+	}
+	return pieces
+}
+
+func TestRebuildLegacyPieces(t *testing.T) {
+	keyBytes := []byte{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255}
+	key, _ := NewKey(keyBytes)
+	pieces := generateLegacyPieces(t, key, 5, 3)
+
+	rebuilt, err := RebuildKey([]*KeyPiece{pieces[4], pieces[1], pieces[2]})
+	if err != nil {
+		t.Fatal("Unable to rebuild key from legacy pieces:", err)
+	}
+	if rebuilt.GetFingerprint() != key.GetFingerprint() {
+		t.Error("Rebuilt the wrong key")
+	}
+}
+
+func TestRebuildKeyLeadingZero(t *testing.T) {
+	keyBytes := make([]byte, 32)
+	keyBytes[31] = 1
+	key, _ := NewKey(keyBytes)
+	pieces, err := GeneratePieces(key, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := RebuildKey(pieces[1:])
+	if err != nil {
+		t.Fatal("Unable to rebuild key with leading zeros:", err)
+	}
+	if len(rebuilt.GetBytes()) != 32 {
+		t.Error("Incorrect key length. Expected: 32 Got:", len(rebuilt.GetBytes()))
+	}
+}
+
+func TestRebuildKeyRepeatedPiece(t *testing.T) {
+	key, err := GenerateKey(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces, err := GeneratePieces(key, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RebuildKey([]*KeyPiece{pieces[0], pieces[0]}); err == nil {
+		t.Error("Expected an error for a repeated piece")
+	}
+	if _, err := RebuildKey(nil); err == nil {
+		t.Error("Expected an error for no pieces")
+	}
+}
@@ -0,0 +1,74 @@
+package keyman
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"filippo.io/bigmod"
+)
+
+// Moduli used for the arithmetic on secret values, which is done in constant
+// time. Values which are public, such as piece sequence numbers and
+// commitments, are handled with math/big.
+var (
+	orderModulus = mustModulus(GroupOrder)
+	groupModulus = mustModulus(GroupModulus)
+)
+
+func mustModulus(n *big.Int) *bigmod.Modulus {
+	m, err := bigmod.NewModulus(n.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// newModulus returns the modulus for the prime of a KeyPiece. Pieces created
+// before GroupOrder was used each have their own random prime.
+func newModulus(prime *big.Int) (*bigmod.Modulus, error) {
+	if prime.Cmp(GroupOrder) == 0 {
+		return orderModulus, nil
+	}
+	if prime.Cmp(big.NewInt(2)) <= 0 || prime.Bit(0) == 0 {
+		return nil, fmt.Errorf("invalid prime %s", prime)
+	}
+	return bigmod.NewModulus(prime.Bytes())
+}
+
+// publicElement returns v modulo m. v must not be secret, as the reduction is
+// not done in constant time.
+func publicElement(v *big.Int, m *bigmod.Modulus) *bigmod.Nat {
+	reduced := new(big.Int).Mod(v, new(big.Int).SetBytes(m.Nat().Bytes(m)))
+	n, err := bigmod.NewNat().SetBytes(reduced.Bytes(), m)
+	if err != nil {
+		// Unreachable, as the value has been reduced.
+		panic(err)
+	}
+	return n
+}
+
+// randomElement returns a uniformly random element modulo m.
+func randomElement(m *bigmod.Modulus) (*bigmod.Nat, error) {
+	v, err := rand.Int(rand.Reader, new(big.Int).SetBytes(m.Nat().Bytes(m)))
+	if err != nil {
+		return nil, fmt.Errorf("could not generate random number: %s", err)
+	}
+	return bigmod.NewNat().SetBytes(v.Bytes(), m)
+}
+
+// secretElement returns the big-endian bytes b as an element modulo m. An
+// error is returned if b is not reduced.
+func secretElement(b []byte, m *bigmod.Modulus) (*bigmod.Nat, error) {
+	n, err := bigmod.NewNat().SetBytes(b, m)
+	if err != nil {
+		return nil, errors.New("value is out of range")
+	}
+	return n, nil
+}
+
+// copyElement returns a copy of x, which must be reduced modulo m.
+func copyElement(x *bigmod.Nat, m *bigmod.Modulus) *bigmod.Nat {
+	return bigmod.NewNat().Mod(x, m)
+}
@@ -0,0 +1,67 @@
+package keyman
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Files written by keyman and the key piece store are framed as:
+//
+//	magic (4 bytes) | version (1 byte) | payload length (4 bytes) | payload | SHA-256 (32 bytes)
+//
+// where the checksum covers everything before it, so that truncated or
+// corrupted files are detected before the payload is decoded.
+const (
+	fileMagicLen    = 4
+	fileHeaderLen   = fileMagicLen + 1 + 4
+	fileChecksumLen = sha256.Size
+)
+
+// ErrCorruptFile is returned when a file is truncated or its checksum does
+// not match.
+var ErrCorruptFile = errors.New("file is truncated or corrupted")
+
+// HasMagic reports whether data starts with the given magic, i.e. whether it
+// was written in a framed format rather than an older unframed one.
+func HasMagic(magic string, data []byte) bool {
+	return len(data) >= len(magic) && string(data[:len(magic)]) == magic
+}
+
+// EncodeFile frames a payload with the magic, version and a checksum.
+func EncodeFile(magic string, version byte, payload []byte) []byte {
+	if len(magic) != fileMagicLen {
+		panic("keyman: file magic must be 4 bytes")
+	}
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	buf.WriteByte(version)
+	binary.Write(&buf, binary.BigEndian, uint32(len(payload)))
+	buf.Write(payload)
+	checksum := sha256.Sum256(buf.Bytes())
+	buf.Write(checksum[:])
+	return buf.Bytes()
+}
+
+// DecodeFile checks the framing of data written by EncodeFile and returns its
+// version and payload.
+func DecodeFile(magic string, data []byte) (version byte, payload []byte, err error) {
+	if !HasMagic(magic, data) {
+		return 0, nil, fmt.Errorf("file does not start with %q", magic)
+	}
+	if len(data) < fileHeaderLen+fileChecksumLen {
+		return 0, nil, ErrCorruptFile
+	}
+	length := binary.BigEndian.Uint32(data[fileMagicLen+1 : fileHeaderLen])
+	if uint64(len(data)) != uint64(fileHeaderLen)+uint64(length)+fileChecksumLen {
+		return 0, nil, ErrCorruptFile
+	}
+	body := data[:len(data)-fileChecksumLen]
+	checksum := sha256.Sum256(body)
+	if !bytes.Equal(checksum[:], data[len(body):]) {
+		return 0, nil, ErrCorruptFile
+	}
+	return data[fileMagicLen], body[fileHeaderLen:], nil
+}
@@ -0,0 +1,60 @@
+package keyman
+
+import "sort"
+
+// ElementSummary describes a key piece of Owner held by Holder
+type ElementSummary struct {
+	Owner  string
+	Holder string
+}
+
+// GenerationSummary describes the state of a single generation
+type GenerationSummary struct {
+	Number        int64
+	Nodes         []string
+	CompleteNodes []string
+	Elements      []ElementSummary
+	Threshold     int64
+}
+
+// StateSummary is a copy of the key state which is safe to hand out
+type StateSummary struct {
+	CurrentGeneration    int64
+	InProgressGeneration int64
+	DeprecatedGeneration int64
+	Policy               string
+	Generations          []GenerationSummary
+}
+
+// Summary returns a copy of the key state, ordered by generation, for
+// diagnosing replication problems.
+func (ksm *KeyStateMachine) Summary() StateSummary {
+	ksm.lock.Lock()
+	defer ksm.lock.Unlock()
+
+	summary := StateSummary{
+		CurrentGeneration:    ksm.CurrentGeneration,
+		InProgressGeneration: ksm.InProgressGeneration,
+		DeprecatedGeneration: ksm.DeprecatedGeneration,
+		Policy:               ksm.Policy.String(),
+	}
+	for number, gen := range ksm.Generations {
+		genSummary := GenerationSummary{
+			Number:        number,
+			Nodes:         append([]string(nil), gen.Nodes...),
+			CompleteNodes: append([]string(nil), gen.CompleteNodes...),
+			Threshold:     gen.RequiredPieces(),
+		}
+		for _, elem := range gen.Elements {
+			genSummary.Elements = append(genSummary.Elements, ElementSummary{
+				Owner:  elem.Owner.NodeId,
+				Holder: elem.Holder.NodeId,
+			})
+		}
+		summary.Generations = append(summary.Generations, genSummary)
+	}
+	sort.Slice(summary.Generations, func(i, j int) bool {
+		return summary.Generations[i].Number < summary.Generations[j].Number
+	})
+	return summary
+}
@@ -1,7 +1,7 @@
 package keyman
 
 import (
-	"encoding/gob"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -10,6 +10,7 @@ import (
 	"sync"
 
 	pb "github.com/pp2p/paranoid/proto/raft"
+	"github.com/pp2p/pfsd/durable"
 )
 
 // KsmFileName stores the name of the file used to store the key state (duh)
@@ -32,6 +33,18 @@ type Generation struct {
 	Nodes         []string
 	CompleteNodes []string
 	Elements      []*keyStateElement
+	// The number of pieces needed to rebuild the key. Zero for generations
+	// created before thresholds were recorded, which used a majority.
+	Threshold int64
+}
+
+// RequiredPieces returns the number of key pieces needed to rebuild the key
+// of the generation.
+func (g *Generation) RequiredPieces() int64 {
+	if g.Threshold > 0 {
+		return g.Threshold
+	}
+	return int64(len(g.Nodes))/2 + 1
 }
 
 // AddElement to the generation
@@ -64,6 +77,9 @@ type KeyStateMachine struct {
 	// The second index is unimportant as order doesn't matter there.
 	Generations map[int64]*Generation
 
+	// Policy used to decide the threshold of new generations
+	Policy ThresholdPolicy
+
 	lock sync.Mutex
 
 	// This is, once again, to avoid an import cycle
@@ -88,6 +104,43 @@ func (ksm *KeyStateMachine) GetInProgressGenertion() int64 {
 	return ksm.InProgressGeneration
 }
 
+// SetThresholdPolicy sets the policy used for the generations of a cluster
+// which has none yet. Once there are generations the policy is the one stored
+// with them, which every node must use, so policy is ignored. The policy in use
+// is returned.
+func (ksm *KeyStateMachine) SetThresholdPolicy(policy ThresholdPolicy) ThresholdPolicy {
+	ksm.lock.Lock()
+	defer ksm.lock.Unlock()
+	if len(ksm.Generations) == 0 {
+		ksm.Policy = policy
+	}
+	return ksm.Policy
+}
+
+// GetThresholdPolicy returns the policy used for new generations.
+func (ksm *KeyStateMachine) GetThresholdPolicy() ThresholdPolicy {
+	ksm.lock.Lock()
+	defer ksm.lock.Unlock()
+	return ksm.Policy
+}
+
+// GetThreshold returns the number of key pieces needed to rebuild the key of
+// the generation.
+func (ksm *KeyStateMachine) GetThreshold(generation int64) (int64, error) {
+	ksm.lock.Lock()
+	defer ksm.lock.Unlock()
+
+	if generation != ksm.CurrentGeneration && generation <= ksm.DeprecatedGeneration {
+		return 0, ErrGenerationDeprecated
+	}
+
+	if _, ok := ksm.Generations[generation]; !ok {
+		return 0, fmt.Errorf("generation %d has not yet been initialised", generation)
+	}
+
+	return ksm.Generations[generation].RequiredPieces(), nil
+}
+
 // GetNodes of the generation. If there is a problem with getting the nodes an
 // error is returned
 func (ksm *KeyStateMachine) GetNodes(generation int64) ([]string, error) {
@@ -102,7 +155,32 @@ func (ksm *KeyStateMachine) GetNodes(generation int64) ([]string, error) {
 		return nil, fmt.Errorf("generation %d has not yet been initialised", generation)
 	}
 
-	return ksm.Generations[generation].Nodes, nil
+	// Callers modify the list, so it must not share the generation's slice.
+	return append([]string(nil), ksm.Generations[generation].Nodes...), nil
+}
+
+// GetHolders returns the nodes recorded as holding a key piece of the owner in
+// the generation. These may include nodes outside the generation which hold
+// a piece in place of a member which has gone.
+func (ksm *KeyStateMachine) GetHolders(generation int64, ownerID string) ([]string, error) {
+	ksm.lock.Lock()
+	defer ksm.lock.Unlock()
+
+	if generation != ksm.CurrentGeneration && generation <= ksm.DeprecatedGeneration {
+		return nil, ErrGenerationDeprecated
+	}
+
+	if _, ok := ksm.Generations[generation]; !ok {
+		return nil, fmt.Errorf("generation %d has not yet been initialised", generation)
+	}
+
+	var holders []string
+	for _, v := range ksm.Generations[generation].Elements {
+		if v.Owner.NodeId == ownerID {
+			holders = append(holders, v.Holder.NodeId)
+		}
+	}
+	return holders, nil
 }
 
 // NewKSM returns a new instantiated KeyStateMachine
@@ -118,14 +196,13 @@ func NewKSM(pfsDir string) *KeyStateMachine {
 }
 
 // NewKSMFromReader returns a new instantiated KeyStateMachine from the
-// io.Reader interface
+// io.Reader interface. Both the current format and the older gob format are
+// accepted.
 func NewKSMFromReader(reader io.Reader) (*KeyStateMachine, error) {
-	ksm := new(KeyStateMachine)
-	dec := gob.NewDecoder(reader)
-	err := dec.Decode(ksm)
+	ksm, _, err := decodeKSM(reader)
 	if err != nil {
-		Log.Error("Failed decoding GOB KeyStateMachine data:", err)
-		return nil, fmt.Errorf("failed decoding from GOB: %s", err)
+		Log.Error("Failed decoding KeyStateMachine data:", err)
+		return nil, err
 	}
 	ksm.Events = make(chan bool, 10)
 	return ksm, nil
@@ -140,7 +217,21 @@ func NewKSMFromPFSDir(pfsDir string) (*KeyStateMachine, error) {
 		return nil, fmt.Errorf("unable to open %s: %s", pfsDir, err)
 	}
 	defer file.Close()
-	return NewKSMFromReader(file)
+
+	ksm, legacy, err := decodeKSM(file)
+	if err != nil {
+		Log.Error("Failed decoding KeyStateMachine data:", err)
+		return nil, err
+	}
+	ksm.Events = make(chan bool, 10)
+	if legacy {
+		Log.Info("Converting key state file to the current format")
+		err = ksm.SerialiseToPFSDir()
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert key state file: %s", err)
+		}
+	}
+	return ksm, nil
 }
 
 // UpdateFromStateFile updates the KeyStateMachine from a file.
@@ -158,15 +249,22 @@ func (ksm *KeyStateMachine) UpdateFromStateFile(filePath string) error {
 		return fmt.Errorf("unable to create new key state machine: %s", err)
 	}
 
+	if tmpKSM.Policy != ksm.Policy {
+		Log.Errorf("Threshold policy %s does not match the policy %s of the cluster, using the cluster's",
+			ksm.Policy, tmpKSM.Policy)
+	}
 	ksm.CurrentGeneration = tmpKSM.CurrentGeneration
 	ksm.InProgressGeneration = tmpKSM.InProgressGeneration
 	ksm.DeprecatedGeneration = tmpKSM.DeprecatedGeneration
 	ksm.Generations = tmpKSM.Generations
+	ksm.Policy = tmpKSM.Policy
 	ksm.Events <- true
 	return nil
 }
 
-// NewGeneration creates a new generation when a new node is added.
+// NewGeneration creates a new generation when a new node is added. A node
+// which is already a member gets a new generation of the same members, which
+// is how a node shares a new key.
 func (ksm *KeyStateMachine) NewGeneration(newNode string) (generationNumber int64, peers []string, err error) {
 	ksm.lock.Lock()
 	defer ksm.lock.Unlock()
@@ -175,10 +273,25 @@ func (ksm *KeyStateMachine) NewGeneration(newNode string) (generationNumber int6
 	if gen, ok := ksm.Generations[ksm.CurrentGeneration]; ok {
 		existingNodes = gen.Nodes
 	}
+	nodes := make([]string, 0, len(existingNodes)+1)
+	for _, v := range existingNodes {
+		if v != newNode {
+			peers = append(peers, v)
+		}
+	}
+	nodes = append(append(nodes, peers...), newNode)
+
+	threshold, err := ksm.Policy.Threshold(int64(len(nodes)))
+	if err != nil {
+		Log.Warnf("%s. Requiring all %d pieces.", err, len(nodes))
+		threshold = int64(len(nodes))
+	}
+
 	ksm.InProgressGeneration++
 	ksm.Generations[ksm.InProgressGeneration] = &Generation{
-		Nodes:    append(existingNodes, newNode),
-		Elements: []*keyStateElement{},
+		Nodes:     nodes,
+		Elements:  []*keyStateElement{},
+		Threshold: threshold,
 	}
 
 	if ksm.CurrentGeneration == -1 {
@@ -193,7 +306,7 @@ func (ksm *KeyStateMachine) NewGeneration(newNode string) (generationNumber int6
 		return 0, nil, err
 	}
 	ksm.Events <- true
-	return ksm.InProgressGeneration, existingNodes, nil
+	return ksm.InProgressGeneration, peers, nil
 }
 
 // NodeInGeneration checks is the specified node in the provided generation
@@ -238,15 +351,14 @@ func (ksm *KeyStateMachine) NeedsReplication(uuid string, generationNumber int64
 		}
 	}
 
-	count := 1
+	count := int64(1)
 	for _, v := range generation.Elements {
 		if v.Owner.NodeId == uuid {
 			count++
 		}
 	}
 
-	minNodesRequired := len(generation.Nodes)/2 + 1
-	if count < minNodesRequired {
+	if count < generation.RequiredPieces() {
 		return true
 	}
 	return false
@@ -371,9 +483,9 @@ func (ksm *KeyStateMachine) OwnerComplete(ownerID string, generation int64) erro
 }
 
 // Count all of the keys grouped by owner and make sure they meet a minimum.
-func (ksm KeyStateMachine) canUpdateGeneration(generation int64) bool {
+func (ksm *KeyStateMachine) canUpdateGeneration(generation int64) bool {
 	// Map of UUIDs (as string) to int
-	owners := make(map[string]int)
+	owners := make(map[string]int64)
 	for _, v := range ksm.Generations[generation].Nodes {
 		owners[v]++
 	}
@@ -383,7 +495,7 @@ func (ksm KeyStateMachine) canUpdateGeneration(generation int64) bool {
 	for _, v := range ksm.Generations[generation].Elements {
 		owners[v.Owner.NodeId]++
 	}
-	minNodesRequired := len(ksm.Generations[generation].Nodes)/2 + 1
+	minNodesRequired := ksm.Generations[generation].RequiredPieces()
 	for _, count := range owners {
 		if count < minNodesRequired {
 			return false
@@ -392,35 +504,29 @@ func (ksm KeyStateMachine) canUpdateGeneration(generation int64) bool {
 	return true
 }
 
-// Serialise to GOB encoding and write to the io.Writer
+// Serialise to the versioned key state format and write to the io.Writer
 func (ksm *KeyStateMachine) Serialise(writer io.Writer) error {
-	enc := gob.NewEncoder(writer)
-	err := enc.Encode(ksm)
+	data, err := encodeKSM(ksm)
 	if err != nil {
-		Log.Error("failed encoding KeyStateMachine to GOB:", err)
-		return fmt.Errorf("failed encoding KeyStateMachine to GOB: %v", err)
+		Log.Error("failed encoding KeyStateMachine:", err)
+		return fmt.Errorf("failed encoding KeyStateMachine: %v", err)
 	}
-	return nil
+	_, err = writer.Write(data)
+	return err
 }
 
-// SerialiseToPFSDir as gob and write to file
+// SerialiseToPFSDir serialises the state and durably writes it to the key
+// state file
 func (ksm *KeyStateMachine) SerialiseToPFSDir() error {
-	ksmpath := path.Join(ksm.PfsDir, "meta", KsmFileName)
-	file, err := os.Create(ksmpath + "-new")
+	var buf bytes.Buffer
+	err := ksm.Serialise(&buf)
 	if err != nil {
-		Log.Errorf("Unable to open %s for writing state: %s", ksm.PfsDir, err)
-		return fmt.Errorf("unable to open %s for writing state: %s", ksm.PfsDir, err)
+		return err
 	}
-	err = ksm.Serialise(file)
-	file.Close()
-	if err == nil {
-		err := os.Rename(ksmpath+"-new", ksmpath)
-		if err != nil {
-			// We ignore the following error because if both file operations fail they are very
-			// likely caused by the same thing, so one error will give information for both.
-			os.Remove(ksmpath + "-new")
-			return fmt.Errorf("unable to rename %s to %s: %s", ksmpath+"-new", ksmpath, err)
-		}
+	err = durable.WriteFile(path.Join(ksm.PfsDir, "meta", KsmFileName), buf.Bytes(), 0600)
+	if err != nil {
+		Log.Errorf("Unable to write state to %s: %s", ksm.PfsDir, err)
+		return fmt.Errorf("unable to write state to %s: %s", ksm.PfsDir, err)
 	}
-	return err
+	return nil
 }
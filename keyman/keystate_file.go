@@ -0,0 +1,165 @@
+package keyman
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	pb "github.com/pp2p/paranoid/proto/raft"
+)
+
+// The key state file is a JSON encoding of ksmFile, framed by EncodeFile. The
+// types below only change together with ksmFileVersion, so that changes to
+// the in-memory structures do not break existing files. Files written before
+// the framing was introduced are a gob encoding of KeyStateMachine.
+const (
+	ksmFileMagic        = "PFKS"
+	ksmFileVersion byte = 1
+)
+
+type ksmFileNode struct {
+	IP         string `json:"ip"`
+	Port       string `json:"port"`
+	CommonName string `json:"commonname"`
+	NodeID     string `json:"nodeid"`
+}
+
+type ksmFileElement struct {
+	Owner  ksmFileNode `json:"owner"`
+	Holder ksmFileNode `json:"holder"`
+}
+
+type ksmFileGeneration struct {
+	Number        int64            `json:"number"`
+	Nodes         []string         `json:"nodes"`
+	CompleteNodes []string         `json:"completenodes"`
+	Elements      []ksmFileElement `json:"elements"`
+	Threshold     int64            `json:"threshold"`
+}
+
+type ksmFile struct {
+	CurrentGeneration    int64               `json:"currentgeneration"`
+	InProgressGeneration int64               `json:"inprogressgeneration"`
+	DeprecatedGeneration int64               `json:"deprecatedgeneration"`
+	Generations          []ksmFileGeneration `json:"generations"`
+	Policy               ThresholdPolicy     `json:"policy"`
+	PfsDir               string              `json:"pfsdir"`
+}
+
+func nodeToFile(node *pb.Node) ksmFileNode {
+	if node == nil {
+		return ksmFileNode{}
+	}
+	return ksmFileNode{
+		IP:         node.Ip,
+		Port:       node.Port,
+		CommonName: node.CommonName,
+		NodeID:     node.NodeId,
+	}
+}
+
+func nodeFromFile(node ksmFileNode) *pb.Node {
+	return &pb.Node{
+		Ip:         node.IP,
+		Port:       node.Port,
+		CommonName: node.CommonName,
+		NodeId:     node.NodeID,
+	}
+}
+
+// encodeKSM returns the framed key state file for ksm. The lock must be held
+// by the caller.
+func encodeKSM(ksm *KeyStateMachine) ([]byte, error) {
+	state := ksmFile{
+		CurrentGeneration:    ksm.CurrentGeneration,
+		InProgressGeneration: ksm.InProgressGeneration,
+		DeprecatedGeneration: ksm.DeprecatedGeneration,
+		Policy:               ksm.Policy,
+		PfsDir:               ksm.PfsDir,
+	}
+	for number, gen := range ksm.Generations {
+		fileGen := ksmFileGeneration{
+			Number:        number,
+			Nodes:         gen.Nodes,
+			CompleteNodes: gen.CompleteNodes,
+			Elements:      []ksmFileElement{},
+			Threshold:     gen.Threshold,
+		}
+		for _, elem := range gen.Elements {
+			fileGen.Elements = append(fileGen.Elements, ksmFileElement{
+				Owner:  nodeToFile(elem.Owner),
+				Holder: nodeToFile(elem.Holder),
+			})
+		}
+		state.Generations = append(state.Generations, fileGen)
+	}
+	sort.Slice(state.Generations, func(i, j int) bool {
+		return state.Generations[i].Number < state.Generations[j].Number
+	})
+
+	payload, err := json.Marshal(&state)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeFile(ksmFileMagic, ksmFileVersion, payload), nil
+}
+
+// decodeKSM reads a key state file. legacy is set if the file is in the old
+// gob format and should be rewritten.
+func decodeKSM(reader io.Reader) (ksm *KeyStateMachine, legacy bool, err error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !HasMagic(ksmFileMagic, data) {
+		ksm = new(KeyStateMachine)
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(ksm)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed decoding from GOB: %s", err)
+		}
+		return ksm, true, nil
+	}
+
+	version, payload, err := DecodeFile(ksmFileMagic, data)
+	if err != nil {
+		return nil, false, err
+	}
+	if version != ksmFileVersion {
+		return nil, false, fmt.Errorf("unsupported key state file version %d", version)
+	}
+	var state ksmFile
+	err = json.Unmarshal(payload, &state)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed decoding key state: %s", err)
+	}
+
+	ksm = &KeyStateMachine{
+		CurrentGeneration:    state.CurrentGeneration,
+		InProgressGeneration: state.InProgressGeneration,
+		DeprecatedGeneration: state.DeprecatedGeneration,
+		Generations:          make(map[int64]*Generation),
+		Policy:               state.Policy,
+		PfsDir:               state.PfsDir,
+	}
+	for _, fileGen := range state.Generations {
+		gen := &Generation{
+			Nodes:         fileGen.Nodes,
+			CompleteNodes: fileGen.CompleteNodes,
+			Elements:      []*keyStateElement{},
+			Threshold:     fileGen.Threshold,
+		}
+		for _, elem := range fileGen.Elements {
+			gen.AddElement(&keyStateElement{
+				Owner:  nodeFromFile(elem.Owner),
+				Holder: nodeFromFile(elem.Holder),
+			})
+		}
+		ksm.Generations[fileGen.Number] = gen
+	}
+	return ksm, false, nil
+}
@@ -0,0 +1,224 @@
+// +build !integration
+
+package keyman
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func newTestKSM(t *testing.T) (*KeyStateMachine, string) {
+	dir, err := ioutil.TempDir("", "keymantest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path.Join(dir, "meta"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return NewKSM(dir), dir
+}
+
+func TestNewGenerationCopiesNodes(t *testing.T) {
+	ksm, dir := newTestKSM(t)
+	defer os.RemoveAll(dir)
+
+	for _, node := range []string{"a", "b", "c"} {
+		if _, _, err := ksm.NewGeneration(node); err != nil {
+			t.Fatal("Unable to create generation:", err)
+		}
+		// Pretend each generation completed replication.
+		ksm.CurrentGeneration = ksm.InProgressGeneration
+	}
+
+	generation, peers, err := ksm.NewGeneration("d")
+	if err != nil {
+		t.Fatal("Unable to create generation:", err)
+	}
+	if generation != 3 {
+		t.Error("Incorrect generation number. Expected: 3 Got:", generation)
+	}
+	if !reflect.DeepEqual(peers, []string{"a", "b", "c"}) {
+		t.Error("Incorrect peers. Expected: [a b c] Got:", peers)
+	}
+	if !reflect.DeepEqual(ksm.Generations[2].Nodes, []string{"a", "b", "c"}) {
+		t.Error("Current generation modified:", ksm.Generations[2].Nodes)
+	}
+}
+
+func TestNewGenerationOfMember(t *testing.T) {
+	ksm, dir := newTestKSM(t)
+	defer os.RemoveAll(dir)
+
+	for _, node := range []string{"a", "b", "c"} {
+		if _, _, err := ksm.NewGeneration(node); err != nil {
+			t.Fatal("Unable to create generation:", err)
+		}
+		ksm.CurrentGeneration = ksm.InProgressGeneration
+	}
+
+	// A member asking for a new generation is not added twice.
+	generation, peers, err := ksm.NewGeneration("b")
+	if err != nil {
+		t.Fatal("Unable to create generation:", err)
+	}
+	if !reflect.DeepEqual(peers, []string{"a", "c"}) {
+		t.Error("Incorrect peers. Expected: [a c] Got:", peers)
+	}
+	if !reflect.DeepEqual(ksm.Generations[generation].Nodes, []string{"a", "c", "b"}) {
+		t.Error("Incorrect nodes. Expected: [a c b] Got:", ksm.Generations[generation].Nodes)
+	}
+	if !reflect.DeepEqual(ksm.Generations[2].Nodes, []string{"a", "b", "c"}) {
+		t.Error("Current generation modified:", ksm.Generations[2].Nodes)
+	}
+}
+
+func TestGenerationThreshold(t *testing.T) {
+	ksm, dir := newTestKSM(t)
+	defer os.RemoveAll(dir)
+
+	policy, err := ParseThresholdPolicy("fixed:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := ksm.SetThresholdPolicy(policy); used != policy {
+		t.Fatal("Threshold policy was not set. Using:", used)
+	}
+
+	// Until there are enough nodes to meet the policy every piece is required.
+	expected := []int64{1, 2, 2}
+	for i, node := range []string{"a", "b", "c"} {
+		generation, _, err := ksm.NewGeneration(node)
+		if err != nil {
+			t.Fatal("Unable to create generation:", err)
+		}
+		ksm.CurrentGeneration = ksm.InProgressGeneration
+		threshold, err := ksm.GetThreshold(generation)
+		if err != nil {
+			t.Fatal("Unable to get threshold:", err)
+		}
+		if threshold != expected[i] {
+			t.Errorf("Incorrect threshold for generation %d. Expected: %d Got: %d", generation, expected[i], threshold)
+		}
+	}
+
+	// The threshold of a generation must survive serialisation.
+	loaded, err := NewKSMFromPFSDir(dir)
+	if err != nil {
+		t.Fatal("Unable to load key state machine:", err)
+	}
+	if threshold, _ := loaded.GetThreshold(2); threshold != 2 {
+		t.Error("Incorrect threshold after loading. Expected: 2 Got:", threshold)
+	}
+
+	// Once there are generations the policy of the cluster is kept.
+	if used := loaded.SetThresholdPolicy(ThresholdPolicy{}); used != policy {
+		t.Error("Policy of a cluster with generations was changed to", used)
+	}
+	if loaded.GetThresholdPolicy() != policy {
+		t.Error("Incorrect policy. Expected:", policy, "Got:", loaded.GetThresholdPolicy())
+	}
+
+	// A node joining the cluster takes the policy from its key state.
+	joining, joiningDir := newTestKSM(t)
+	defer os.RemoveAll(joiningDir)
+	if err := joining.UpdateFromStateFile(path.Join(dir, "meta", KsmFileName)); err != nil {
+		t.Fatal("Unable to update from state file:", err)
+	}
+	if joining.Policy != policy {
+		t.Error("Incorrect policy after update. Expected:", policy, "Got:", joining.Policy)
+	}
+}
+
+func TestKSMFileFormat(t *testing.T) {
+	ksm, dir := newTestKSM(t)
+	defer os.RemoveAll(dir)
+
+	if _, _, err := ksm.NewGeneration("a"); err != nil {
+		t.Fatal("Unable to create generation:", err)
+	}
+	if _, _, err := ksm.NewGeneration("b"); err != nil {
+		t.Fatal("Unable to create generation:", err)
+	}
+	loaded, err := NewKSMFromPFSDir(dir)
+	if err != nil {
+		t.Fatal("Unable to load key state machine:", err)
+	}
+	if !reflect.DeepEqual(loaded.Generations, ksm.Generations) {
+		t.Error("Loaded generations do not match. Expected:", ksm.Generations, "Got:", loaded.Generations)
+	}
+	ksm.Events, loaded.Events = nil, nil
+	if !reflect.DeepEqual(loaded, ksm) {
+		t.Error("Loaded key state machine does not match. Expected:", ksm, "Got:", loaded)
+	}
+
+	ksmPath := path.Join(dir, "meta", KsmFileName)
+	data, err := ioutil.ReadFile(ksmPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(ksmPath, data[:len(data)-1], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKSMFromPFSDir(dir); err != ErrCorruptFile {
+		t.Error("Expected ErrCorruptFile for a truncated file. Got:", err)
+	}
+}
+
+func TestKSMLegacyFormat(t *testing.T) {
+	ksm, dir := newTestKSM(t)
+	defer os.RemoveAll(dir)
+
+	ksm.Generations[0] = &Generation{Nodes: []string{"a"}}
+	ksm.CurrentGeneration = 0
+	ksm.InProgressGeneration = 0
+	file, err := os.Create(path.Join(dir, "meta", KsmFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gob.NewEncoder(file).Encode(ksm)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewKSMFromPFSDir(dir)
+	if err != nil {
+		t.Fatal("Unable to load legacy key state machine:", err)
+	}
+	if nodes, err := loaded.GetNodes(0); err != nil || !reflect.DeepEqual(nodes, []string{"a"}) {
+		t.Error("Incorrect nodes after loading legacy file:", nodes, err)
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "meta", KsmFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !HasMagic(ksmFileMagic, data) {
+		t.Error("Legacy key state file was not converted")
+	}
+}
+
+func TestKeyStateSummary(t *testing.T) {
+	ksm, dir := newTestKSM(t)
+	defer os.RemoveAll(dir)
+
+	if _, _, err := ksm.NewGeneration("a"); err != nil {
+		t.Fatal("Unable to create generation:", err)
+	}
+	generation, _, err := ksm.NewGeneration("b")
+	if err != nil {
+		t.Fatal("Unable to create generation:", err)
+	}
+
+	summary := ksm.Summary()
+	if summary.CurrentGeneration != 0 || summary.InProgressGeneration != generation {
+		t.Fatalf("unexpected generations: current %d, in progress %d",
+			summary.CurrentGeneration, summary.InProgressGeneration)
+	}
+	if len(summary.Generations) != 2 || summary.Generations[1].Number != generation {
+		t.Fatal("summary does not list both generations in order:", summary.Generations)
+	}
+}
@@ -0,0 +1,112 @@
+// Proofs that a node holds a KeyPiece, which do not reveal the piece.
+//
+// A proof is a Schnorr proof of knowledge of the share s = f(Seq), for which
+// GroupGenerator^s follows from the commitments of the key. The challenge is
+// derived from a nonce chosen by the verifier, so a proof can not be replayed,
+// and the owner of a key can check a piece without having kept a copy of it.
+//
+// Nodes ask each other for proofs with the VerifyKeyPiece RPC of the
+// keynetwork service.
+
+package keyman
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+
+	"filippo.io/bigmod"
+)
+
+// MinProofNonceSize is the smallest nonce accepted for a PieceProof.
+const MinProofNonceSize = 16
+
+const pieceProofDomain = "pfsd key piece proof v1"
+
+// ErrInvalidProof is returned when a PieceProof does not prove possession of
+// a valid piece.
+var ErrInvalidProof = errors.New("key piece proof is not valid")
+
+// PieceProof proves that its creator holds the piece with sequence number Seq.
+type PieceProof struct {
+	Seq        int64
+	Commitment *big.Int // g^k for a random k
+	Response   []byte   // k + c*s modulo GroupOrder, for the challenge c
+}
+
+// proofChallenge returns the challenge for a proof. The statement proven is
+// fixed by the commitments of the key and the sequence number.
+func proofChallenge(nonce []byte, seq int64, commitment *big.Int) *big.Int {
+	h := sha256.New()
+	h.Write([]byte(pieceProofDomain))
+	binary.Write(h, binary.BigEndian, uint32(len(nonce)))
+	h.Write(nonce)
+	binary.Write(h, binary.BigEndian, seq)
+	h.Write(commitment.Bytes())
+	return new(big.Int).Mod(new(big.Int).SetBytes(h.Sum(nil)), GroupOrder)
+}
+
+// ProvePiece creates a proof of holding a piece in answer to a nonce. Only
+// pieces generated modulo GroupOrder can be proven.
+func ProvePiece(piece *KeyPiece, nonce []byte) (*PieceProof, error) {
+	if len(nonce) < MinProofNonceSize {
+		return nil, errors.New("proof nonce is too short")
+	}
+	if err := CheckPiece(piece); err != nil {
+		return nil, err
+	}
+	if piece.Prime.Cmp(GroupOrder) != 0 {
+		return nil, errors.New("key piece was generated without commitments and can not be proven")
+	}
+	share, err := secretElement(piece.Data, orderModulus)
+	if err != nil {
+		return nil, err
+	}
+	k, err := randomElement(orderModulus)
+	if err != nil {
+		return nil, err
+	}
+
+	generator := publicElement(GroupGenerator, groupModulus)
+	r := bigmod.NewNat().Exp(generator, k.Bytes(orderModulus), groupModulus)
+	commitment := new(big.Int).SetBytes(r.Bytes(groupModulus))
+	c := publicElement(proofChallenge(nonce, piece.Seq, commitment), orderModulus)
+
+	share.Mul(c, orderModulus)
+	share.Add(k, orderModulus)
+	return &PieceProof{
+		Seq:        piece.Seq,
+		Commitment: commitment,
+		Response:   share.Bytes(orderModulus),
+	}, nil
+}
+
+// VerifyPieceProof checks a proof created by ProvePiece for the nonce against
+// the commitments of the key, which should come from a trusted piece such as
+// the one kept by the owner of the key.
+func VerifyPieceProof(proof *PieceProof, commitments []*big.Int, nonce []byte) error {
+	if len(commitments) == 0 {
+		return errors.New("no commitments to verify the proof against")
+	}
+	if proof.Seq < 1 || proof.Commitment == nil {
+		return ErrInvalidProof
+	}
+	if proof.Commitment.Sign() <= 0 || proof.Commitment.Cmp(GroupModulus) >= 0 {
+		return ErrInvalidProof
+	}
+	response := new(big.Int).SetBytes(proof.Response)
+	if response.Cmp(GroupOrder) >= 0 {
+		return ErrInvalidProof
+	}
+
+	// g^response = commitment * (g^s)^c
+	c := proofChallenge(nonce, proof.Seq, proof.Commitment)
+	expected := new(big.Int).Exp(shareCommitment(proof.Seq, commitments), c, GroupModulus)
+	expected.Mul(expected, proof.Commitment)
+	expected.Mod(expected, GroupModulus)
+	if new(big.Int).Exp(GroupGenerator, response, GroupModulus).Cmp(expected) != 0 {
+		return ErrInvalidProof
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// +build !integration
+
+package keyman
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+)
+
+func TestPieceProof(t *testing.T) {
+	key, err := GenerateKey(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces, err := GeneratePieces(key, 4, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitments := pieces[0].Commitments
+	nonce := bytes.Repeat([]byte{7}, MinProofNonceSize)
+
+	for _, piece := range pieces[1:] {
+		proof, err := ProvePiece(piece, nonce)
+		if err != nil {
+			t.Fatal("Unable to prove piece:", err)
+		}
+		if err := VerifyPieceProof(proof, commitments, nonce); err != nil {
+			t.Error("Valid proof for piece", piece.Seq, "failed verification:", err)
+		}
+	}
+
+	proof, err := ProvePiece(pieces[1], nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherNonce := bytes.Repeat([]byte{8}, MinProofNonceSize)
+	if err := VerifyPieceProof(proof, commitments, otherNonce); err != ErrInvalidProof {
+		t.Error("Expected ErrInvalidProof for a replayed proof. Got:", err)
+	}
+	wrongSeq := *proof
+	wrongSeq.Seq = 3
+	if err := VerifyPieceProof(&wrongSeq, commitments, nonce); err != ErrInvalidProof {
+		t.Error("Expected ErrInvalidProof for the wrong sequence number. Got:", err)
+	}
+
+	corrupt := *pieces[1]
+	data := new(big.Int).SetBytes(corrupt.Data)
+	corrupt.Data = data.Add(data, big.NewInt(1)).Bytes()
+	proof, err = ProvePiece(&corrupt, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyPieceProof(proof, commitments, nonce); err != ErrInvalidProof {
+		t.Error("Expected ErrInvalidProof for a corrupt piece. Got:", err)
+	}
+
+	if _, err := ProvePiece(pieces[1], nonce[:MinProofNonceSize-1]); err == nil {
+		t.Error("Able to create a proof for a short nonce")
+	}
+}
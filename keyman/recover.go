@@ -0,0 +1,120 @@
+package keyman
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxRecoverSubsets limits the number of subsets RecoverKey tries, as the
+// number of subsets grows quickly with the number of pieces.
+const maxRecoverSubsets = 100000
+
+// ErrNotEnoughPieces is returned when fewer pieces than required are given.
+var ErrNotEnoughPieces = errors.New("not enough key pieces to rebuild the key")
+
+// SuppliedPiece is a KeyPiece together with the UUID of the node which
+// supplied it.
+type SuppliedPiece struct {
+	Holder string
+	Piece  *KeyPiece
+}
+
+// RecoverKey rebuilds a key from pieces of which some may be wrong. The first
+// piece is trusted to carry the fingerprint of the key, as it should be the
+// one held by the owner. If rebuilding from every piece fails, subsets of
+// requiredPieces pieces which include the first piece are tried until one
+// matches the fingerprint. The holders of every piece which does not lie on
+// the recovered polynomial are returned in badHolders.
+func RecoverKey(pieces []SuppliedPiece, requiredPieces int64) (key *Key, badHolders []string, err error) {
+	if requiredPieces < 1 {
+		return nil, nil, errors.New("at least one piece must be required")
+	}
+	if int64(len(pieces)) < requiredPieces {
+		return nil, nil, ErrNotEnoughPieces
+	}
+
+	// Pieces of another key can be discarded straight away.
+	fingerprint := pieces[0].Piece.ParentFingerprint
+	var candidates []SuppliedPiece
+	for _, v := range pieces {
+		if v.Piece.ParentFingerprint == fingerprint {
+			candidates = append(candidates, v)
+		} else {
+			badHolders = append(badHolders, v.Holder)
+		}
+	}
+	if int64(len(candidates)) < requiredPieces {
+		return nil, badHolders, ErrNotEnoughPieces
+	}
+
+	key, err = RebuildKey(keyPieces(candidates))
+	if err == nil {
+		return key, badHolders, nil
+	}
+
+	// indices holds the positions of the pieces in the current subset. The
+	// first piece is always part of it.
+	indices := make([]int, requiredPieces)
+	for i := range indices {
+		indices[i] = i
+	}
+	subset := make([]SuppliedPiece, requiredPieces)
+	for tries := 0; tries < maxRecoverSubsets; tries++ {
+		for i, v := range indices {
+			subset[i] = candidates[v]
+		}
+		key, err = RebuildKey(keyPieces(subset))
+		if err == nil {
+			return key, append(badHolders, inconsistentHolders(subset, candidates, indices)...), nil
+		}
+		if !nextSubset(indices, len(candidates)) {
+			return nil, badHolders, errors.New("no subset of the key pieces rebuilds the key")
+		}
+	}
+	return nil, badHolders, fmt.Errorf("no key found after trying %d subsets of the key pieces", maxRecoverSubsets)
+}
+
+// inconsistentHolders returns the holders of the candidates outside of the
+// subset which do not lie on the polynomial the subset describes.
+func inconsistentHolders(subset, candidates []SuppliedPiece, indices []int) []string {
+	inSubset := make(map[int]bool)
+	for _, v := range indices {
+		inSubset[v] = true
+	}
+	var holders []string
+	for i, v := range candidates {
+		if inSubset[i] {
+			continue
+		}
+		pieces := append(keyPieces(subset), v.Piece)
+		if _, err := RebuildKey(pieces); err != nil {
+			holders = append(holders, v.Holder)
+		}
+	}
+	return holders
+}
+
+// nextSubset advances indices to the next combination of n elements in
+// lexicographic order, keeping the first index at 0. It returns false once
+// every combination has been visited.
+func nextSubset(indices []int, n int) bool {
+	k := len(indices)
+	for i := k - 1; i > 0; i-- {
+		if indices[i] < n-k+i {
+			indices[i]++
+			for j := i + 1; j < k; j++ {
+				indices[j] = indices[j-1] + 1
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func keyPieces(pieces []SuppliedPiece) []*KeyPiece {
+	result := make([]*KeyPiece, len(pieces))
+	for i, v := range pieces {
+		result[i] = v.Piece
+	}
+	return result
+}
@@ -0,0 +1,138 @@
+// Functions for protecting key material stored on disk. Data is sealed with
+// AES-256-GCM under a key-encryption-key, which is either random or derived
+// from a passphrase with scrypt.
+
+package keyman
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// KEKSize is the size in bytes of a key-encryption-key
+	KEKSize int = 32
+	// SaltSize is the size in bytes of the salt used when deriving a
+	// key-encryption-key from a passphrase
+	SaltSize int = 16
+
+	scryptN int = 1 << 15
+	scryptR int = 8
+	scryptP int = 1
+)
+
+// ErrUnsealFailed is returned when sealed data can not be decrypted, either
+// because the key is wrong or because the data has been modified.
+var ErrUnsealFailed = errors.New("unable to unseal data: wrong key or corrupted data")
+
+// GenerateKEK returns a new random key-encryption-key
+func GenerateKEK() ([]byte, error) {
+	kek := make([]byte, KEKSize)
+	if _, err := io.ReadFull(rand.Reader, kek); err != nil {
+		return nil, err
+	}
+	return kek, nil
+}
+
+// GenerateSalt returns a new random salt for DeriveKEK
+func GenerateSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// DeriveKEK derives a key-encryption-key from a passphrase and salt
+func DeriveKEK(passphrase, salt []byte) ([]byte, error) {
+	if len(salt) != SaltSize {
+		return nil, errors.New("invalid salt size")
+	}
+	return scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, KEKSize)
+}
+
+// Seal encrypts and authenticates plaintext, along with additionalData which
+// is authenticated but not encrypted. The nonce is prepended to the result.
+func Seal(kek, plaintext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// Open decrypts data produced by Seal. ErrUnsealFailed is returned if the key
+// or additionalData do not match, or if the data has been modified.
+func Open(kek, sealed, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrUnsealFailed
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	plaintext, err := gcm.Open(nil, nonce, sealed[gcm.NonceSize():], additionalData)
+	if err != nil {
+		return nil, ErrUnsealFailed
+	}
+	return plaintext, nil
+}
+
+// WrappedKey is a Key sealed with a key-encryption-key derived from a
+// passphrase. It is safe to store on disk.
+type WrappedKey struct {
+	Salt   []byte `json:"salt"`
+	Sealed []byte `json:"sealed"`
+}
+
+// WrapKey seals key with a key-encryption-key derived from passphrase
+func WrapKey(key *Key, passphrase []byte) (*WrappedKey, error) {
+	salt, err := GenerateSalt()
+	if err != nil {
+		return nil, err
+	}
+	kek, err := DeriveKEK(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := Seal(kek, key.GetBytes(), salt)
+	if err != nil {
+		return nil, err
+	}
+	return &WrappedKey{
+		Salt:   salt,
+		Sealed: sealed,
+	}, nil
+}
+
+// UnwrapKey recovers the Key sealed by WrapKey. ErrUnsealFailed is returned if
+// the passphrase is wrong.
+func UnwrapKey(wrapped *WrappedKey, passphrase []byte) (*Key, error) {
+	kek, err := DeriveKEK(passphrase, wrapped.Salt)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := Open(kek, wrapped.Sealed, wrapped.Salt)
+	if err != nil {
+		return nil, err
+	}
+	return NewKey(keyBytes)
+}
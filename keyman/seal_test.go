@@ -0,0 +1,81 @@
+// +build !integration
+
+package keyman
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	kek, err := GenerateKEK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("key pieces")
+	sealed, err := Seal(kek, plaintext, []byte("header"))
+	if err != nil {
+		t.Fatal("Unable to seal:", err)
+	}
+	if bytes.Contains(sealed, plaintext) {
+		t.Error("Sealed data contains the plaintext")
+	}
+
+	opened, err := Open(kek, sealed, []byte("header"))
+	if err != nil {
+		t.Fatal("Unable to open:", err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Error("Opened data does not match. Expected:", plaintext, "Got:", opened)
+	}
+
+	if _, err := Open(kek, sealed, []byte("other header")); err != ErrUnsealFailed {
+		t.Error("Expected ErrUnsealFailed for different additional data. Got:", err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := Open(kek, sealed, []byte("header")); err != ErrUnsealFailed {
+		t.Error("Expected ErrUnsealFailed for modified data. Got:", err)
+	}
+}
+
+func TestDeriveKEK(t *testing.T) {
+	salt, err := GenerateSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := DeriveKEK([]byte("passphrase"), salt)
+	if err != nil {
+		t.Fatal("Unable to derive KEK:", err)
+	}
+	second, _ := DeriveKEK([]byte("passphrase"), salt)
+	if !bytes.Equal(first, second) {
+		t.Error("Same passphrase and salt gave different keys")
+	}
+	other, _ := DeriveKEK([]byte("other passphrase"), salt)
+	if bytes.Equal(first, other) {
+		t.Error("Different passphrases gave the same key")
+	}
+}
+
+func TestWrapKey(t *testing.T) {
+	key, err := GenerateKey(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := WrapKey(key, []byte("passphrase"))
+	if err != nil {
+		t.Fatal("Unable to wrap key:", err)
+	}
+
+	unwrapped, err := UnwrapKey(wrapped, []byte("passphrase"))
+	if err != nil {
+		t.Fatal("Unable to unwrap key:", err)
+	}
+	if unwrapped.GetFingerprint() != key.GetFingerprint() {
+		t.Error("Unwrapped key does not match the original")
+	}
+
+	if _, err := UnwrapKey(wrapped, []byte("wrong")); err != ErrUnsealFailed {
+		t.Error("Expected ErrUnsealFailed for the wrong passphrase. Got:", err)
+	}
+}
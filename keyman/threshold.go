@@ -0,0 +1,152 @@
+package keyman
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Kinds of ThresholdPolicy
+const (
+	ThresholdMajority = "majority" // More than half of the pieces
+	ThresholdFixed    = "fixed"    // A fixed number of pieces
+	ThresholdFraction = "fraction" // A fraction of the pieces, rounded up
+	ThresholdAllBut   = "allbut"   // Every piece but a fixed number
+)
+
+// ThresholdPolicy decides how many of the key pieces of a generation are
+// required to rebuild the key. It is written as "majority", "fixed:K",
+// "fraction:N/D" or "allbut:F". The zero value is the majority policy.
+type ThresholdPolicy struct {
+	kind        string
+	count       int64 // K for a fixed policy, F for an all but policy
+	numerator   int64
+	denominator int64
+}
+
+// ParseThresholdPolicy parses a policy written as returned by String.
+func ParseThresholdPolicy(s string) (ThresholdPolicy, error) {
+	kind, value := s, ""
+	if i := strings.Index(s, ":"); i != -1 {
+		kind, value = s[:i], s[i+1:]
+	}
+
+	p := ThresholdPolicy{kind: kind}
+	var err error
+	switch kind {
+	case ThresholdMajority:
+		if value != "" {
+			return ThresholdPolicy{}, errors.New("majority threshold policy does not take a value")
+		}
+		// The zero value, so that a stored policy reads back equal to it
+		return ThresholdPolicy{}, nil
+	case ThresholdFixed, ThresholdAllBut:
+		p.count, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return ThresholdPolicy{}, fmt.Errorf("invalid %s threshold policy: %v", kind, err)
+		}
+		if kind == ThresholdFixed && p.count < 1 {
+			return ThresholdPolicy{}, errors.New("fixed threshold policy must require at least one piece")
+		}
+		if kind == ThresholdAllBut && p.count < 0 {
+			return ThresholdPolicy{}, errors.New("allbut threshold policy can not be negative")
+		}
+	case ThresholdFraction:
+		parts := strings.Split(value, "/")
+		if len(parts) != 2 {
+			return ThresholdPolicy{}, errors.New("fraction threshold policy must be written as N/D")
+		}
+		p.numerator, err = strconv.ParseInt(parts[0], 10, 64)
+		if err == nil {
+			p.denominator, err = strconv.ParseInt(parts[1], 10, 64)
+		}
+		if err != nil {
+			return ThresholdPolicy{}, fmt.Errorf("invalid fraction threshold policy: %v", err)
+		}
+		if p.numerator < 1 || p.numerator > p.denominator {
+			return ThresholdPolicy{}, errors.New("fraction threshold policy must be greater than 0 and at most 1")
+		}
+	default:
+		return ThresholdPolicy{}, fmt.Errorf("unknown threshold policy %q", kind)
+	}
+	return p, nil
+}
+
+func (p ThresholdPolicy) String() string {
+	switch p.kind {
+	case ThresholdFixed, ThresholdAllBut:
+		return fmt.Sprintf("%s:%d", p.kind, p.count)
+	case ThresholdFraction:
+		return fmt.Sprintf("%s:%d/%d", p.kind, p.numerator, p.denominator)
+	default:
+		return ThresholdMajority
+	}
+}
+
+// MarshalText allows policies to be stored in the filesystem attributes.
+func (p ThresholdPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// UnmarshalText parses a policy stored by MarshalText. An empty policy is the
+// majority policy.
+func (p *ThresholdPolicy) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*p = ThresholdPolicy{}
+		return nil
+	}
+	policy, err := ParseThresholdPolicy(string(text))
+	if err != nil {
+		return err
+	}
+	*p = policy
+	return nil
+}
+
+// GobEncode stores the policy in the key state machine in its text form.
+func (p ThresholdPolicy) GobEncode() ([]byte, error) {
+	return p.MarshalText()
+}
+
+// GobDecode parses a policy stored by GobEncode.
+func (p *ThresholdPolicy) GobDecode(data []byte) error {
+	return p.UnmarshalText(data)
+}
+
+// Threshold returns the number of pieces required out of the given number of
+// pieces. An error is returned if the policy can not be met with that many
+// pieces.
+func (p ThresholdPolicy) Threshold(numPieces int64) (int64, error) {
+	if numPieces < 1 {
+		return 0, errors.New("there must be at least one piece")
+	}
+
+	var threshold int64
+	switch p.kind {
+	case ThresholdFixed:
+		threshold = p.count
+	case ThresholdFraction:
+		threshold = (numPieces*p.numerator + p.denominator - 1) / p.denominator
+	case ThresholdAllBut:
+		threshold = numPieces - p.count
+	default:
+		threshold = numPieces/2 + 1
+	}
+
+	if threshold < 1 || threshold > numPieces {
+		return 0, fmt.Errorf("threshold policy %s can not be met with %d pieces", p, numPieces)
+	}
+	return threshold, nil
+}
+
+// Required returns the number of pieces required out of the given number of
+// pieces. While there are too few pieces to meet the policy, which happens
+// while a cluster is still growing, every piece is required.
+func (p ThresholdPolicy) Required(numPieces int64) int64 {
+	threshold, err := p.Threshold(numPieces)
+	if err != nil {
+		return numPieces
+	}
+	return threshold
+}
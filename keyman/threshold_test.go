@@ -0,0 +1,96 @@
+// +build !integration
+
+package keyman
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestThresholdPolicy(t *testing.T) {
+	tests := []struct {
+		policy    string
+		numPieces int64
+		threshold int64
+		ok        bool
+	}{
+		{"majority", 4, 3, true},
+		{"majority", 1, 1, true},
+		{"fixed:3", 5, 3, true},
+		{"fixed:3", 2, 0, false},
+		{"fraction:2/3", 4, 3, true},
+		{"fraction:1/2", 4, 2, true},
+		{"allbut:1", 5, 4, true},
+		{"allbut:1", 1, 0, false},
+	}
+	for _, test := range tests {
+		policy, err := ParseThresholdPolicy(test.policy)
+		if err != nil {
+			t.Fatal("Unable to parse", test.policy, ":", err)
+		}
+		if policy.String() != test.policy {
+			t.Error("Incorrect string. Expected:", test.policy, "Got:", policy)
+		}
+		threshold, err := policy.Threshold(test.numPieces)
+		if (err == nil) != test.ok {
+			t.Errorf("%s with %d pieces: unexpected error value: %v", test.policy, test.numPieces, err)
+		}
+		if threshold != test.threshold {
+			t.Errorf("%s with %d pieces: Expected: %d Got: %d",
+				test.policy, test.numPieces, test.threshold, threshold)
+		}
+	}
+}
+
+func TestParseThresholdPolicyInvalid(t *testing.T) {
+	for _, s := range []string{"", "most", "fixed", "fixed:0", "fraction:3/2", "fraction:1", "allbut:-1", "majority:1"} {
+		if _, err := ParseThresholdPolicy(s); err == nil {
+			t.Errorf("Expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestThresholdPolicyJSON(t *testing.T) {
+	var attributes struct {
+		Policy ThresholdPolicy `json:"policy"`
+	}
+	if err := json.Unmarshal([]byte(`{}`), &attributes); err != nil {
+		t.Fatal(err)
+	}
+	if attributes.Policy.String() != ThresholdMajority {
+		t.Error("Missing policy should be the majority policy. Got:", attributes.Policy)
+	}
+	if err := json.Unmarshal([]byte(`{"policy": "allbut:2"}`), &attributes); err != nil {
+		t.Fatal(err)
+	}
+	if threshold := attributes.Policy.Required(5); threshold != 3 {
+		t.Error("Incorrect threshold. Expected: 3 Got:", threshold)
+	}
+}
+
+func TestThresholdPolicyRoundTrip(t *testing.T) {
+	majority, err := ParseThresholdPolicy(ThresholdMajority)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if majority != (ThresholdPolicy{}) {
+		t.Error("The majority policy should be the zero value. Got:", majority)
+	}
+	for _, s := range []string{"majority", "fixed:3", "fraction:2/3", "allbut:1"} {
+		policy, err := ParseThresholdPolicy(s)
+		if err != nil {
+			t.Fatal("Unable to parse", s, ":", err)
+		}
+		data, err := policy.GobEncode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded ThresholdPolicy
+		if err := decoded.GobDecode(data); err != nil {
+			t.Fatal(err)
+		}
+		if decoded != policy {
+			t.Errorf("Policy %s changed when reloaded. Got: %#v", s, decoded)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Feldman verifiable secret sharing for KeyPieces.
+//
+// The polynomial used to split a key is chosen modulo GroupOrder, the order
+// of the subgroup generated by GroupGenerator modulo GroupModulus. Publishing
+// GroupGenerator^coefficient for every coefficient allows each piece to be
+// checked on its own, without revealing the coefficients themselves.
+
+package keyman
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"filippo.io/bigmod"
+)
+
+// GroupModulus is the 2048-bit MODP group prime from RFC 3526. It is a safe
+// prime, so GroupGenerator generates a subgroup of prime order GroupOrder.
+var GroupModulus, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D"+
+		"C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F"+
+		"83655D23DCA3AD961C62F356208552BB9ED529077096966D"+
+		"670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9"+
+		"DE2BCBF6955817183995497CEA956AE515D2261898FA0510"+
+		"15728E5A8AACAA68FFFFFFFFFFFFFFFF", 16)
+
+// GroupOrder is the prime order of the subgroup generated by GroupGenerator.
+// KeyPieces with commitments are generated modulo GroupOrder.
+var GroupOrder = new(big.Int).Rsh(GroupModulus, 1)
+
+// GroupGenerator generates the subgroup of order GroupOrder.
+var GroupGenerator = big.NewInt(2)
+
+// ErrInvalidPiece is returned when a KeyPiece does not match the commitments
+// made when the key was split.
+var ErrInvalidPiece = errors.New("key piece does not match its commitments")
+
+// commit returns the commitments to the coefficients of a polynomial. The
+// coefficients are secret, so the exponentiation is done in constant time.
+func commit(coefficients []*bigmod.Nat) []*big.Int {
+	generator := publicElement(GroupGenerator, groupModulus)
+	commitments := make([]*big.Int, len(coefficients))
+	for i, c := range coefficients {
+		commitment := bigmod.NewNat().Exp(generator, c.Bytes(orderModulus), groupModulus)
+		commitments[i] = new(big.Int).SetBytes(commitment.Bytes(groupModulus))
+	}
+	return commitments
+}
+
+// shareCommitment returns g^f(seq), computed from the commitments to the
+// coefficients of f. A piece is valid iff g^f(x) = product of C_i^(x^i) for
+// every commitment C_i = g^a_i.
+func shareCommitment(seq int64, commitments []*big.Int) *big.Int {
+	expected := big.NewInt(1)
+	x := big.NewInt(seq)
+	xi := big.NewInt(1)
+	for _, c := range commitments {
+		expected.Mul(expected, new(big.Int).Exp(c, xi, GroupModulus))
+		expected.Mod(expected, GroupModulus)
+		xi.Mul(xi, x)
+		xi.Mod(xi, GroupOrder)
+	}
+	return expected
+}
+
+// CheckPiece performs the checks which do not need commitments, so that
+// malformed pieces can be rejected as soon as they are received.
+func CheckPiece(piece *KeyPiece) error {
+	if piece.Prime == nil || piece.Prime.Sign() <= 0 {
+		return errors.New("key piece has no prime")
+	}
+	if piece.Seq < 1 {
+		return fmt.Errorf("key piece has invalid sequence number %d", piece.Seq)
+	}
+	if new(big.Int).SetBytes(piece.Data).Cmp(piece.Prime) >= 0 {
+		return errors.New("key piece data is out of range")
+	}
+	return nil
+}
+
+// VerifyPiece checks a KeyPiece against the commitments published alongside
+// the pieces of the same key, which should come from a trusted piece such as
+// the one kept by the owner of the key. ErrInvalidPiece is returned if the
+// piece was not generated from the committed polynomial.
+func VerifyPiece(piece *KeyPiece, commitments []*big.Int) error {
+	if len(commitments) == 0 {
+		return errors.New("no commitments to verify the key piece against")
+	}
+	if err := CheckPiece(piece); err != nil {
+		return err
+	}
+	if piece.Prime.Cmp(GroupOrder) != 0 {
+		return ErrInvalidPiece
+	}
+
+	expected := shareCommitment(piece.Seq, commitments)
+	share, err := secretElement(piece.Data, orderModulus)
+	if err != nil {
+		return ErrInvalidPiece
+	}
+	generator := publicElement(GroupGenerator, groupModulus)
+	actual := bigmod.NewNat().Exp(generator, share.Bytes(orderModulus), groupModulus)
+	if actual.Equal(publicElement(expected, groupModulus)) != 1 {
+		return ErrInvalidPiece
+	}
+	return nil
+}
+
+// VerifyPieceFrom checks a KeyPiece against a trusted piece of the same key,
+// such as the one kept by the owner of the key. Pieces which predate
+// commitments can only be checked for being well formed.
+func VerifyPieceFrom(piece, trusted *KeyPiece) error {
+	if piece.ParentFingerprint != trusted.ParentFingerprint {
+		return errors.New("key piece belongs to a different key")
+	}
+	if len(trusted.Commitments) == 0 {
+		return CheckPiece(piece)
+	}
+	return VerifyPiece(piece, trusted.Commitments)
+}
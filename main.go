@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -24,30 +23,34 @@ import (
 	rpb "github.com/pp2p/paranoid/proto/raft"
 	"github.com/pp2p/paranoid/raft"
 	"github.com/pp2p/paranoid/raft/raftlog"
+	"github.com/pp2p/pfsd/certstore"
 	"github.com/pp2p/pfsd/dnetclient"
+	"github.com/pp2p/pfsd/durable"
 	"github.com/pp2p/pfsd/globals"
 	"github.com/pp2p/pfsd/intercom"
 	"github.com/pp2p/pfsd/keyman"
 	"github.com/pp2p/pfsd/pfi"
 	"github.com/pp2p/pfsd/pnetclient"
 	"github.com/pp2p/pfsd/pnetserver"
+	kpb "github.com/pp2p/pfsd/proto/keynetwork"
 	"github.com/pp2p/pfsd/upnp"
 )
 
-const (
-	// GenerationJoinTimeout determines the timeout for joining a generation
-	GenerationJoinTimeout time.Duration = time.Minute * 3
-	// JoinSendKeysInterval determines the interval at which the keys should be
-	// sent
-	JoinSendKeysInterval time.Duration = time.Second
-)
-
 var (
 	srv *grpc.Server
+	// srvLock guards srv and globals.RaftNetworkServer, which are replaced
+	// once a locked filesystem has been unlocked
+	srvLock sync.Mutex
+	// The address srv listens on
+	rpcAddr string
 )
 
 // Flags
 var (
+	configFile = flag.String(
+		"config",
+		"",
+		"JSON configuration file - flags given on the command line override its values")
 	certFile = flag.String(
 		"cert",
 		"",
@@ -56,11 +59,21 @@ var (
 		"key",
 		"",
 		"TLS key file - if empty connection will be unencrypted")
+	caFile = flag.String(
+		"ca_file",
+		"",
+		"TLS certificate authorities used to verify peers - if set, peers must present a client "+
+			"certificate signed by one of them")
 	skipVerify = flag.Bool(
 		"skip_verification",
 		false,
 		"skip verification of TLS certificate chain and hostname"+
 			"- not recommended unless using self-signed certs")
+	insecureKeyRelease = flag.Bool(
+		"insecure_key_release",
+		false,
+		"release held key pieces to peers without a peer certificate authority to authenticate them - "+
+			"anyone able to connect can then collect enough pieces to rebuild the key")
 	paranoidDirFlag = flag.String(
 		"paranoid_dir",
 		"",
@@ -80,7 +93,70 @@ var (
 	discoveryPasswordFlag = flag.String(
 		"pool_password",
 		"",
-		"pool password")
+		"pool password - visible to other users, prefer pool_password_file or "+
+			poolPasswordEnv)
+	poolPasswordFile = flag.String(
+		"pool_password_file",
+		"",
+		"file containing the pool password")
+	pieceKeyFile = flag.String(
+		"piece_key_file",
+		"",
+		"file containing the key used to encrypt held key pieces - created if it does not exist. Must "+
+			"be outside the paranoid directory. Encrypted filesystems need this or piece_passphrase_file")
+	keyPassphraseFile = flag.String(
+		"key_passphrase_file",
+		"",
+		"file containing the passphrase protecting the key of an encrypted filesystem with networking "+
+			"disabled - rewritten when the passphrase is changed. If not given it is read from "+
+			keyPassphraseEnv+" or prompted for")
+	piecePassphraseFile = flag.String(
+		"piece_passphrase_file",
+		"",
+		"file containing a passphrase from which the key used to encrypt held key pieces is derived")
+	generationJoinTimeout = flag.Duration(
+		"generation_join_timeout",
+		time.Minute*3,
+		"timeout for joining a key generation")
+	joinSendKeysInterval = flag.Duration(
+		"join_send_keys_interval",
+		time.Second,
+		"interval at which key pieces are resent while joining a generation")
+	unlockTimeout = flag.Duration(
+		"unlock_timeout",
+		time.Minute*10,
+		"timeout for each attempt to collect enough key pieces to unlock the filesystem. The filesystem "+
+			"stays locked and attempts are retried until one succeeds")
+	thresholdPolicy = flag.String(
+		"threshold_policy",
+		"",
+		"number of key pieces needed to unlock an encrypted filesystem: majority, fixed:K, fraction:N/D "+
+			"or allbut:F. Can only be set before the key is generated, defaults to majority. A node joining "+
+			"a cluster uses the policy of the cluster")
+	recoverKey = flag.Bool(
+		"recover_key",
+		false,
+		"rebuild the key of an encrypted filesystem from backup shares typed in at a prompt, instead "+
+			"of unlocking it with the help of peers or a passphrase")
+	recoveryShareFiles = flag.String(
+		"recovery_share_files",
+		"",
+		"comma separated list of files containing key backup shares, one per line - implies recover_key")
+	allowOther = flag.Bool(
+		"allow_other",
+		false,
+		"allow users other than the one running pfsd to use the mount. Every file is owned by the user "+
+			"running pfsd, and others only get the group or other permissions. Requires user_allow_other "+
+			"in /etc/fuse.conf unless running as root")
+	statfsBlockSize = flag.Int(
+		"statfs_block_size",
+		0,
+		"block size reported to statfs, for example by df. Defaults to the block size of the filesystem "+
+			"holding the paranoid directory")
+	certReloadInterval = flag.Duration(
+		"cert_reload_interval",
+		time.Minute,
+		"interval at which the TLS certificate and key files are checked for changes")
 )
 
 type keySentResponse struct {
@@ -111,33 +187,85 @@ func sendKeyPiece(uuid string, generation int64, piece *keyman.KeyPiece, respons
 	}
 }
 
-func startRPCServer(lis *net.Listener, password string) {
+func newRPCServer() *grpc.Server {
 	var opts []grpc.ServerOption
 	if globals.TLSEnabled {
 		log.Info("Starting ParanoidNetwork server with TLS.")
-		creds, err := credentials.NewServerTLSFromFile(*certFile, *keyFile)
-		if err != nil {
-			log.Fatal("Failed to generate TLS credentials:", err)
-		}
+		creds := credentials.NewTLS(globals.Certificates.ServerConfig())
 		opts = []grpc.ServerOption{grpc.Creds(creds)}
 	} else {
 		log.Info("Starting ParanoidNetwork server without TLS.")
 	}
-	srv = grpc.NewServer(opts...)
+	server := grpc.NewServer(opts...)
+	pb.RegisterParanoidNetworkServer(server, &pnetserver.ParanoidServer{})
+	kpb.RegisterKeyNetworkServer(server, &pnetserver.ParanoidServer{})
+	return server
+}
 
-	pb.RegisterParanoidNetworkServer(srv, &pnetserver.ParanoidServer{})
-	nodeDetails := raft.Node{
-		IP:         globals.ThisNode.IP,
-		Port:       globals.ThisNode.Port,
-		CommonName: globals.ThisNode.CommonName,
-		NodeID:     globals.ThisNode.UUID,
-	}
+func serveRPC(server *grpc.Server, lis net.Listener) {
+	globals.Wait.Add(1)
+	go func() {
+		defer globals.Wait.Done()
+		err := server.Serve(lis)
+		log.Info("Paranoid network server stopped")
+		if err != nil && globals.ShuttingDown == false {
+			log.Fatal("Server stopped because of an error:", err)
+		}
+	}()
+}
 
+func startRPCServer(lis *net.Listener, password string) {
 	startKeyStateMachine()
+	useClusterThresholdPolicy()
+	checkThresholdPolicy()
 
 	if globals.Encrypted && globals.KeyGenerated {
+		if keyRecovered {
+			if err := checkRecoveredKey(); err != nil {
+				log.Fatal("Unable to use recovered key:", err)
+			}
+			if err := resumeKeyRotation(nil); err != nil {
+				log.Fatal("Unable to resume key rotation:", err)
+			}
+		} else {
+			// The key is collected in the background once the server is
+			// running, so that pfsd starts even while most peers are down.
+			globals.SetLockState(true, "waiting for key pieces")
+		}
+	}
+
+	rpcAddr = (*lis).Addr().String()
+	if globals.Locked() {
+		// Raft applies committed entries to the filesystem as soon as it is
+		// started, which can not be done without the key. Until the key has
+		// been rebuilt only the requests of other nodes for the key pieces
+		// held by this node are served.
+		srvLock.Lock()
+		srv = newRPCServer()
+		serveRPC(srv, *lis)
+		srvLock.Unlock()
+
 		log.Info("Attempting to unlock")
-		Unlock()
+		globals.Wait.Add(1)
+		go unlockInBackground(password)
+		return
+	}
+
+	srvLock.Lock()
+	srv = newRPCServer()
+	startRaft(srv, *lis)
+	srvLock.Unlock()
+	joinCluster(password)
+}
+
+// startRaft creates the raft server of this node and starts serving. It must
+// be called with srvLock held.
+func startRaft(server *grpc.Server, lis net.Listener) {
+	nodeDetails := raft.Node{
+		IP:         globals.ThisNode.IP,
+		Port:       globals.ThisNode.Port,
+		CommonName: globals.ThisNode.CommonName,
+		NodeID:     globals.ThisNode.UUID,
 	}
 
 	//First node to join a given cluster
@@ -154,7 +282,74 @@ func startRPCServer(lis *net.Listener, password string) {
 			globals.TLSSkipVerify,
 			globals.Encrypted,
 		)
-		timeout := time.After(GenerationJoinTimeout)
+	} else {
+		globals.RaftNetworkServer = raft.NewRaftNetworkServer(
+			nodeDetails,
+			globals.ParanoidDir,
+			path.Join(globals.ParanoidDir, "meta", "raft"),
+			nil,
+			globals.TLSEnabled,
+			globals.TLSSkipVerify,
+			globals.Encrypted,
+		)
+	}
+
+	rpb.RegisterRaftNetworkServer(server, globals.RaftNetworkServer)
+	if err := pnetserver.RecordPieceOwners(); err != nil {
+		log.Error("Unable to record the owners of held key pieces:", err)
+	}
+	serveRPC(server, lis)
+}
+
+// restartWithRaft replaces the server used while the filesystem was locked
+// with one which also serves raft. Services can not be added to a running
+// server, so the old one is stopped and the address is listened on again.
+func restartWithRaft() error {
+	srvLock.Lock()
+	defer srvLock.Unlock()
+	if globals.ShuttingDown {
+		return errUnlockStopped
+	}
+	srv.GracefulStop()
+	lis, err := net.Listen("tcp", rpcAddr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s again: %s", rpcAddr, err)
+	}
+	srv = newRPCServer()
+	startRaft(srv, lis)
+	return nil
+}
+
+// stopRaft stops raft on this node and goes back to serving only the requests
+// of other nodes for key pieces, as while the filesystem is locked.
+func stopRaft() error {
+	srvLock.Lock()
+	defer srvLock.Unlock()
+	if globals.ShuttingDown {
+		return errUnlockStopped
+	}
+	if globals.RaftNetworkServer != nil {
+		close(globals.RaftNetworkServer.Quit)
+	}
+	srv.GracefulStop()
+	if globals.RaftNetworkServer != nil {
+		globals.RaftNetworkServer.Wait.Wait()
+		globals.RaftNetworkServer = nil
+	}
+	lis, err := net.Listen("tcp", rpcAddr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s again: %s", rpcAddr, err)
+	}
+	srv = newRPCServer()
+	serveRPC(srv, lis)
+	return nil
+}
+
+// joinCluster creates the first generation of a new cluster, or joins this
+// node to an existing one, and starts replicating the key pieces of this node.
+func joinCluster(password string) {
+	if len(globals.Nodes.GetAll()) == 0 {
+		timeout := time.After(*generationJoinTimeout)
 	initalGenerationLoop:
 		for {
 			select {
@@ -170,39 +365,12 @@ func startRPCServer(lis *net.Listener, password string) {
 			}
 		}
 		if globals.Encrypted {
-			globals.KeyGenerated = true
-			saveFileSystemAttributes(&globals.FileSystemAttributes{
-				Encrypted:    globals.Encrypted,
-				KeyGenerated: globals.KeyGenerated,
-				NetworkOff:   globals.NetworkOff,
-			})
+			markKeyGenerated()
 		}
-	} else {
-		globals.RaftNetworkServer = raft.NewRaftNetworkServer(
-			nodeDetails,
-			globals.ParanoidDir,
-			path.Join(globals.ParanoidDir, "meta", "raft"),
-			nil,
-			globals.TLSEnabled,
-			globals.TLSSkipVerify,
-			globals.Encrypted,
-		)
 	}
 
-	rpb.RegisterRaftNetworkServer(srv, globals.RaftNetworkServer)
-
-	globals.Wait.Add(1)
-	go func() {
-		defer globals.Wait.Done()
-		err := srv.Serve(*lis)
-		log.Info("Paranoid network server stopped")
-		if err != nil && globals.ShuttingDown == false {
-			log.Fatal("Server stopped because of an error:", err)
-		}
-	}()
-
 	if globals.Encrypted && !globals.KeyGenerated {
-		timeout := time.After(GenerationJoinTimeout)
+		timeout := time.After(*generationJoinTimeout)
 	generationCreateLoop:
 		for {
 			select {
@@ -215,9 +383,13 @@ func startRPCServer(lis *net.Listener, password string) {
 				}
 
 				keyPiecesN := int64(len(peers) + 1)
-				minKeysRequired := (keyPiecesN / 2) + 1
+				minKeysRequired, err := generationThreshold(generation, peers)
+				if err != nil {
+					log.Error("Unable to get threshold of new generation:", err)
+					continue
+				}
 				log.Info("pieces : ", keyPiecesN)
-				keyPieces, err := keyman.GeneratePieces(globals.EncryptionKey, keyPiecesN, minKeysRequired)
+				keyPieces, err := keyman.GeneratePieces(globals.GetEncryptionKey(), keyPiecesN, minKeysRequired)
 				if err != nil {
 					log.Fatal("Unable to split keys:", err)
 				}
@@ -257,7 +429,7 @@ func startRPCServer(lis *net.Listener, password string) {
 						if keysReplicated >= minKeysRequired {
 							attemptJoin <- true
 						}
-						sendKeysTimer.Reset(JoinSendKeysInterval)
+						sendKeysTimer.Reset(*joinSendKeysInterval)
 					case keySendInfo := <-sendKeysResponse:
 						log.Info("Received key piece response")
 						if keySendInfo.err != nil {
@@ -309,12 +481,7 @@ func startRPCServer(lis *net.Listener, password string) {
 			}
 		}
 
-		globals.KeyGenerated = true
-		saveFileSystemAttributes(&globals.FileSystemAttributes{
-			Encrypted:    globals.Encrypted,
-			KeyGenerated: globals.KeyGenerated,
-			NetworkOff:   globals.NetworkOff,
-		})
+		markKeyGenerated()
 	} else if globals.RaftNetworkServer.State.Configuration.HasConfiguration() == false {
 		log.Info("Attempting to join raft cluster")
 		err := dnetclient.JoinCluster(password)
@@ -325,6 +492,10 @@ func startRPCServer(lis *net.Listener, password string) {
 
 	globals.Wait.Add(1)
 	go pnetclient.KSMObserver(keyman.StateMachine)
+	if keyRotationPending() {
+		globals.Wait.Add(1)
+		go finishKeyRotation()
+	}
 }
 
 func setupLogging() {
@@ -335,6 +506,7 @@ func setupLogging() {
 	dnetclient.Log = log.New("dnetclient", "pfsd", logDir)
 	pnetclient.Log = log.New("pnetclient", "pfsd", logDir)
 	pnetserver.Log = log.New("pnetserver", "pfsd", logDir)
+	pnetserver.AuditLog = log.New("audit", "pfsd", logDir)
 	upnp.Log = log.New("upnp", "pfsd", logDir)
 	keyman.Log = log.New("keyman", "pfsd", logDir)
 	raft.Log = log.New("raft", "pfsd", logDir)
@@ -342,11 +514,13 @@ func setupLogging() {
 	commands.Log = log.New("libpfs", "pfsd", logDir)
 	intercom.Log = log.New("intercom", "pfsd", logDir)
 	globals.Log = log.New("globals", "pfsd", logDir)
+	certstore.Log = log.New("certstore", "pfsd", logDir)
 
 	log.SetOutput(log.STDERR | log.LOGFILE)
 	dnetclient.Log.SetOutput(log.STDERR | log.LOGFILE)
 	pnetclient.Log.SetOutput(log.STDERR | log.LOGFILE)
 	pnetserver.Log.SetOutput(log.STDERR | log.LOGFILE)
+	pnetserver.AuditLog.SetOutput(log.LOGFILE)
 	upnp.Log.SetOutput(log.STDERR | log.LOGFILE)
 	keyman.Log.SetOutput(log.STDERR | log.LOGFILE)
 	raft.Log.SetOutput(log.STDERR | log.LOGFILE)
@@ -354,17 +528,12 @@ func setupLogging() {
 	commands.Log.SetOutput(log.STDERR | log.LOGFILE)
 	intercom.Log.SetOutput(log.STDERR | log.LOGFILE)
 	globals.Log.SetOutput(log.STDERR | log.LOGFILE)
+	certstore.Log.SetOutput(log.STDERR | log.LOGFILE)
 
 }
 
 func getFileSystemAttributes() {
-	attributesJSON, err := ioutil.ReadFile(path.Join(globals.ParanoidDir, "meta", "attributes"))
-	if err != nil {
-		log.Fatal("unable to read file system attributes:", err)
-	}
-
-	attributes := &globals.FileSystemAttributes{}
-	err = json.Unmarshal(attributesJSON, attributes)
+	attributes, err := globals.ReadFileSystemAttributes()
 	if err != nil {
 		log.Fatal("unable to read file system attributes:", err)
 	}
@@ -373,33 +542,109 @@ func getFileSystemAttributes() {
 	globals.NetworkOff = attributes.NetworkOff
 	encryption.Encrypted = attributes.Encrypted
 
+	if *thresholdPolicy != "" {
+		policy, err := keyman.ParseThresholdPolicy(*thresholdPolicy)
+		if err != nil {
+			log.Fatal("invalid threshold policy:", err)
+		}
+		if !attributes.KeyGenerated {
+			attributes.ThresholdPolicy = policy
+		} else if policy != attributes.ThresholdPolicy {
+			log.Warnf("Ignoring threshold policy %s: the threshold policy of this filesystem is %s and "+
+				"can not be changed once the key has been generated", policy, attributes.ThresholdPolicy)
+		}
+	}
+	globals.ThresholdPolicy = attributes.ThresholdPolicy
+
+	if recoveryRequested() && !(attributes.Encrypted && attributes.KeyGenerated) {
+		log.Fatal("there is no encryption key to recover for this filesystem")
+	}
+
 	if attributes.Encrypted {
 		if !attributes.KeyGenerated {
 			//If a key has not yet been generated for this file system, one must be generated
-			globals.EncryptionKey, err = keyman.GenerateKey(32)
+			key, err := keyman.GenerateKey(32)
 			if err != nil {
 				log.Fatal("unable to generate encryption key:", err)
 			}
+			globals.SetEncryptionKey(key)
+			fingerprint := key.GetFingerprint()
+			attributes.KeyFingerprint = fingerprint[:]
 
-			cipherB, err := encryption.GenerateAESCipherBlock(globals.EncryptionKey.GetBytes())
+			cipherB, err := encryption.GenerateAESCipherBlock(key.GetBytes())
 			if err != nil {
 				log.Fatal("unable to generate cipher block:", err)
 			}
 			encryption.SetCipher(cipherB)
 
 			if attributes.NetworkOff {
-				//If networking is turned off, save the key to a file
+				//If networking is turned off, save the key to a file wrapped with a passphrase
+				passphrase, err := readKeyPassphrase(true)
+				if err != nil {
+					log.Fatal("unable to get filesystem passphrase:", err)
+				}
+				attributes.WrappedKey, err = keyman.WrapKey(key, passphrase)
+				zeroBytes(passphrase)
+				if err != nil {
+					log.Fatal("unable to wrap encryption key:", err)
+				}
 				attributes.KeyGenerated = true
-				attributes.EncryptionKey = *globals.EncryptionKey
+			}
+		} else if recoveryRequested() {
+			key, err := recoverKeyFromShares()
+			if err != nil {
+				log.Fatal("unable to recover encryption key:", err)
+			}
+			globals.SetEncryptionKey(key)
+			cipherB, err := encryption.GenerateAESCipherBlock(key.GetBytes())
+			if err != nil {
+				log.Fatal("unable to generate cipher block:", err)
+			}
+			encryption.SetCipher(cipherB)
+			keyRecovered = true
+			log.Info("Recovered encryption key from backup shares")
+
+			if attributes.NetworkOff {
+				if err := checkRecoveredKey(); err != nil {
+					log.Fatal("unable to use recovered key:", err)
+				}
+				if err := resumeKeyRotation(attributes); err != nil {
+					log.Fatal("unable to resume key rotation:", err)
+				}
+				//The passphrase may have been lost as well, so the key is wrapped with a new one
+				passphrase, err := readKeyPassphrase(true)
+				if err != nil {
+					log.Fatal("unable to get filesystem passphrase:", err)
+				}
+				attributes.WrappedKey, err = keyman.WrapKey(globals.GetEncryptionKey(), passphrase)
+				zeroBytes(passphrase)
+				if err != nil {
+					log.Fatal("unable to wrap encryption key:", err)
+				}
 			}
 		} else if attributes.NetworkOff {
-			//If networking is off, load the key from the file
-			globals.EncryptionKey = &attributes.EncryptionKey
-			cipherB, err := encryption.GenerateAESCipherBlock(globals.EncryptionKey.GetBytes())
+			//If networking is off, unwrap the key stored in the file
+			if attributes.WrappedKey == nil {
+				log.Fatal("no encryption key is stored for this filesystem")
+			}
+			passphrase, err := readKeyPassphrase(false)
+			if err != nil {
+				log.Fatal("unable to get filesystem passphrase:", err)
+			}
+			key, err := keyman.UnwrapKey(attributes.WrappedKey, passphrase)
+			zeroBytes(passphrase)
+			if err != nil {
+				log.Fatal("unable to unlock encryption key:", err)
+			}
+			globals.SetEncryptionKey(key)
+			cipherB, err := encryption.GenerateAESCipherBlock(key.GetBytes())
 			if err != nil {
 				log.Fatal("unable to generate cipher block:", err)
 			}
 			encryption.SetCipher(cipherB)
+			if err := resumeKeyRotation(attributes); err != nil {
+				log.Fatal("unable to resume key rotation:", err)
+			}
 		}
 	}
 
@@ -411,19 +656,35 @@ func getFileSystemAttributes() {
 	saveFileSystemAttributes(attributes)
 }
 
-func saveFileSystemAttributes(attributes *globals.FileSystemAttributes) {
-	attributesJSON, err := json.Marshal(attributes)
+// markKeyGenerated records that the key of this filesystem has been generated
+// and distributed.
+func markKeyGenerated() {
+	globals.KeyGenerated = true
+	attributes, err := globals.ReadFileSystemAttributes()
 	if err != nil {
-		log.Fatal("unable to save new file system attributes to file:", err)
+		log.Fatal("unable to read file system attributes:", err)
 	}
+	attributes.KeyGenerated = true
+	saveFileSystemAttributes(attributes)
+}
 
-	newAttributesFile := path.Join(globals.ParanoidDir, "meta", "attributes-new")
-	err = ioutil.WriteFile(newAttributesFile, attributesJSON, 0600)
+// checkThresholdPolicy warns if the threshold policy can not be met by the
+// members of the current key generation.
+func checkThresholdPolicy() {
+	if !globals.Encrypted {
+		return
+	}
+	nodes, err := keyman.StateMachine.GetNodes(keyman.StateMachine.GetCurrentGeneration())
 	if err != nil {
-		log.Fatal("unable to save new file system attributes to file:", err)
+		return
+	}
+	if _, err := globals.ThresholdPolicy.Threshold(int64(len(nodes))); err != nil {
+		log.Warn("Threshold policy is not reachable with the current membership:", err)
 	}
+}
 
-	err = os.Rename(newAttributesFile, path.Join(globals.ParanoidDir, "meta", "attributes"))
+func saveFileSystemAttributes(attributes *globals.FileSystemAttributes) {
+	err := globals.SaveFileSystemAttributes(attributes)
 	if err != nil {
 		log.Fatal("unable to save new file system attributes to file:", err)
 	}
@@ -434,20 +695,23 @@ func main() {
 
 	var err error
 
-	if len(*paranoidDirFlag) == 0 {
-		fmt.Println("FATAL: paranoid directory must be provided")
+	if err = loadConfig(*configFile); err != nil {
+		fmt.Println("FATAL: could not load configuration:", err)
 		os.Exit(1)
 	}
+	if errs := validateFlags(); len(errs) != 0 {
+		for _, err := range errs {
+			fmt.Println("FATAL:", err)
+		}
+		os.Exit(1)
+	}
+
 	globals.ParanoidDir, err = filepath.Abs(*paranoidDirFlag)
 	if err != nil {
 		fmt.Println("FATAL: Could not get absolute paranoid dir:", err)
 		os.Exit(1)
 	}
 
-	if len(*mountDirFlag) == 0 {
-		fmt.Println("FATAL: mount point must be provided")
-		os.Exit(1)
-	}
 	globals.MountPoint, err = filepath.Abs(*mountDirFlag)
 	if err != nil {
 		fmt.Println("FATAL: Could not get absolute mount point:", err)
@@ -455,11 +719,33 @@ func main() {
 	}
 
 	setupLogging()
+	if err = readInheritedSecrets(); err != nil {
+		log.Fatal("Unable to read secrets from the previous pfsd:", err)
+	}
+	if err = setupPieceSealing(); err != nil {
+		log.Fatal("Unable to set up key piece encryption:", err)
+	}
 	getFileSystemAttributes()
 
 	globals.TLSSkipVerify = *skipVerify
 	if *certFile != "" && *keyFile != "" {
 		globals.TLSEnabled = true
+		globals.Certificates, err = certstore.New(*certFile, *keyFile)
+		if err != nil {
+			log.Fatal("Failed to load TLS certificate:", err)
+		}
+		if *caFile != "" {
+			err = globals.Certificates.LoadPeerCA(*caFile)
+			if err != nil {
+				log.Fatal("Failed to load TLS certificate authorities:", err)
+			}
+			log.Info("Requiring client certificates from peers")
+		}
+		globals.Wait.Add(1)
+		go func() {
+			defer globals.Wait.Done()
+			globals.Certificates.Watch(*certReloadInterval, globals.Quit)
+		}()
 		if !globals.TLSSkipVerify {
 			cn, err := getCommonNameFromCert(*certFile)
 			if err != nil {
@@ -470,6 +756,16 @@ func main() {
 	} else {
 		globals.TLSEnabled = false
 	}
+	globals.InsecureKeyRelease = *insecureKeyRelease
+	if globals.Encrypted && !globals.NetworkOff && (globals.Certificates == nil || !globals.Certificates.VerifiesPeers()) {
+		if globals.InsecureKeyRelease {
+			log.Warn("No peer certificate authority given, key pieces will be released without " +
+				"authenticating the requester")
+		} else {
+			log.Warn("No peer certificate authority given, held key pieces will not be released to " +
+				"peers. Use ca_file, or insecure_key_release to allow it anyway")
+		}
+	}
 
 	if !globals.NetworkOff {
 		uuid, err := ioutil.ReadFile(path.Join(globals.ParanoidDir, "meta", "uuid"))
@@ -526,16 +822,31 @@ func main() {
 		if len(*discoveryAddrFlag) == 0 {
 			log.Fatal("discovery server address must be specified")
 		}
-		dnetclient.SetDiscovery(*discoveryAddrFlag)
-		dnetclient.JoinDiscovery(*discoveryPoolFlag, *discoveryPasswordFlag)
-		if err = globals.SetPoolPasswordHash(*discoveryPasswordFlag); err != nil {
+		passwordBytes, err := readPoolPassword()
+		if err != nil {
+			log.Fatal("Unable to get pool password:", err)
+		}
+		// The RPC messages carry the password as a string, so that copy can not
+		// be cleared. Every other copy is zeroed once the hash is generated.
+		password := string(passwordBytes)
+		err = globals.SetPoolPasswordHash(passwordBytes)
+		zeroBytes(passwordBytes)
+		if err != nil {
 			log.Fatal("Error setting up password hash:", err)
 		}
-		startRPCServer(&lis, *discoveryPasswordFlag)
+
+		dnetclient.SetDiscovery(*discoveryAddrFlag)
+		dnetclient.JoinDiscovery(*discoveryPoolFlag, password)
+		startRPCServer(&lis, password)
 	}
 	createPid("pfsd")
+	pfi.AllowOther = *allowOther
+	pfi.StatFsBlockSize = uint32(*statfsBlockSize)
 	pfi.StartPfi(false)
 
+	intercom.PassphraseChanged = storeKeyPassphrase
+	intercom.BeginPassphraseChange = beginPassphraseChange
+	intercom.RotateKey = rotateKey
 	intercom.RunServer(path.Join(globals.ParanoidDir, "meta"))
 
 	HandleSignals()
@@ -544,7 +855,7 @@ func main() {
 func createPid(processName string) {
 	processID := os.Getpid()
 	pid := []byte(strconv.Itoa(processID))
-	err := ioutil.WriteFile(path.Join(globals.ParanoidDir, "meta", processName+".pid"), pid, 0600)
+	err := durable.WriteFile(path.Join(globals.ParanoidDir, "meta", processName+".pid"), pid, 0600)
 	if err != nil {
 		log.Fatal("Failed to create PID file", err)
 	}
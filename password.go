@@ -0,0 +1,344 @@
+// password.go contains the functions used to obtain the pool password and the
+// passphrase protecting the key of an offline filesystem
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/pp2p/pfsd/durable"
+)
+
+// poolPasswordEnv is the environment variable the pool password is read from
+// if neither -pool_password nor -pool_password_file is given.
+const poolPasswordEnv = "PFSD_POOL_PASSWORD"
+
+// keyPassphraseEnv is the environment variable the filesystem passphrase is
+// read from if -key_passphrase_file is not given.
+const keyPassphraseEnv = "PFSD_KEY_PASSPHRASE"
+
+// secretsFDEnv names the file descriptor a restarted pfsd reads the secrets
+// handed over by the process it replaces from. The secrets themselves are
+// never placed in the environment, where /proc/<pid>/environ exposes them.
+const secretsFDEnv = "PFSD_SECRETS_FD"
+
+// secretsFD is the file descriptor the secrets pipe is given in a restarted
+// pfsd, after stdin, stdout and stderr.
+const secretsFD = 3
+
+// Tags of the secrets written to the pipe of a restarted pfsd.
+const (
+	poolPasswordSecret  byte = 'p'
+	keyPassphraseSecret byte = 'k'
+)
+
+// restartPoolPassword and restartKeyPassphrase hold the secrets pfsd can not
+// read again once it restarts: those typed in at a prompt, read from the
+// environment or handed over by a previous pfsd, and a key passphrase changed
+// through intercom. A restarted pfsd is given them through a pipe.
+var (
+	restartPoolPassword  []byte
+	restartKeyPassphrase []byte
+	restartSecretsLock   sync.Mutex
+)
+
+// lookupSecretEnv returns a secret held in an environment variable and
+// removes the variable, so that it is not passed on to child processes.
+func lookupSecretEnv(name string) ([]byte, bool) {
+	secret, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, false
+	}
+	os.Unsetenv(name)
+	return []byte(secret), true
+}
+
+// setRestartSecret records a secret to be handed to a restarted pfsd.
+func setRestartSecret(restartSecret *[]byte, secret []byte) {
+	restartSecretsLock.Lock()
+	zeroBytes(*restartSecret)
+	*restartSecret = append([]byte(nil), secret...)
+	restartSecretsLock.Unlock()
+}
+
+// getRestartSecret returns a copy of a secret handed over by a previous pfsd,
+// or nil if there is none. The caller should zero the returned slice.
+func getRestartSecret(restartSecret *[]byte) []byte {
+	restartSecretsLock.Lock()
+	defer restartSecretsLock.Unlock()
+	if *restartSecret == nil {
+		return nil
+	}
+	return append([]byte(nil), *restartSecret...)
+}
+
+// encodeSecrets returns the secrets a restarted pfsd is handed through its
+// pipe, each written as a tag, a 4 byte length and the secret itself.
+func encodeSecrets() []byte {
+	restartSecretsLock.Lock()
+	defer restartSecretsLock.Unlock()
+
+	var buf bytes.Buffer
+	for _, secret := range []struct {
+		tag   byte
+		value []byte
+	}{
+		{poolPasswordSecret, restartPoolPassword},
+		{keyPassphraseSecret, restartKeyPassphrase},
+	} {
+		if secret.value == nil {
+			continue
+		}
+		var header [5]byte
+		header[0] = secret.tag
+		binary.BigEndian.PutUint32(header[1:], uint32(len(secret.value)))
+		buf.Write(header[:])
+		buf.Write(secret.value)
+	}
+	return buf.Bytes()
+}
+
+// decodeSecrets records the secrets handed over by a previous pfsd.
+func decodeSecrets(data []byte) error {
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return errors.New("truncated secret")
+		}
+		tag := data[0]
+		length := binary.BigEndian.Uint32(data[1:5])
+		data = data[5:]
+		if uint64(length) > uint64(len(data)) {
+			return errors.New("truncated secret")
+		}
+		secret := data[:length]
+		data = data[length:]
+		switch tag {
+		case poolPasswordSecret:
+			setRestartSecret(&restartPoolPassword, secret)
+		case keyPassphraseSecret:
+			setRestartSecret(&restartKeyPassphrase, secret)
+		default:
+			return fmt.Errorf("unknown secret %q", tag)
+		}
+	}
+	return nil
+}
+
+// readInheritedSecrets reads the secrets handed over by the pfsd this process
+// replaced, if it was started by one.
+func readInheritedSecrets() error {
+	fdString, ok := os.LookupEnv(secretsFDEnv)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(secretsFDEnv)
+	fd, err := strconv.Atoi(fdString)
+	if err != nil || fd < 0 {
+		return fmt.Errorf("invalid %s %q", secretsFDEnv, fdString)
+	}
+	pipe := os.NewFile(uintptr(fd), "secrets")
+	defer pipe.Close()
+	data, err := ioutil.ReadAll(pipe)
+	defer zeroBytes(data)
+	if err != nil {
+		return fmt.Errorf("could not read secrets: %v", err)
+	}
+	return decodeSecrets(data)
+}
+
+// restartSecretsPipe returns the read end of a pipe holding the secrets for a
+// restarted pfsd, or nil if there are none. The secrets fit in the pipe's
+// buffer, so the write end is closed before the pipe is returned.
+func restartSecretsPipe() (*os.File, error) {
+	secrets := encodeSecrets()
+	defer zeroBytes(secrets)
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(secrets)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// readSecretFile returns the contents of a file holding a secret, without any
+// trailing newline.
+func readSecretFile(secretFile string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(secretFile)
+	if err != nil {
+		return nil, err
+	}
+	secret := append([]byte(nil), bytes.TrimRight(contents, "\r\n")...)
+	zeroBytes(contents)
+	return secret, nil
+}
+
+// promptSecret asks for a secret on the terminal without echoing it. ok is
+// false if stdin is not a terminal.
+func promptSecret(prompt string) (secret []byte, ok bool, err error) {
+	stdin := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(stdin) {
+		return nil, false, nil
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err = terminal.ReadPassword(stdin)
+	fmt.Fprintln(os.Stderr)
+	return secret, true, err
+}
+
+// readPoolPassword returns the pool password from the first available source:
+// the -pool_password flag, the file named by -pool_password_file, the previous
+// pfsd if this one was restarted, the PFSD_POOL_PASSWORD environment variable
+// or, if stdin is a terminal, a prompt which does not echo the input. The
+// caller should zero the returned slice once it is no longer needed.
+func readPoolPassword() ([]byte, error) {
+	if *discoveryPasswordFlag != "" {
+		return []byte(*discoveryPasswordFlag), nil
+	}
+
+	if *poolPasswordFile != "" {
+		password, err := readSecretFile(*poolPasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read pool password file: %v", err)
+		}
+		return password, nil
+	}
+
+	if password := getRestartSecret(&restartPoolPassword); password != nil {
+		return password, nil
+	}
+
+	if password, ok := lookupSecretEnv(poolPasswordEnv); ok {
+		setRestartSecret(&restartPoolPassword, password)
+		return password, nil
+	}
+
+	password, ok, err := promptSecret("Pool password: ")
+	if err != nil {
+		return nil, fmt.Errorf("could not read pool password: %v", err)
+	}
+	if ok {
+		setRestartSecret(&restartPoolPassword, password)
+	}
+	return password, nil
+}
+
+// readKeyPassphrase returns the passphrase protecting the key of an offline
+// encrypted filesystem, from the file named by -key_passphrase_file, the
+// previous pfsd if this one was restarted, the PFSD_KEY_PASSPHRASE environment
+// variable or a prompt. If confirm is set a
+// prompted passphrase must be typed twice. The caller should zero the
+// returned slice once it is no longer needed.
+func readKeyPassphrase(confirm bool) ([]byte, error) {
+	if *keyPassphraseFile != "" {
+		passphrase, err := readSecretFile(*keyPassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read key passphrase file: %v", err)
+		}
+		if confirm && len(passphrase) == 0 {
+			return nil, errors.New("key passphrase file is empty")
+		}
+		return passphrase, nil
+	}
+
+	if passphrase := getRestartSecret(&restartKeyPassphrase); passphrase != nil {
+		return passphrase, nil
+	}
+
+	if passphrase, ok := lookupSecretEnv(keyPassphraseEnv); ok {
+		if confirm && len(passphrase) == 0 {
+			return nil, fmt.Errorf("%s must not be empty", keyPassphraseEnv)
+		}
+		setRestartSecret(&restartKeyPassphrase, passphrase)
+		return passphrase, nil
+	}
+
+	passphrase, ok, err := promptSecret("Filesystem passphrase: ")
+	if err != nil {
+		return nil, fmt.Errorf("could not read key passphrase: %v", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("a passphrase is required: use key_passphrase_file or %s", keyPassphraseEnv)
+	}
+	if confirm && len(passphrase) == 0 {
+		return nil, errors.New("passphrase must not be empty")
+	}
+	if confirm {
+		again, _, err := promptSecret("Confirm filesystem passphrase: ")
+		if err != nil {
+			return nil, fmt.Errorf("could not read key passphrase: %v", err)
+		}
+		match := bytes.Equal(passphrase, again)
+		zeroBytes(again)
+		if !match {
+			zeroBytes(passphrase)
+			return nil, errors.New("passphrases do not match")
+		}
+	}
+	setRestartSecret(&restartKeyPassphrase, passphrase)
+	return passphrase, nil
+}
+
+// storeKeyPassphrase records a changed key passphrase so that it is used when
+// pfsd next starts. It replaces the contents of key_passphrase_file if one was
+// given, and otherwise the passphrase handed to pfsd when it restarts.
+func storeKeyPassphrase(passphrase []byte) error {
+	if *keyPassphraseFile != "" {
+		info, err := os.Stat(*keyPassphraseFile)
+		if err != nil {
+			return fmt.Errorf("could not stat key passphrase file: %v", err)
+		}
+		err = durable.WriteFile(*keyPassphraseFile, passphrase, info.Mode().Perm())
+		if err != nil {
+			return fmt.Errorf("could not update key passphrase file: %v", err)
+		}
+		return nil
+	}
+	setRestartSecret(&restartKeyPassphrase, passphrase)
+	return nil
+}
+
+// restartEnv returns the environment of a restarted pfsd. Secrets are left
+// out of it; if withSecrets is set the restarted pfsd is told to read them
+// from its secrets pipe instead.
+func restartEnv(withSecrets bool) []string {
+	var env []string
+	for _, v := range os.Environ() {
+		if strings.HasPrefix(v, poolPasswordEnv+"=") ||
+			strings.HasPrefix(v, keyPassphraseEnv+"=") ||
+			strings.HasPrefix(v, secretsFDEnv+"=") {
+			continue
+		}
+		env = append(env, v)
+	}
+	if withSecrets {
+		env = append(env, secretsFDEnv+"="+strconv.Itoa(secretsFD))
+	}
+	return env
+}
+
+// zeroBytes overwrites a secret held in memory.
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
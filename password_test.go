@@ -0,0 +1,91 @@
+// +build !integration
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSecretsPipe(t *testing.T) {
+	setRestartSecret(&restartPoolPassword, []byte("pool password"))
+	setRestartSecret(&restartKeyPassphrase, []byte("key\npassphrase"))
+	defer setRestartSecret(&restartPoolPassword, nil)
+	defer setRestartSecret(&restartKeyPassphrase, nil)
+
+	pipe, err := restartSecretsPipe()
+	if err != nil {
+		t.Fatal("Could not create secrets pipe:", err)
+	}
+	if pipe == nil {
+		t.Fatal("No secrets pipe was created")
+	}
+
+	setRestartSecret(&restartPoolPassword, nil)
+	setRestartSecret(&restartKeyPassphrase, nil)
+	os.Setenv(secretsFDEnv, strconv.Itoa(int(pipe.Fd())))
+	if err := readInheritedSecrets(); err != nil {
+		t.Fatal("Could not read inherited secrets:", err)
+	}
+	if _, ok := os.LookupEnv(secretsFDEnv); ok {
+		t.Error(secretsFDEnv, "was not removed from the environment")
+	}
+	if password := getRestartSecret(&restartPoolPassword); string(password) != "pool password" {
+		t.Errorf("Inherited pool password %q", password)
+	}
+	if passphrase := getRestartSecret(&restartKeyPassphrase); string(passphrase) != "key\npassphrase" {
+		t.Errorf("Inherited key passphrase %q", passphrase)
+	}
+}
+
+func TestNoSecretsPipe(t *testing.T) {
+	pipe, err := restartSecretsPipe()
+	if err != nil {
+		t.Fatal("Could not create secrets pipe:", err)
+	}
+	if pipe != nil {
+		pipe.Close()
+		t.Error("A secrets pipe was created without any secrets")
+	}
+}
+
+func TestDecodeTruncatedSecrets(t *testing.T) {
+	defer setRestartSecret(&restartPoolPassword, nil)
+	if err := decodeSecrets([]byte{poolPasswordSecret, 0, 0, 0, 9, 'a'}); err == nil {
+		t.Error("Truncated secrets were accepted")
+	}
+	if err := decodeSecrets([]byte{'x', 0, 0, 0, 0}); err == nil {
+		t.Error("An unknown secret was accepted")
+	}
+}
+
+func TestSecretEnvRemoved(t *testing.T) {
+	os.Setenv(poolPasswordEnv, "password")
+	os.Setenv(keyPassphraseEnv, "passphrase")
+	defer os.Unsetenv(keyPassphraseEnv)
+
+	password, ok := lookupSecretEnv(poolPasswordEnv)
+	if !ok || string(password) != "password" {
+		t.Errorf("Read pool password %q", password)
+	}
+	if _, ok := os.LookupEnv(poolPasswordEnv); ok {
+		t.Error(poolPasswordEnv, "was not removed from the environment")
+	}
+
+	for _, withSecrets := range []bool{false, true} {
+		var fdSet bool
+		for _, v := range restartEnv(withSecrets) {
+			if strings.HasPrefix(v, poolPasswordEnv+"=") || strings.HasPrefix(v, keyPassphraseEnv+"=") {
+				t.Error("Restart environment contains a secret:", v)
+			}
+			if v == secretsFDEnv+"="+strconv.Itoa(secretsFD) {
+				fdSet = true
+			}
+		}
+		if fdSet != withSecrets {
+			t.Errorf("Restart environment names the secrets pipe: %v, expected %v", fdSet, withSecrets)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package pfi
 
 import (
 	"os"
+	"sync"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -16,6 +17,14 @@ import (
 type ParanoidFile struct {
 	Name string
 	nodefs.File
+
+	// writeLock is held for reading by every write through this handle and
+	// for writing by Fsync, so that Fsync waits for the writes before it.
+	writeLock sync.RWMutex
+	errLock   sync.Mutex
+	// writeErr is the first write error not yet reported by Flush or Fsync.
+	// The kernel may have already told the application a write succeeded.
+	writeErr fuse.Status
 }
 
 //newParanoidFile returns a new object of ParanoidFile
@@ -29,6 +38,10 @@ func newParanoidFile(name string) nodefs.File {
 //Read reads a file and returns an array of bytes
 func (f *ParanoidFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
 	Log.Info("Read called on file:", f.Name)
+	if !globals.BeginOperation() {
+		return nil, lockedStatus
+	}
+	defer globals.EndOperation()
 	code, data, err := commands.ReadCommand(globals.ParanoidDir, f.Name, off, int64(len(buf)))
 	if code == returncodes.EUNEXPECTED {
 		Log.Fatal("Error running read command :", err)
@@ -48,6 +61,12 @@ func (f *ParanoidFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status
 //Write writes to a file
 func (f *ParanoidFile) Write(content []byte, off int64) (uint32, fuse.Status) {
 	Log.Info("Write called on file : " + f.Name)
+	if !globals.BeginOperation() {
+		return 0, lockedStatus
+	}
+	defer globals.EndOperation()
+	f.writeLock.RLock()
+	defer f.writeLock.RUnlock()
 	var (
 		code         returncodes.Code
 		err          error
@@ -70,6 +89,11 @@ func (f *ParanoidFile) Write(content []byte, off int64) (uint32, fuse.Status) {
 	if code != returncodes.OK {
 		return 0, GetFuseReturnCode(code)
 	}
+	// The caller only sees a short count, so why the rest was not written is
+	// reported later
+	if bytesWritten < len(content) {
+		f.setWriteError(fuse.EIO)
+	}
 
 	return uint32(bytesWritten), fuse.OK
 }
@@ -77,6 +101,12 @@ func (f *ParanoidFile) Write(content []byte, off int64) (uint32, fuse.Status) {
 //Truncate is called when a file is to be reduced in length to size.
 func (f *ParanoidFile) Truncate(size uint64) fuse.Status {
 	Log.Info("Truncate called on file : " + f.Name)
+	if !globals.BeginOperation() {
+		return lockedStatus
+	}
+	defer globals.EndOperation()
+	f.writeLock.RLock()
+	defer f.writeLock.RUnlock()
 	var code returncodes.Code
 	var err error
 	if SendOverNetwork {
@@ -99,6 +129,10 @@ func (f *ParanoidFile) Truncate(size uint64) fuse.Status {
 //Utimens updates the access and mofication time of the file.
 func (f *ParanoidFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
 	Log.Info("Utimens called on file : " + f.Name)
+	if !globals.BeginOperation() {
+		return lockedStatus
+	}
+	defer globals.EndOperation()
 	var code returncodes.Code
 	var err error
 	if SendOverNetwork {
@@ -120,6 +154,10 @@ func (f *ParanoidFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
 //Chmod changes the permission flags of the file
 func (f *ParanoidFile) Chmod(perms uint32) fuse.Status {
 	Log.Info("Chmod called on file : " + f.Name)
+	if !globals.BeginOperation() {
+		return lockedStatus
+	}
+	defer globals.EndOperation()
 	var code returncodes.Code
 	var err error
 	if SendOverNetwork {
@@ -137,3 +175,53 @@ func (f *ParanoidFile) Chmod(perms uint32) fuse.Status {
 	}
 	return GetFuseReturnCode(code)
 }
+
+//Flush is called each time the file is closed. Short writes are reported
+//here, as the application has only seen the count of bytes written.
+func (f *ParanoidFile) Flush() fuse.Status {
+	Log.Info("Flush called on file : " + f.Name)
+	return f.takeWriteError()
+}
+
+//Fsync returns once every write made through this handle before it is
+//durable. Writes are only applied locally after raft has committed them, so
+//the writes in progress are waited for and the applied data is synced to
+//disk.
+func (f *ParanoidFile) Fsync(flags int) fuse.Status {
+	Log.Info("Fsync called on file : " + f.Name)
+	if !globals.BeginOperation() {
+		return lockedStatus
+	}
+	defer globals.EndOperation()
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+
+	if code := f.takeWriteError(); code != fuse.OK {
+		return code
+	}
+	// libpfs does not expose where the contents of a file are stored, so
+	// the filesystem holding the paranoid directory is synced
+	if err := syncFilesystem(globals.ParanoidDir); err != nil {
+		Log.Error("Error syncing paranoid directory :", err)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+func (f *ParanoidFile) setWriteError(code fuse.Status) {
+	f.errLock.Lock()
+	defer f.errLock.Unlock()
+	if f.writeErr == fuse.OK {
+		f.writeErr = code
+	}
+}
+
+// takeWriteError returns the pending write error and clears it, so that each
+// error is only reported once.
+func (f *ParanoidFile) takeWriteError() fuse.Status {
+	f.errLock.Lock()
+	defer f.errLock.Unlock()
+	code := f.writeErr
+	f.writeErr = fuse.OK
+	return code
+}
@@ -2,6 +2,7 @@ package pfi
 
 import (
 	"os"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/fuse"
@@ -19,6 +20,16 @@ type ParanoidFileSystem struct {
 	pathfs.FileSystem
 }
 
+// statBlockSize is the unit of fuse.Attr.Blocks
+const statBlockSize = 512
+
+// mountOwner owns every file without a metadata record, which is every file
+// created by the user who mounted the filesystem until it is given away.
+var mountOwner = fuse.Owner{
+	Uid: uint32(os.Getuid()),
+	Gid: uint32(os.Getgid()),
+}
+
 //GetAttr is called by fuse when the attributes of a
 //file or directory are needed. (pfs stat)
 func (fs *ParanoidFileSystem) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
@@ -26,9 +37,31 @@ func (fs *ParanoidFileSystem) GetAttr(name string, context *fuse.Context) (*fuse
 
 	// Special case : "" is the root of our filesystem
 	if name == "" {
-		return &fuse.Attr{
-			Mode: fuse.S_IFDIR | 0755,
-		}, fuse.OK
+		attr := &fuse.Attr{
+			Mode:  fuse.S_IFDIR | 0755,
+			Nlink: 2,
+			Owner: mountOwner,
+		}
+		// The root is found while the filesystem is locked, but what is
+		// recorded about it can not be read
+		if !globals.BeginOperation() {
+			return attr, fuse.OK
+		}
+		defer globals.EndOperation()
+		if code := fillMetadata(name, attr); code != fuse.OK {
+			return nil, code
+		}
+		return attr, fuse.OK
+	}
+	if isMetaPath(name) {
+		return nil, fuse.ENOENT
+	}
+	if !globals.BeginOperation() {
+		return nil, lockedStatus
+	}
+	defer globals.EndOperation()
+	if code := newPermissionCheck(context).permission(parentDir(name), permExec); code != fuse.OK {
+		return nil, code
 	}
 
 	code, stats, err := commands.StatCommand(globals.ParanoidDir, name)
@@ -45,19 +78,81 @@ func (fs *ParanoidFileSystem) GetAttr(name string, context *fuse.Context) (*fuse
 	}
 
 	attr := fuse.Attr{
-		Size:  uint64(stats.Length),
-		Atime: uint64(stats.Atime.Unix()),
-		Ctime: uint64(stats.Ctime.Unix()),
-		Mtime: uint64(stats.Mtime.Unix()),
-		Mode:  uint32(stats.Mode),
+		Size:   uint64(stats.Length),
+		Atime:  uint64(stats.Atime.Unix()),
+		Ctime:  uint64(stats.Ctime.Unix()),
+		Mtime:  uint64(stats.Mtime.Unix()),
+		Mode:   uint32(stats.Mode),
+		Blocks: (uint64(stats.Length) + statBlockSize - 1) / statBlockSize,
+	}
+	if code := fillMetadata(name, &attr); code != fuse.OK {
+		return nil, code
 	}
 
 	return &attr, fuse.OK
 }
 
+// fillMetadata sets the owner, link count and inode number of attr from the
+// metadata record of name, and counts the links of a directory, which are
+// its own, the one from its parent and those from its subdirectories.
+func fillMetadata(name string, attr *fuse.Attr) fuse.Status {
+	id, inode, code := loadInode(name)
+	if code != fuse.OK {
+		return code
+	}
+	attr.Owner = inode.owner()
+	if inode != nil && name != "" {
+		attr.Ino = inodeNumber(id)
+	}
+	if attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		attr.Nlink = 1
+		if inode != nil {
+			attr.Nlink = inode.Links
+		}
+		return fuse.OK
+	}
+
+	returnCode, names, err := commands.ReadDirCommand(globals.ParanoidDir, name)
+	if code := commandStatus("readdir", returnCode, err); code != fuse.OK {
+		return code
+	}
+	attr.Nlink = 2
+	for _, child := range names {
+		if name == "" && child == metaDir {
+			continue
+		}
+		if name != "" {
+			child = name + "/" + child
+		}
+		mode, code := fileMode(child)
+		if code != fuse.OK {
+			return code
+		}
+		if mode&syscall.S_IFMT == syscall.S_IFDIR {
+			attr.Nlink++
+		}
+	}
+	return fuse.OK
+}
+
+// creatorOf returns the owner of the files created by a request
+func creatorOf(context *fuse.Context) fuse.Owner {
+	if context == nil {
+		return mountOwner
+	}
+	return context.Owner
+}
+
 //OpenDir is called when the contents of a directory are needed.
 func (fs *ParanoidFileSystem) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 	Log.Info("OpenDir called on : " + name)
+	if !globals.BeginOperation() {
+		return nil, lockedStatus
+	}
+	defer globals.EndOperation()
+	if code := newPermissionCheck(context).permission(name, permRead); code != fuse.OK {
+		return nil, code
+	}
 
 	code, fileNames, err := commands.ReadDirCommand(globals.ParanoidDir, name)
 	if code == returncodes.EUNEXPECTED {
@@ -72,10 +167,13 @@ func (fs *ParanoidFileSystem) OpenDir(name string, context *fuse.Context) ([]fus
 		return nil, GetFuseReturnCode(code)
 	}
 
-	dirEntries := make([]fuse.DirEntry, len(fileNames))
-	for i, dirName := range fileNames {
+	dirEntries := make([]fuse.DirEntry, 0, len(fileNames))
+	for _, dirName := range fileNames {
+		if name == "" && dirName == metaDir {
+			continue
+		}
 		Log.Info("OpenDir has " + dirName)
-		dirEntries[i] = fuse.DirEntry{Name: dirName}
+		dirEntries = append(dirEntries, fuse.DirEntry{Name: dirName})
 	}
 
 	return dirEntries, fuse.OK
@@ -86,12 +184,26 @@ func (fs *ParanoidFileSystem) OpenDir(name string, context *fuse.Context) ([]fus
 //custom file object (ParanoidFile, see below)
 func (fs *ParanoidFileSystem) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
 	Log.Info("Open called on : " + name)
+	if !globals.BeginOperation() {
+		return nil, lockedStatus
+	}
+	defer globals.EndOperation()
+	if code := newPermissionCheck(context).permission(name, openMask(flags)); code != fuse.OK {
+		return nil, code
+	}
 	return newParanoidFile(name), fuse.OK
 }
 
 //Create is called when a new file is to be created.
 func (fs *ParanoidFileSystem) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
 	Log.Info("Create called on : " + name)
+	if !globals.BeginOperation() {
+		return nil, lockedStatus
+	}
+	defer globals.EndOperation()
+	if code := newPermissionCheck(context).create(name); code != fuse.OK {
+		return nil, code
+	}
 	var code returncodes.Code
 	var err error
 	if SendOverNetwork {
@@ -111,6 +223,9 @@ func (fs *ParanoidFileSystem) Create(name string, flags uint32, mode uint32, con
 	if code != returncodes.OK {
 		return nil, GetFuseReturnCode(code)
 	}
+	if code := createMetadata(name, creatorOf(context)); code != fuse.OK {
+		return nil, code
+	}
 	return newParanoidFile(name), fuse.OK
 }
 
@@ -118,6 +233,13 @@ func (fs *ParanoidFileSystem) Create(name string, flags uint32, mode uint32, con
 func (fs *ParanoidFileSystem) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
 	Log.Info("Access called on : " + name)
 	if name != "" {
+		if !globals.BeginOperation() {
+			return lockedStatus
+		}
+		defer globals.EndOperation()
+		if context != nil {
+			return newPermissionCheck(context).permission(name, mode&7)
+		}
 		code, err := commands.AccessCommand(globals.ParanoidDir, name, mode)
 		if code == returncodes.EUNEXPECTED {
 			Log.Fatal("Error running access command :", err)
@@ -128,12 +250,23 @@ func (fs *ParanoidFileSystem) Access(name string, mode uint32, context *fuse.Con
 		}
 		return GetFuseReturnCode(code)
 	}
-	return fuse.OK
+	return newPermissionCheck(context).permission(name, mode&7)
 }
 
 //Rename is called when renaming a file
 func (fs *ParanoidFileSystem) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
 	Log.Info("Rename called on : " + oldName + " to be renamed to " + newName)
+	if !globals.BeginOperation() {
+		return lockedStatus
+	}
+	defer globals.EndOperation()
+	perm := newPermissionCheck(context)
+	if code := perm.remove(oldName); code != fuse.OK {
+		return code
+	}
+	if code := perm.create(newName); code != fuse.OK {
+		return code
+	}
 	var code returncodes.Code
 	var err error
 	if SendOverNetwork {
@@ -149,12 +282,26 @@ func (fs *ParanoidFileSystem) Rename(oldName string, newName string, context *fu
 	if err != nil {
 		Log.Error("Error running rename command :", err)
 	}
-	return GetFuseReturnCode(code)
+	if code != returncodes.OK {
+		return GetFuseReturnCode(code)
+	}
+	return renameMetadata(oldName, newName)
 }
 
 //Link creates a hard link from newName to oldName
 func (fs *ParanoidFileSystem) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
 	Log.Info("Link called")
+	if !globals.BeginOperation() {
+		return lockedStatus
+	}
+	defer globals.EndOperation()
+	perm := newPermissionCheck(context)
+	if code := perm.permission(oldName, 0); code != fuse.OK {
+		return code
+	}
+	if code := perm.create(newName); code != fuse.OK {
+		return code
+	}
 	var code returncodes.Code
 	var err error
 	if SendOverNetwork {
@@ -170,12 +317,22 @@ func (fs *ParanoidFileSystem) Link(oldName string, newName string, context *fuse
 	if err != nil {
 		Log.Error("Error running link command :", err)
 	}
-	return GetFuseReturnCode(code)
+	if code != returncodes.OK {
+		return GetFuseReturnCode(code)
+	}
+	return linkMetadata(oldName, newName)
 }
 
 //Symlink creates a symbolic link from newName to oldName
 func (fs *ParanoidFileSystem) Symlink(oldName string, newName string, context *fuse.Context) fuse.Status {
 	Log.Info("Symbolic link called from", oldName, "to", newName)
+	if !globals.BeginOperation() {
+		return lockedStatus
+	}
+	defer globals.EndOperation()
+	if code := newPermissionCheck(context).create(newName); code != fuse.OK {
+		return code
+	}
 	var code returncodes.Code
 	var err error
 	if SendOverNetwork {
@@ -191,12 +348,25 @@ func (fs *ParanoidFileSystem) Symlink(oldName string, newName string, context *f
 	if err != nil {
 		Log.Error("Error running symlink command :", err)
 	}
-	return GetFuseReturnCode(code)
+	if code != returncodes.OK {
+		return GetFuseReturnCode(code)
+	}
+	return createMetadata(newName, creatorOf(context))
 }
 
 // Readlink to where the file is pointing to
 func (fs *ParanoidFileSystem) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
 	Log.Info("Readlink called on", name)
+	if isMetaPath(name) {
+		return "", fuse.ENOENT
+	}
+	if !globals.BeginOperation() {
+		return "", lockedStatus
+	}
+	defer globals.EndOperation()
+	if code := newPermissionCheck(context).permission(parentDir(name), permExec); code != fuse.OK {
+		return "", code
+	}
 	code, link, err := commands.ReadlinkCommand(globals.ParanoidDir, name)
 	if code == returncodes.EUNEXPECTED {
 		Log.Fatal("Error running readlink command :", err)
@@ -211,6 +381,13 @@ func (fs *ParanoidFileSystem) Readlink(name string, context *fuse.Context) (stri
 //Unlink is called when deleting a file
 func (fs *ParanoidFileSystem) Unlink(name string, context *fuse.Context) fuse.Status {
 	Log.Info("Unlink callde on : " + name)
+	if !globals.BeginOperation() {
+		return lockedStatus
+	}
+	defer globals.EndOperation()
+	if code := newPermissionCheck(context).remove(name); code != fuse.OK {
+		return code
+	}
 	var code returncodes.Code
 	var err error
 	if SendOverNetwork {
@@ -226,12 +403,22 @@ func (fs *ParanoidFileSystem) Unlink(name string, context *fuse.Context) fuse.St
 	if err != nil {
 		Log.Error("Error running unlink command :", err)
 	}
-	return GetFuseReturnCode(code)
+	if code != returncodes.OK {
+		return GetFuseReturnCode(code)
+	}
+	return unlinkMetadata(name)
 }
 
 //Mkdir is called when creating a directory
 func (fs *ParanoidFileSystem) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
 	Log.Info("Mkdir called on : " + name)
+	if !globals.BeginOperation() {
+		return lockedStatus
+	}
+	defer globals.EndOperation()
+	if code := newPermissionCheck(context).create(name); code != fuse.OK {
+		return code
+	}
 	var code returncodes.Code
 	var err error
 	if SendOverNetwork {
@@ -247,12 +434,22 @@ func (fs *ParanoidFileSystem) Mkdir(name string, mode uint32, context *fuse.Cont
 	if err != nil {
 		Log.Error("Error running mkdir command :", err)
 	}
-	return GetFuseReturnCode(code)
+	if code != returncodes.OK {
+		return GetFuseReturnCode(code)
+	}
+	return createMetadata(name, creatorOf(context))
 }
 
 //Rmdir is called when deleting a directory
 func (fs *ParanoidFileSystem) Rmdir(name string, context *fuse.Context) fuse.Status {
 	Log.Info("Rmdir called on : " + name)
+	if !globals.BeginOperation() {
+		return lockedStatus
+	}
+	defer globals.EndOperation()
+	if code := newPermissionCheck(context).remove(name); code != fuse.OK {
+		return code
+	}
 	var code returncodes.Code
 	var err error
 	if SendOverNetwork {
@@ -268,12 +465,18 @@ func (fs *ParanoidFileSystem) Rmdir(name string, context *fuse.Context) fuse.Sta
 	if err != nil {
 		Log.Error("Error running rmdir command :", err)
 	}
-	return GetFuseReturnCode(code)
+	if code != returncodes.OK {
+		return GetFuseReturnCode(code)
+	}
+	return unlinkMetadata(name)
 }
 
 //Truncate is called when a file is to be reduced in length to size.
 func (fs *ParanoidFileSystem) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
 	Log.Info("Truncate called on : " + name)
+	if code := newPermissionCheck(context).permission(name, permWrite); code != fuse.OK {
+		return code
+	}
 	pfile := newParanoidFile(name)
 	return pfile.Truncate(size)
 }
@@ -281,6 +484,16 @@ func (fs *ParanoidFileSystem) Truncate(name string, size uint64, context *fuse.C
 //Utimens update the Access time and modified time of a given file.
 func (fs *ParanoidFileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
 	Log.Info("Utimens called on : " + name)
+	// Only the owner may set other times than the current time, which can
+	// not be told apart here, so write permission is enough.
+	perm := newPermissionCheck(context)
+	code := perm.owner(name)
+	if code == fuse.EPERM {
+		code = perm.permission(name, permWrite)
+	}
+	if code != fuse.OK {
+		return code
+	}
 	pfile := newParanoidFile(name)
 	return pfile.Utimens(atime, mtime)
 }
@@ -288,6 +501,51 @@ func (fs *ParanoidFileSystem) Utimens(name string, atime *time.Time, mtime *time
 //Chmod is called when the permissions of a file are to be changed
 func (fs *ParanoidFileSystem) Chmod(name string, perms uint32, context *fuse.Context) fuse.Status {
 	Log.Info("Chmod called on : " + name)
+	if code := newPermissionCheck(context).owner(name); code != fuse.OK {
+		return code
+	}
 	pfile := newParanoidFile(name)
 	return pfile.Chmod(perms)
 }
+
+//Chown is called when the owner of a file is to be changed. The owner is
+//kept in the metadata record of the file.
+func (fs *ParanoidFileSystem) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	Log.Info("Chown called on : " + name)
+	if !globals.BeginOperation() {
+		return lockedStatus
+	}
+	defer globals.EndOperation()
+	if _, code := fileMode(name); code != fuse.OK {
+		return code
+	}
+	if code := newPermissionCheck(context).chown(name, uid, gid); code != fuse.OK {
+		return code
+	}
+
+	metaLock.Lock()
+	defer metaLock.Unlock()
+	id, inode, code := loadInode(name)
+	if code != fuse.OK {
+		return code
+	}
+	owner := inode.owner()
+	// -1 leaves the uid or gid unchanged
+	if uid != ^uint32(0) {
+		owner.Uid = uid
+	}
+	if gid != ^uint32(0) {
+		owner.Gid = gid
+	}
+	if owner == inode.owner() {
+		return fuse.OK
+	}
+	if inode == nil {
+		inode = &inodeRecord{Links: 1}
+		inode.setOwner(owner)
+		_, code = newInode(name, inode)
+		return code
+	}
+	inode.setOwner(owner)
+	return saveInode(id, inode)
+}
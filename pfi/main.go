@@ -3,6 +3,7 @@ package pfi
 import (
 	"path"
 
+	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 
@@ -33,7 +34,10 @@ func StartPfi(logVerbose bool) {
 	nfs := pathfs.NewPathNodeFs(&ParanoidFileSystem{
 		FileSystem: pathfs.NewDefaultFileSystem(),
 	}, &opts)
-	server, _, err := nodefs.MountRoot(globals.MountPoint, nfs.Root(), nil)
+	conn := nodefs.NewFileSystemConnector(nfs.Root(), nil)
+	server, err := fuse.NewServer(conn.RawFS(), globals.MountPoint, &fuse.MountOptions{
+		AllowOther: AllowOther,
+	})
 	if err != nil {
 		Log.Fatalf("Mount fail: %v\n", err)
 	}
@@ -0,0 +1,385 @@
+package pfi
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/pp2p/paranoid/libpfs/commands"
+	"github.com/pp2p/paranoid/libpfs/returncodes"
+	"github.com/pp2p/pfsd/globals"
+)
+
+// libpfs only keeps the contents, mode and times of files. The rest of their
+// metadata is kept in records stored as files below metaDir, which is hidden
+// from the filesystem. Records are written with the same commands as any
+// other file, so they are replicated through the raft log like the files
+// themselves.
+//
+// Every name with metadata has a record in metaNamesDir, named after the hash
+// of the name, holding the id of its inode record in metaInodesDir. Hard
+// links share the inode record of the file they link to. Files without a
+// record belong to mountOwner, have a single link and no extended attributes,
+// so files created by the user who mounted the filesystem, and files created
+// before records were kept, only get one once their metadata is changed.
+const (
+	metaDir       = ".pfsmeta"
+	metaNamesDir  = metaDir + "/names"
+	metaInodesDir = metaDir + "/inodes"
+)
+
+// metaLock is held while records are changed, so that changes made on this
+// node do not overwrite each other. Changes made on different nodes at the
+// same time are not ordered.
+var metaLock sync.Mutex
+
+// inodeRecord is the metadata shared by a file and its hard links
+type inodeRecord struct {
+	// Links is the number of names sharing the record
+	Links uint32 `json:"links"`
+	// Owner is nil for records of files owned by mountOwner
+	Owner  *fuse.Owner       `json:"owner,omitempty"`
+	XAttrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+func (inode *inodeRecord) owner() fuse.Owner {
+	if inode == nil || inode.Owner == nil {
+		return mountOwner
+	}
+	return *inode.Owner
+}
+
+func (inode *inodeRecord) setOwner(owner fuse.Owner) {
+	if owner == mountOwner {
+		inode.Owner = nil
+	} else {
+		inode.Owner = &owner
+	}
+}
+
+// inodeNumber derives the inode number reported for a file from the id of
+// its inode record, so that hard links are reported as the same file.
+func inodeNumber(id string) uint64 {
+	raw, err := hex.DecodeString(id)
+	if err != nil || len(raw) < 8 {
+		return 0
+	}
+	// 1 is the root of the filesystem
+	return binary.BigEndian.Uint64(raw) | 2
+}
+
+// isMetaPath reports whether name is the records directory or below it.
+func isMetaPath(name string) bool {
+	return name == metaDir || strings.HasPrefix(name, metaDir+"/")
+}
+
+func nameRecordPath(name string) string {
+	hash := sha256.Sum256([]byte(name))
+	return metaNamesDir + "/" + hex.EncodeToString(hash[:])
+}
+
+func inodeRecordPath(id string) string {
+	return metaInodesDir + "/" + id
+}
+
+// commandStatus logs the outcome of a libpfs command and returns its status.
+func commandStatus(command string, code returncodes.Code, err error) fuse.Status {
+	if code == returncodes.EUNEXPECTED {
+		Log.Fatal("Error running "+command+" command :", err)
+	}
+
+	if err != nil {
+		Log.Error("Error running "+command+" command :", err)
+	}
+	return GetFuseReturnCode(code)
+}
+
+func metaCreat(name string) fuse.Status {
+	var code returncodes.Code
+	var err error
+	if SendOverNetwork {
+		code, err = globals.RaftNetworkServer.RequestCreatCommand(name, 0600)
+	} else {
+		code, err = commands.CreatCommand(globals.ParanoidDir, name, 0600)
+	}
+	return commandStatus("creat", code, err)
+}
+
+func metaWrite(name string, data []byte) fuse.Status {
+	var (
+		code         returncodes.Code
+		err          error
+		bytesWritten int
+	)
+	if SendOverNetwork {
+		code, bytesWritten, err = globals.RaftNetworkServer.RequestWriteCommand(name, 0, int64(len(data)), data)
+	} else {
+		code, bytesWritten, err = commands.WriteCommand(globals.ParanoidDir, name, 0, int64(len(data)), data)
+	}
+	if status := commandStatus("write", code, err); status != fuse.OK {
+		return status
+	}
+	if bytesWritten < len(data) {
+		Log.Error("Short write of metadata record", name)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+func metaRename(oldName, newName string) fuse.Status {
+	var code returncodes.Code
+	var err error
+	if SendOverNetwork {
+		code, err = globals.RaftNetworkServer.RequestRenameCommand(oldName, newName)
+	} else {
+		code, err = commands.RenameCommand(globals.ParanoidDir, oldName, newName)
+	}
+	return commandStatus("rename", code, err)
+}
+
+func metaUnlink(name string) fuse.Status {
+	var code returncodes.Code
+	var err error
+	if SendOverNetwork {
+		code, err = globals.RaftNetworkServer.RequestUnlinkCommand(name)
+	} else {
+		code, err = commands.UnlinkCommand(globals.ParanoidDir, name)
+	}
+	return commandStatus("unlink", code, err)
+}
+
+func metaMkdir(name string) fuse.Status {
+	var code returncodes.Code
+	var err error
+	if SendOverNetwork {
+		code, err = globals.RaftNetworkServer.RequestMkdirCommand(name, 0700)
+	} else {
+		code, err = commands.MkdirCommand(globals.ParanoidDir, name, 0700)
+	}
+	return commandStatus("mkdir", code, err)
+}
+
+// createMetaDirs creates the directories holding the records, which do not
+// exist until the first record is written.
+func createMetaDirs() fuse.Status {
+	for _, dir := range []string{metaDir, metaNamesDir, metaInodesDir} {
+		if code := metaMkdir(dir); code != fuse.OK && code != fuse.Status(syscall.EEXIST) {
+			return code
+		}
+	}
+	return fuse.OK
+}
+
+// readRecord reads the record at name. It returns fuse.ENOENT if there is no
+// record.
+func readRecord(name string) ([]byte, fuse.Status) {
+	code, stats, err := commands.StatCommand(globals.ParanoidDir, name)
+	if code == returncodes.ENOENT {
+		return nil, fuse.ENOENT
+	}
+	if status := commandStatus("stat", code, err); status != fuse.OK {
+		return nil, status
+	}
+	code, data, err := commands.ReadCommand(globals.ParanoidDir, name, 0, stats.Length)
+	if status := commandStatus("read", code, err); status != fuse.OK {
+		return nil, status
+	}
+	return data, fuse.OK
+}
+
+// writeRecord replaces the record at name with data. The record is written
+// under a temporary name and renamed over the old one, so that it is never
+// read half written.
+func writeRecord(name string, data []byte) fuse.Status {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		Log.Error("Unable to generate name for metadata record :", err)
+		return fuse.EIO
+	}
+	tmp := name + "." + hex.EncodeToString(suffix)
+	code := metaCreat(tmp)
+	if code == fuse.ENOENT {
+		if code = createMetaDirs(); code != fuse.OK {
+			return code
+		}
+		code = metaCreat(tmp)
+	}
+	if code != fuse.OK {
+		return code
+	}
+	if code := metaWrite(tmp, data); code != fuse.OK {
+		metaUnlink(tmp)
+		return code
+	}
+	if code := metaRename(tmp, name); code != fuse.OK {
+		metaUnlink(tmp)
+		return code
+	}
+	return fuse.OK
+}
+
+// loadInode returns the id and inode record of name, or a nil record if name
+// has none.
+func loadInode(name string) (string, *inodeRecord, fuse.Status) {
+	data, code := readRecord(nameRecordPath(name))
+	if code == fuse.ENOENT {
+		return "", nil, fuse.OK
+	}
+	if code != fuse.OK {
+		return "", nil, code
+	}
+	id := string(data)
+	data, code = readRecord(inodeRecordPath(id))
+	if code != fuse.OK {
+		Log.Errorf("Unable to read inode record %s of %s : %s", id, name, code)
+		return "", nil, code
+	}
+	inode := &inodeRecord{}
+	if err := json.Unmarshal(data, inode); err != nil {
+		Log.Errorf("Unable to parse inode record %s of %s : %s", id, name, err)
+		return "", nil, fuse.EIO
+	}
+	return id, inode, fuse.OK
+}
+
+func saveInode(id string, inode *inodeRecord) fuse.Status {
+	data, err := json.Marshal(inode)
+	if err != nil {
+		Log.Error("Unable to encode inode record :", err)
+		return fuse.EIO
+	}
+	return writeRecord(inodeRecordPath(id), data)
+}
+
+// newInode records inode as the record of name, which must not have one.
+func newInode(name string, inode *inodeRecord) (string, fuse.Status) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		Log.Error("Unable to generate inode id :", err)
+		return "", fuse.EIO
+	}
+	id := hex.EncodeToString(raw)
+	if code := saveInode(id, inode); code != fuse.OK {
+		return "", code
+	}
+	return id, writeRecord(nameRecordPath(name), []byte(id))
+}
+
+// inodeOf returns the id and inode record of name, and records an empty one
+// if name has none yet.
+func inodeOf(name string) (string, *inodeRecord, fuse.Status) {
+	id, inode, code := loadInode(name)
+	if code != fuse.OK || inode != nil {
+		return id, inode, code
+	}
+	inode = &inodeRecord{Links: 1}
+	id, code = newInode(name, inode)
+	return id, inode, code
+}
+
+// createMetadata records owner as the owner of name, which has just been
+// created. A record left behind for an earlier file of the same name is
+// removed.
+func createMetadata(name string, owner fuse.Owner) fuse.Status {
+	metaLock.Lock()
+	defer metaLock.Unlock()
+	if code := removeName(name); code != fuse.OK {
+		return code
+	}
+	if owner == mountOwner {
+		return fuse.OK
+	}
+	inode := &inodeRecord{Links: 1}
+	inode.setOwner(owner)
+	_, code := newInode(name, inode)
+	return code
+}
+
+// linkMetadata gives newName, which has just been linked to oldName, the
+// inode record of oldName.
+func linkMetadata(oldName, newName string) fuse.Status {
+	metaLock.Lock()
+	defer metaLock.Unlock()
+	id, inode, code := inodeOf(oldName)
+	if code != fuse.OK {
+		return code
+	}
+	inode.Links++
+	if code := saveInode(id, inode); code != fuse.OK {
+		return code
+	}
+	return writeRecord(nameRecordPath(newName), []byte(id))
+}
+
+// unlinkMetadata removes the record of name, which has just been removed, and
+// its inode record once no other names share it.
+func unlinkMetadata(name string) fuse.Status {
+	metaLock.Lock()
+	defer metaLock.Unlock()
+	return removeName(name)
+}
+
+func removeName(name string) fuse.Status {
+	id, inode, code := loadInode(name)
+	if code != fuse.OK || inode == nil {
+		return code
+	}
+	if code := metaUnlink(nameRecordPath(name)); code != fuse.OK {
+		return code
+	}
+	if inode.Links > 1 {
+		inode.Links--
+		return saveInode(id, inode)
+	}
+	return metaUnlink(inodeRecordPath(id))
+}
+
+// renameMetadata moves the records of oldName, which has just been renamed to
+// newName, and of everything below it. The record newName still has belongs
+// to the file the rename replaced, and is removed first.
+func renameMetadata(oldName, newName string) fuse.Status {
+	metaLock.Lock()
+	defer metaLock.Unlock()
+	if code := removeName(newName); code != fuse.OK {
+		return code
+	}
+	return moveNames(oldName, newName)
+}
+
+func moveNames(oldName, newName string) fuse.Status {
+	id, status := readRecord(nameRecordPath(oldName))
+	switch status {
+	case fuse.OK:
+		if status := writeRecord(nameRecordPath(newName), id); status != fuse.OK {
+			return status
+		}
+		if status := metaUnlink(nameRecordPath(oldName)); status != fuse.OK {
+			return status
+		}
+	case fuse.ENOENT:
+	default:
+		return status
+	}
+
+	mode, status := fileMode(newName)
+	if status != fuse.OK || mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return status
+	}
+	code, names, err := commands.ReadDirCommand(globals.ParanoidDir, newName)
+	if status := commandStatus("readdir", code, err); status != fuse.OK {
+		return status
+	}
+	for _, child := range names {
+		if code := moveNames(oldName+"/"+child, newName+"/"+child); code != fuse.OK {
+			return code
+		}
+	}
+	return fuse.OK
+}
@@ -0,0 +1,327 @@
+package pfi
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/pp2p/paranoid/libpfs/commands"
+	"github.com/pp2p/paranoid/libpfs/returncodes"
+	"github.com/pp2p/pfsd/globals"
+)
+
+// Permission checks in the style of the default_permissions mount option. The
+// caller of every request is checked against the owner and mode of the files
+// it touches, and every directory leading to them must be searchable.
+// Requests without a context come from pfsd itself and are not checked.
+
+// Access bits, as passed to access(2)
+const (
+	permRead  uint32 = 4
+	permWrite uint32 = 2
+	permExec  uint32 = 1
+)
+
+const modeSticky uint32 = 01000
+
+// caller is the process a request was made by
+type caller struct {
+	uid    uint32
+	gid    uint32
+	groups []uint32
+}
+
+func callerOf(context *fuse.Context) caller {
+	c := caller{uid: context.Uid, gid: context.Gid}
+	groups, err := supplementaryGroups(context.Pid)
+	if err != nil {
+		Log.Verbosef("Unable to read groups of process %d: %s", context.Pid, err)
+	}
+	c.groups = groups
+	return c
+}
+
+// supplementaryGroups reads the groups of a process from /proc, as FUSE only
+// passes the primary group of the caller.
+func supplementaryGroups(pid uint32) ([]uint32, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		var groups []uint32
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			gid, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, uint32(gid))
+		}
+		return groups, nil
+	}
+	return nil, scanner.Err()
+}
+
+func (c caller) isRoot() bool {
+	return c.uid == 0
+}
+
+func (c caller) owns(file fileInfo) bool {
+	return c.isRoot() || c.uid == file.owner.Uid
+}
+
+func (c caller) inGroup(gid uint32) bool {
+	if c.gid == gid {
+		return true
+	}
+	for _, v := range c.groups {
+		if v == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed checks the access bits in mask against the mode and owner of a
+// file.
+func (c caller) allowed(file fileInfo, mask uint32) bool {
+	if c.isRoot() {
+		return true
+	}
+	var bits uint32
+	switch {
+	case c.uid == file.owner.Uid:
+		bits = (file.mode >> 6) & 7
+	case c.inGroup(file.owner.Gid):
+		bits = (file.mode >> 3) & 7
+	default:
+		bits = file.mode & 7
+	}
+	return bits&mask == mask
+}
+
+// fileInfo is what permissions are checked against
+type fileInfo struct {
+	mode  uint32
+	owner fuse.Owner
+}
+
+// fileMode returns the mode of a file, or the status to return if it can not
+// be found. The metadata records are never found.
+func fileMode(name string) (uint32, fuse.Status) {
+	// Special case : "" is the root of our filesystem
+	if name == "" {
+		return fuse.S_IFDIR | 0755, fuse.OK
+	}
+	if isMetaPath(name) {
+		return 0, fuse.ENOENT
+	}
+	if globals.Locked() {
+		return 0, lockedStatus
+	}
+	code, stats, err := commands.StatCommand(globals.ParanoidDir, name)
+	if code == returncodes.EUNEXPECTED {
+		Log.Fatal("Error running stat command :", err)
+	}
+
+	if err != nil {
+		Log.Error("Error running stat command :", err)
+	}
+
+	if code != returncodes.OK {
+		return 0, GetFuseReturnCode(code)
+	}
+	return uint32(stats.Mode), fuse.OK
+}
+
+func parentDir(name string) string {
+	dir := path.Dir(name)
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	return dir
+}
+
+// permissionCheck checks the caller of a single request. The caller is read
+// once per request, and the mode and owner of each file are only looked up
+// once, however many of the checks need them.
+type permissionCheck struct {
+	// nil for requests from pfsd itself, which are not checked
+	caller *caller
+	files  map[string]fileInfo
+}
+
+func newPermissionCheck(context *fuse.Context) *permissionCheck {
+	if context == nil {
+		return &permissionCheck{}
+	}
+	c := callerOf(context)
+	return &permissionCheck{
+		caller: &c,
+		files:  make(map[string]fileInfo),
+	}
+}
+
+func (p *permissionCheck) file(name string) (fileInfo, fuse.Status) {
+	if file, ok := p.files[name]; ok {
+		return file, fuse.OK
+	}
+	mode, code := fileMode(name)
+	if code != fuse.OK {
+		return fileInfo{}, code
+	}
+	_, inode, code := loadInode(name)
+	if code != fuse.OK {
+		return fileInfo{}, code
+	}
+	file := fileInfo{mode: mode, owner: inode.owner()}
+	p.files[name] = file
+	return file, fuse.OK
+}
+
+// search makes sure every directory leading to name is searchable.
+func (p *permissionCheck) search(name string) fuse.Status {
+	if name == "" || p.caller.isRoot() {
+		return fuse.OK
+	}
+	dir := parentDir(name)
+	if code := p.search(dir); code != fuse.OK {
+		return code
+	}
+	file, code := p.file(dir)
+	if code != fuse.OK {
+		return code
+	}
+	if !p.caller.allowed(file, permExec) {
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
+
+// permission returns fuse.OK if the caller may access name with the access
+// bits in mask.
+func (p *permissionCheck) permission(name string, mask uint32) fuse.Status {
+	if p.caller == nil {
+		return fuse.OK
+	}
+	if code := p.search(name); code != fuse.OK {
+		return code
+	}
+	file, code := p.file(name)
+	if code != fuse.OK {
+		return code
+	}
+	if !p.caller.allowed(file, mask) {
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
+
+// owner returns fuse.OK if the caller may change the mode or times of name,
+// which only its owner may do.
+func (p *permissionCheck) owner(name string) fuse.Status {
+	if p.caller == nil {
+		return fuse.OK
+	}
+	if code := p.search(name); code != fuse.OK {
+		return code
+	}
+	file, code := p.file(name)
+	if code != fuse.OK {
+		return code
+	}
+	if !p.caller.owns(file) {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// chown returns fuse.OK if the caller may give name the owner uid and group
+// gid, where ^uint32(0) leaves either unchanged. Only root may give a file
+// away, and its owner may only change its group to one they are in.
+func (p *permissionCheck) chown(name string, uid, gid uint32) fuse.Status {
+	if p.caller == nil {
+		return fuse.OK
+	}
+	if code := p.search(name); code != fuse.OK {
+		return code
+	}
+	file, code := p.file(name)
+	if code != fuse.OK {
+		return code
+	}
+	if p.caller.isRoot() {
+		return fuse.OK
+	}
+	if uid != ^uint32(0) && uid != file.owner.Uid {
+		return fuse.EPERM
+	}
+	if gid != ^uint32(0) && gid != file.owner.Gid &&
+		(!p.caller.owns(file) || !p.caller.inGroup(gid)) {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// create returns fuse.OK if the caller may add an entry called name to its
+// directory. Nobody may add entries in place of the metadata records.
+func (p *permissionCheck) create(name string) fuse.Status {
+	if isMetaPath(name) {
+		return fuse.EPERM
+	}
+	return p.permission(parentDir(name), permWrite|permExec)
+}
+
+// remove returns fuse.OK if the caller may remove the entry called name from
+// its directory. Entries of a sticky directory may only be removed by their
+// owner or the owner of the directory.
+func (p *permissionCheck) remove(name string) fuse.Status {
+	if code := p.create(name); code != fuse.OK || p.caller == nil {
+		return code
+	}
+	dir, code := p.file(parentDir(name))
+	if code != fuse.OK {
+		return code
+	}
+	if dir.mode&modeSticky == 0 || p.caller.owns(dir) {
+		return fuse.OK
+	}
+	file, code := p.file(name)
+	if code != fuse.OK {
+		return code
+	}
+	if !p.caller.owns(file) {
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
+
+// openMask returns the access bits needed to open a file with flags.
+func openMask(flags uint32) uint32 {
+	var mask uint32
+	switch int(flags) & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		mask = permRead
+	case syscall.O_WRONLY:
+		mask = permWrite
+	default:
+		mask = permRead | permWrite
+	}
+	if int(flags)&syscall.O_TRUNC != 0 {
+		mask |= permWrite
+	}
+	return mask
+}
@@ -5,6 +5,7 @@ package pfi
 import (
 	"os"
 	"path"
+	"syscall"
 	"testing"
 	"time"
 
@@ -263,3 +264,436 @@ func TestFuseUtimes(t *testing.T) {
 		t.Error("Incorrect atime received : ", attr.AccessTime().Round(roundFactor))
 	}
 }
+
+func TestFuseCallerPermissions(t *testing.T) {
+	setuptesting(t)
+	defer removeTestDir("pfiTestPfsDir")
+
+	pfs := &ParanoidFileSystem{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+	}
+	owner := &fuse.Context{Owner: mountOwner}
+	other := &fuse.Context{Owner: fuse.Owner{Uid: mountOwner.Uid + 1, Gid: mountOwner.Gid + 1}}
+
+	_, code := pfs.Create("private.txt", 0, uint32(os.FileMode(0600)), owner)
+	if code != fuse.OK {
+		t.Fatal("Failed to create file error : ", code)
+	}
+
+	_, code = pfs.Open("private.txt", uint32(os.O_RDWR), owner)
+	if code != fuse.OK {
+		t.Error("Owner should be able to open file error : ", code)
+	}
+	_, code = pfs.Open("private.txt", uint32(os.O_RDONLY), other)
+	if code != fuse.EACCES {
+		t.Error("Other user should not be able to open file error : ", code)
+	}
+	code = pfs.Chmod("private.txt", uint32(os.FileMode(0777)), other)
+	if code != fuse.EPERM {
+		t.Error("Other user should not be able to chmod file error : ", code)
+	}
+	code = pfs.Unlink("private.txt", other)
+	if code != fuse.EACCES {
+		t.Error("Other user should not be able to unlink file error : ", code)
+	}
+	code = pfs.Unlink("private.txt", owner)
+	if code != fuse.OK {
+		t.Error("Owner should be able to unlink file error : ", code)
+	}
+}
+
+func TestFuseStatFs(t *testing.T) {
+	setuptesting(t)
+	defer removeTestDir("pfiTestPfsDir")
+
+	pfs := &ParanoidFileSystem{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+	}
+
+	StatFsBlockSize = 0
+	out := pfs.StatFs("")
+	if out == nil {
+		t.Fatal("StatFs returned no statistics")
+	}
+	if out.Bsize == 0 || out.Blocks == 0 {
+		t.Error("Incorrect statistics : ", out)
+	}
+	native := *out
+
+	StatFsBlockSize = native.Bsize * 2
+	defer func() { StatFsBlockSize = 0 }()
+	out = pfs.StatFs("")
+	if out == nil {
+		t.Fatal("StatFs returned no statistics")
+	}
+	if out.Bsize != native.Bsize*2 {
+		t.Error("Incorrect block size. Expected: ", native.Bsize*2, " Got: ", out.Bsize)
+	}
+	if diff := int64(out.Blocks) - int64(native.Blocks/2); diff < -1 || diff > 1 {
+		t.Error("Incorrect block count. Expected about: ", native.Blocks/2, " Got: ", out.Blocks)
+	}
+}
+
+func TestFuseFsyncFlush(t *testing.T) {
+	setuptesting(t)
+	defer removeTestDir("pfiTestPfsDir")
+
+	pfs := &ParanoidFileSystem{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+	}
+
+	file, code := pfs.Create("helloworld.txt", 0, uint32(os.FileMode(0777)), nil)
+	if code != fuse.OK {
+		t.Fatal("Failed to create file error : ", code)
+	}
+
+	_, code = file.Write([]byte("TEST"), 0)
+	if code != fuse.OK {
+		t.Error("Failed to write to file error : ", code)
+	}
+	code = file.Fsync(0)
+	if code != fuse.OK {
+		t.Error("Failed to fsync file error : ", code)
+	}
+	code = file.Flush()
+	if code != fuse.OK {
+		t.Error("Failed to flush file error : ", code)
+	}
+
+	code = pfs.Unlink("helloworld.txt", nil)
+	if code != fuse.OK {
+		t.Fatal("Failed to unlink file error : ", code)
+	}
+	_, code = file.Write([]byte("TEST"), 0)
+	if code == fuse.OK {
+		t.Fatal("Write to unlinked file should fail")
+	}
+	// The error was returned by Write, so it is not reported again
+	code = file.Flush()
+	if code != fuse.OK {
+		t.Error("Flush should not report the failed write again : ", code)
+	}
+}
+
+func TestFuseXAttr(t *testing.T) {
+	setuptesting(t)
+	defer removeTestDir("pfiTestPfsDir")
+
+	pfs := &ParanoidFileSystem{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+	}
+
+	_, code := pfs.Create("helloworld.txt", 0, uint32(os.FileMode(0777)), nil)
+	if code != fuse.OK {
+		t.Fatal("Failed to create file error : ", code)
+	}
+
+	_, code = pfs.GetXAttr("helloworld.txt", "user.test", nil)
+	if code != noXAttrStatus {
+		t.Error("GetXAttr should report ENODATA error : ", code)
+	}
+	code = pfs.RemoveXAttr("helloworld.txt", "user.test", nil)
+	if code != noXAttrStatus {
+		t.Error("RemoveXAttr should report ENODATA error : ", code)
+	}
+	attributes, code := pfs.ListXAttr("helloworld.txt", nil)
+	if code != fuse.OK {
+		t.Error("ListXAttr did not return OK error : ", code)
+	}
+	if len(attributes) != 0 {
+		t.Error("ListXAttr should return no attributes : ", attributes)
+	}
+
+	code = pfs.SetXAttr("helloworld.txt", "user.test", []byte("value"), 0, nil)
+	if code != fuse.OK {
+		t.Fatal("SetXAttr did not return OK error : ", code)
+	}
+	code = pfs.SetXAttr("helloworld.txt", "user.other", []byte("other"), xattrCreate, nil)
+	if code != fuse.OK {
+		t.Fatal("SetXAttr did not return OK error : ", code)
+	}
+	value, code := pfs.GetXAttr("helloworld.txt", "user.test", nil)
+	if code != fuse.OK || string(value) != "value" {
+		t.Error("GetXAttr did not return the attribute set. Got : ", string(value), code)
+	}
+	attributes, code = pfs.ListXAttr("helloworld.txt", nil)
+	if code != fuse.OK || len(attributes) != 2 || attributes[0] != "user.other" || attributes[1] != "user.test" {
+		t.Error("ListXAttr did not return the attributes set : ", attributes, code)
+	}
+	code = pfs.SetXAttr("helloworld.txt", "user.test", []byte("again"), xattrCreate, nil)
+	if code != fuse.Status(syscall.EEXIST) {
+		t.Error("SetXAttr creating an existing attribute should report EEXIST error : ", code)
+	}
+	code = pfs.SetXAttr("helloworld.txt", "user.missing", []byte("value"), xattrReplace, nil)
+	if code != noXAttrStatus {
+		t.Error("SetXAttr replacing a missing attribute should report ENODATA error : ", code)
+	}
+
+	// Attributes are shared by hard links, and follow renames
+	code = pfs.Link("helloworld.txt", "link.txt", nil)
+	if code != fuse.OK {
+		t.Fatal("Link did not return OK error : ", code)
+	}
+	code = pfs.Rename("link.txt", "renamed.txt", nil)
+	if code != fuse.OK {
+		t.Fatal("Rename did not return OK error : ", code)
+	}
+	code = pfs.SetXAttr("renamed.txt", "user.test", []byte("changed"), xattrReplace, nil)
+	if code != fuse.OK {
+		t.Fatal("SetXAttr did not return OK error : ", code)
+	}
+	value, code = pfs.GetXAttr("helloworld.txt", "user.test", nil)
+	if code != fuse.OK || string(value) != "changed" {
+		t.Error("Attribute set through a hard link was not changed. Got : ", string(value), code)
+	}
+	code = pfs.RemoveXAttr("helloworld.txt", "user.other", nil)
+	if code != fuse.OK {
+		t.Error("RemoveXAttr did not return OK error : ", code)
+	}
+	code = pfs.Unlink("helloworld.txt", nil)
+	if code != fuse.OK {
+		t.Fatal("Unlink did not return OK error : ", code)
+	}
+	attributes, code = pfs.ListXAttr("renamed.txt", nil)
+	if code != fuse.OK || len(attributes) != 1 || attributes[0] != "user.test" {
+		t.Error("Attributes were not kept by the remaining link : ", attributes, code)
+	}
+
+	// A file created in place of a removed one has no attributes
+	code = pfs.Unlink("renamed.txt", nil)
+	if code != fuse.OK {
+		t.Fatal("Unlink did not return OK error : ", code)
+	}
+	_, code = pfs.Create("renamed.txt", 0, uint32(os.FileMode(0777)), nil)
+	if code != fuse.OK {
+		t.Fatal("Failed to create file error : ", code)
+	}
+	attributes, code = pfs.ListXAttr("renamed.txt", nil)
+	if code != fuse.OK || len(attributes) != 0 {
+		t.Error("New file has attributes : ", attributes, code)
+	}
+
+	// Attributes of the contents of a directory follow its renames
+	code = pfs.Mkdir("directory", uint32(os.FileMode(0777)), nil)
+	if code != fuse.OK {
+		t.Fatal("Failed to create directory error : ", code)
+	}
+	_, code = pfs.Create("directory/file.txt", 0, uint32(os.FileMode(0777)), nil)
+	if code != fuse.OK {
+		t.Fatal("Failed to create file error : ", code)
+	}
+	code = pfs.SetXAttr("directory/file.txt", "user.test", []byte("value"), 0, nil)
+	if code != fuse.OK {
+		t.Fatal("SetXAttr did not return OK error : ", code)
+	}
+	code = pfs.Rename("directory", "moved", nil)
+	if code != fuse.OK {
+		t.Fatal("Rename did not return OK error : ", code)
+	}
+	value, code = pfs.GetXAttr("moved/file.txt", "user.test", nil)
+	if code != fuse.OK || string(value) != "value" {
+		t.Error("Attribute did not follow the directory it is in. Got : ", string(value), code)
+	}
+
+	// The records are hidden
+	dirEntries, code := pfs.OpenDir("", nil)
+	if code != fuse.OK {
+		t.Fatal("Could not open directory, error : ", code)
+	}
+	for _, entry := range dirEntries {
+		if entry.Name == metaDir {
+			t.Error("Metadata records are listed")
+		}
+	}
+	_, code = pfs.GetAttr(metaDir, nil)
+	if code != fuse.ENOENT {
+		t.Error("GetAttr of the metadata records should report ENOENT error : ", code)
+	}
+	code = pfs.Rmdir(metaDir, nil)
+	if code != fuse.EPERM {
+		t.Error("Rmdir of the metadata records should report EPERM error : ", code)
+	}
+
+	_, code = pfs.GetXAttr("missing.txt", "user.test", nil)
+	if code != fuse.ENOENT {
+		t.Error("GetXAttr on a missing file should report ENOENT error : ", code)
+	}
+	code = pfs.RemoveXAttr("missing.txt", "user.test", nil)
+	if code != fuse.ENOENT {
+		t.Error("RemoveXAttr on a missing file should report ENOENT error : ", code)
+	}
+	_, code = pfs.ListXAttr("missing.txt", nil)
+	if code != fuse.ENOENT {
+		t.Error("ListXAttr on a missing file should report ENOENT error : ", code)
+	}
+	code = pfs.SetXAttr("missing.txt", "user.test", []byte("value"), 0, nil)
+	if code != fuse.ENOENT {
+		t.Error("SetXAttr on a missing file should report ENOENT error : ", code)
+	}
+}
+
+func TestFuseOwnership(t *testing.T) {
+	setuptesting(t)
+	defer removeTestDir("pfiTestPfsDir")
+
+	pfs := &ParanoidFileSystem{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+	}
+	root := &fuse.Context{Owner: fuse.Owner{Uid: 0, Gid: 0}}
+	otherOwner := fuse.Owner{Uid: mountOwner.Uid + 1, Gid: mountOwner.Gid + 1}
+	other := &fuse.Context{Owner: otherOwner}
+
+	file, code := pfs.Create("helloworld.txt", 0, uint32(os.FileMode(0600)), nil)
+	if code != fuse.OK {
+		t.Fatal("Failed to create file error : ", code)
+	}
+	_, code = file.Write(make([]byte, statBlockSize+1), 0)
+	if code != fuse.OK {
+		t.Fatal("Failed to write to file error : ", code)
+	}
+	code = pfs.Mkdir("directory", uint32(os.FileMode(0777)), nil)
+	if code != fuse.OK {
+		t.Fatal("Failed to create directory error : ", code)
+	}
+	code = pfs.Mkdir("directory/subdirectory", uint32(os.FileMode(0777)), nil)
+	if code != fuse.OK {
+		t.Fatal("Failed to create directory error : ", code)
+	}
+
+	attr, code := pfs.GetAttr("helloworld.txt", nil)
+	if code != fuse.OK {
+		t.Fatal("Failed to stat file error : ", code)
+	}
+	if attr.Owner != mountOwner {
+		t.Error("Incorrect owner. Expected: ", mountOwner, " Got: ", attr.Owner)
+	}
+	if attr.Nlink != 1 {
+		t.Error("Incorrect link count for file. Expected: 1 Got: ", attr.Nlink)
+	}
+	if attr.Blocks != 2 {
+		t.Error("Incorrect block count. Expected: 2 Got: ", attr.Blocks)
+	}
+
+	// Hard links are counted, and reported as the same inode
+	code = pfs.Link("helloworld.txt", "link.txt", nil)
+	if code != fuse.OK {
+		t.Fatal("Link did not return OK error : ", code)
+	}
+	attr, code = pfs.GetAttr("helloworld.txt", nil)
+	if code != fuse.OK {
+		t.Fatal("Failed to stat file error : ", code)
+	}
+	linkAttr, code := pfs.GetAttr("link.txt", nil)
+	if code != fuse.OK {
+		t.Fatal("Failed to stat link error : ", code)
+	}
+	if attr.Nlink != 2 || linkAttr.Nlink != 2 {
+		t.Error("Incorrect link counts. Expected: 2 Got: ", attr.Nlink, linkAttr.Nlink)
+	}
+	if attr.Ino == 0 || attr.Ino != linkAttr.Ino {
+		t.Error("Hard links have different inode numbers : ", attr.Ino, linkAttr.Ino)
+	}
+	code = pfs.Unlink("link.txt", nil)
+	if code != fuse.OK {
+		t.Fatal("Unlink did not return OK error : ", code)
+	}
+	attr, code = pfs.GetAttr("helloworld.txt", nil)
+	if code != fuse.OK || attr.Nlink != 1 {
+		t.Error("Incorrect link count after unlink. Expected: 1 Got: ", attr.Nlink, code)
+	}
+
+	// Directories are linked from their parent and their subdirectories
+	attr, code = pfs.GetAttr("directory", nil)
+	if code != fuse.OK {
+		t.Fatal("Failed to stat directory error : ", code)
+	}
+	if attr.Owner != mountOwner {
+		t.Error("Incorrect owner. Expected: ", mountOwner, " Got: ", attr.Owner)
+	}
+	if attr.Nlink != 3 {
+		t.Error("Incorrect link count for directory. Expected: 3 Got: ", attr.Nlink)
+	}
+	attr, code = pfs.GetAttr("", nil)
+	if code != fuse.OK {
+		t.Fatal("Failed to stat root error : ", code)
+	}
+	if attr.Owner != mountOwner || attr.Nlink != 3 {
+		t.Error("Incorrect root attributes : ", attr)
+	}
+
+	// Files belong to the user who created them
+	_, code = pfs.Create("directory/theirs.txt", 0, uint32(os.FileMode(0600)), other)
+	if code != fuse.OK {
+		t.Fatal("Failed to create file error : ", code)
+	}
+	attr, code = pfs.GetAttr("directory/theirs.txt", nil)
+	if code != fuse.OK || attr.Owner != otherOwner {
+		t.Error("Incorrect owner. Expected: ", otherOwner, " Got: ", attr.Owner, code)
+	}
+	_, code = pfs.Open("directory/theirs.txt", uint32(os.O_RDWR), other)
+	if code != fuse.OK {
+		t.Error("Creator should be able to open file error : ", code)
+	}
+	code = pfs.Chmod("directory/theirs.txt", uint32(os.FileMode(0640)), other)
+	if code != fuse.OK {
+		t.Error("Creator should be able to chmod file error : ", code)
+	}
+
+	// Only root gives files away, and owners only change the group to theirs
+	code = pfs.Chown("directory/theirs.txt", mountOwner.Uid, ^uint32(0), other)
+	if code != fuse.EPERM {
+		t.Error("Chown to another user should fail with EPERM error : ", code)
+	}
+	code = pfs.Chown("directory/theirs.txt", ^uint32(0), otherOwner.Gid+1, other)
+	if code != fuse.EPERM {
+		t.Error("Chown to a group the owner is not in should fail with EPERM error : ", code)
+	}
+	code = pfs.Chown("directory/theirs.txt", otherOwner.Uid, otherOwner.Gid, other)
+	if code != fuse.OK {
+		t.Error("Chown to the current owner should succeed error : ", code)
+	}
+	code = pfs.Chown("helloworld.txt", ^uint32(0), otherOwner.Gid, other)
+	if code != fuse.EPERM {
+		t.Error("Chown of a file of another user should fail with EPERM error : ", code)
+	}
+	_, code = pfs.Open("helloworld.txt", uint32(os.O_RDONLY), other)
+	if code != fuse.EACCES {
+		t.Error("Other user should not be able to open file error : ", code)
+	}
+	code = pfs.Chown("helloworld.txt", otherOwner.Uid, ^uint32(0), root)
+	if code != fuse.OK {
+		t.Fatal("Root should be able to chown file error : ", code)
+	}
+	attr, code = pfs.GetAttr("helloworld.txt", nil)
+	expected := fuse.Owner{Uid: otherOwner.Uid, Gid: mountOwner.Gid}
+	if code != fuse.OK || attr.Owner != expected {
+		t.Error("Incorrect owner after chown. Expected: ", expected, " Got: ", attr.Owner, code)
+	}
+	_, code = pfs.Open("helloworld.txt", uint32(os.O_RDWR), other)
+	if code != fuse.OK {
+		t.Error("New owner should be able to open file error : ", code)
+	}
+
+	// The owner follows renames, and is not inherited by a new file
+	code = pfs.Rename("helloworld.txt", "directory/renamed.txt", nil)
+	if code != fuse.OK {
+		t.Fatal("Rename did not return OK error : ", code)
+	}
+	attr, code = pfs.GetAttr("directory/renamed.txt", nil)
+	if code != fuse.OK || attr.Owner != expected {
+		t.Error("Owner did not follow rename. Expected: ", expected, " Got: ", attr.Owner, code)
+	}
+	_, code = pfs.Create("helloworld.txt", 0, uint32(os.FileMode(0600)), nil)
+	if code != fuse.OK {
+		t.Fatal("Failed to create file error : ", code)
+	}
+	attr, code = pfs.GetAttr("helloworld.txt", nil)
+	if code != fuse.OK || attr.Owner != mountOwner {
+		t.Error("Incorrect owner of new file. Expected: ", mountOwner, " Got: ", attr.Owner, code)
+	}
+
+	code = pfs.Chown("missing.txt", mountOwner.Uid, mountOwner.Gid, nil)
+	if code != fuse.ENOENT {
+		t.Error("Chown of a missing file should fail with ENOENT error : ", code)
+	}
+}
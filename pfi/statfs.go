@@ -0,0 +1,55 @@
+package pfi
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/pp2p/pfsd/globals"
+)
+
+// StatFsBlockSize is the block size reported by StatFs. Zero reports the block
+// size of the filesystem holding the paranoid directory.
+var StatFsBlockSize uint32
+
+// fsStats holds the statistics of the filesystem holding the paranoid
+// directory. Block counts are in units of unit bytes.
+type fsStats struct {
+	blocks  uint64
+	bfree   uint64
+	bavail  uint64
+	files   uint64
+	ffree   uint64
+	unit    uint64
+	nameLen uint32
+}
+
+// StatFs is called to get the size and free space of the filesystem (df).
+// Everything is stored in the paranoid directory, so its filesystem is
+// reported.
+func (fs *ParanoidFileSystem) StatFs(name string) *fuse.StatfsOut {
+	Log.Info("StatFs called on : " + name)
+	stats, err := statDir(globals.ParanoidDir)
+	if err != nil {
+		Log.Error("Error running statfs :", err)
+		return nil
+	}
+	return statfsOut(stats, StatFsBlockSize)
+}
+
+// statfsOut converts the statistics of the backing filesystem to the given
+// block size.
+func statfsOut(stats fsStats, blockSize uint32) *fuse.StatfsOut {
+	if blockSize == 0 {
+		blockSize = uint32(stats.unit)
+	}
+	size := uint64(blockSize)
+	return &fuse.StatfsOut{
+		Blocks:  stats.blocks * stats.unit / size,
+		Bfree:   stats.bfree * stats.unit / size,
+		Bavail:  stats.bavail * stats.unit / size,
+		Files:   stats.files,
+		Ffree:   stats.ffree,
+		Bsize:   blockSize,
+		Frsize:  blockSize,
+		NameLen: stats.nameLen,
+	}
+}
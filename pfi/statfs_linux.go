@@ -0,0 +1,25 @@
+package pfi
+
+import "syscall"
+
+// statDir returns the statistics of the filesystem holding dir.
+func statDir(dir string) (fsStats, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return fsStats{}, err
+	}
+	// Block counts are in units of the fragment size
+	unit := uint64(st.Frsize)
+	if unit == 0 {
+		unit = uint64(st.Bsize)
+	}
+	return fsStats{
+		blocks:  st.Blocks,
+		bfree:   st.Bfree,
+		bavail:  st.Bavail,
+		files:   st.Files,
+		ffree:   st.Ffree,
+		unit:    unit,
+		nameLen: uint32(st.Namelen),
+	}, nil
+}
@@ -0,0 +1,27 @@
+// +build !linux
+
+package pfi
+
+import "syscall"
+
+// maxNameLen is reported as the longest file name, as statfs(2) does not
+// report one here.
+const maxNameLen = 255
+
+// statDir returns the statistics of the filesystem holding dir. There is no
+// fragment size here, so block counts are in units of the block size.
+func statDir(dir string) (fsStats, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return fsStats{}, err
+	}
+	return fsStats{
+		blocks:  uint64(st.Blocks),
+		bfree:   uint64(st.Bfree),
+		bavail:  uint64(st.Bavail),
+		files:   uint64(st.Files),
+		ffree:   uint64(st.Ffree),
+		unit:    uint64(st.Bsize),
+		nameLen: maxNameLen,
+	}, nil
+}
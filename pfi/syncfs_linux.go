@@ -0,0 +1,23 @@
+// +build amd64 arm64 386 arm
+
+package pfi
+
+import (
+	"os"
+	"syscall"
+)
+
+// syncFilesystem flushes the filesystem holding dir to disk, without syncing
+// every other mounted filesystem as sync(2) would.
+func syncFilesystem(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, _, errno := syscall.Syscall(sysSyncfs, file.Fd(), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
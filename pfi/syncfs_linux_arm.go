@@ -0,0 +1,4 @@
+package pfi
+
+// The syscall package does not define SYS_SYNCFS
+const sysSyncfs = 373
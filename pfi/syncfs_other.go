@@ -0,0 +1,12 @@
+// +build !linux linux,!amd64,!arm64,!386,!arm
+
+package pfi
+
+import "syscall"
+
+// syncFilesystem flushes every filesystem to disk, as syncfs(2) is not
+// available here.
+func syncFilesystem(dir string) error {
+	syscall.Sync()
+	return nil
+}
@@ -14,8 +14,16 @@ var (
 	// or locally
 	SendOverNetwork bool
 
+	// AllowOther lets users other than the one running pfsd use the mount.
+	// Their access is checked against the owner and mode of each file.
+	AllowOther bool
+
 	// Log used for pfi
 	Log *logger.ParanoidLogger
+
+	// lockedStatus is returned while an encrypted filesystem is locked, as
+	// its contents can not be used until the key has been rebuilt.
+	lockedStatus = fuse.Status(syscall.EAGAIN)
 )
 
 // GetFuseReturnCode from the internal return code
@@ -0,0 +1,149 @@
+package pfi
+
+import (
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/pp2p/pfsd/globals"
+)
+
+// Extended attributes are kept in the inode record of a file, see
+// metadata.go, so they are shared by its hard links and replicated with it.
+const (
+	// Limits of Linux, which other filesystems are expected to copy
+	// attributes to
+	xattrNameMax = 255
+	xattrSizeMax = 65536
+
+	// Flags of setxattr(2)
+	xattrCreate  = 1
+	xattrReplace = 2
+)
+
+var noXAttrStatus = fuse.Status(syscall.ENODATA)
+
+// GetXAttr is called to read an extended attribute of a file
+func (fs *ParanoidFileSystem) GetXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	Log.Info("GetXAttr called on : " + name)
+	if !globals.BeginOperation() {
+		return nil, lockedStatus
+	}
+	defer globals.EndOperation()
+	if _, code := fileMode(name); code != fuse.OK {
+		return nil, code
+	}
+	if code := newPermissionCheck(context).permission(name, permRead); code != fuse.OK {
+		return nil, code
+	}
+	_, inode, code := loadInode(name)
+	if code != fuse.OK {
+		return nil, code
+	}
+	if inode == nil {
+		return nil, noXAttrStatus
+	}
+	value, ok := inode.XAttrs[attribute]
+	if !ok {
+		return nil, noXAttrStatus
+	}
+	return value, fuse.OK
+}
+
+// ListXAttr is called to list the extended attributes of a file
+func (fs *ParanoidFileSystem) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	Log.Info("ListXAttr called on : " + name)
+	if !globals.BeginOperation() {
+		return nil, lockedStatus
+	}
+	defer globals.EndOperation()
+	if _, code := fileMode(name); code != fuse.OK {
+		return nil, code
+	}
+	if code := newPermissionCheck(context).permission(name, permRead); code != fuse.OK {
+		return nil, code
+	}
+	_, inode, code := loadInode(name)
+	if code != fuse.OK {
+		return nil, code
+	}
+	attributes := []string{}
+	if inode != nil {
+		for attribute := range inode.XAttrs {
+			attributes = append(attributes, attribute)
+		}
+	}
+	sort.Strings(attributes)
+	return attributes, fuse.OK
+}
+
+// SetXAttr is called to set an extended attribute of a file
+func (fs *ParanoidFileSystem) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	Log.Info("SetXAttr called on : " + name)
+	if attr == "" || len(attr) > xattrNameMax {
+		return fuse.Status(syscall.ERANGE)
+	}
+	if len(data) > xattrSizeMax {
+		return fuse.Status(syscall.E2BIG)
+	}
+	if !globals.BeginOperation() {
+		return lockedStatus
+	}
+	defer globals.EndOperation()
+	if _, code := fileMode(name); code != fuse.OK {
+		return code
+	}
+	if code := newPermissionCheck(context).permission(name, permWrite); code != fuse.OK {
+		return code
+	}
+
+	metaLock.Lock()
+	defer metaLock.Unlock()
+	id, inode, code := inodeOf(name)
+	if code != fuse.OK {
+		return code
+	}
+	_, exists := inode.XAttrs[attr]
+	if flags&xattrCreate != 0 && exists {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if flags&xattrReplace != 0 && !exists {
+		return noXAttrStatus
+	}
+	if inode.XAttrs == nil {
+		inode.XAttrs = make(map[string][]byte)
+	}
+	inode.XAttrs[attr] = append([]byte{}, data...)
+	return saveInode(id, inode)
+}
+
+// RemoveXAttr is called to remove an extended attribute of a file
+func (fs *ParanoidFileSystem) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	Log.Info("RemoveXAttr called on : " + name)
+	if !globals.BeginOperation() {
+		return lockedStatus
+	}
+	defer globals.EndOperation()
+	if _, code := fileMode(name); code != fuse.OK {
+		return code
+	}
+	if code := newPermissionCheck(context).permission(name, permWrite); code != fuse.OK {
+		return code
+	}
+
+	metaLock.Lock()
+	defer metaLock.Unlock()
+	id, inode, code := loadInode(name)
+	if code != fuse.OK {
+		return code
+	}
+	if inode == nil {
+		return noXAttrStatus
+	}
+	if _, ok := inode.XAttrs[attr]; !ok {
+		return noXAttrStatus
+	}
+	delete(inode.XAttrs, attr)
+	return saveInode(id, inode)
+}
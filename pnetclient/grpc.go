@@ -1,7 +1,6 @@
 package pnetclient
 
 import (
-	"crypto/tls"
 	"time"
 
 	"google.golang.org/grpc"
@@ -19,10 +18,7 @@ func Dial(node globals.Node) (*grpc.ClientConn, error) {
 	var opts []grpc.DialOption
 	opts = append(opts, grpc.WithTimeout(5*time.Second))
 	if globals.TLSEnabled {
-		creds := credentials.NewTLS(&tls.Config{
-			ServerName:         node.CommonName,
-			InsecureSkipVerify: globals.TLSSkipVerify,
-		})
+		creds := credentials.NewTLS(globals.Certificates.PeerConfig(node.CommonName, globals.TLSSkipVerify))
 		opts = append(opts, grpc.WithTransportCredentials(creds))
 	} else {
 		opts = append(opts, grpc.WithInsecure())
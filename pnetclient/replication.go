@@ -0,0 +1,630 @@
+package pnetclient
+
+import (
+	"crypto/rand"
+	"flag"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pp2p/pfsd/globals"
+	"github.com/pp2p/pfsd/keyman"
+)
+
+// The key of this node is split once for every generation it is part of, and
+// each piece is sent to its holder with an exponential backoff per holder.
+// The piece kept by this node is only replaced by the one of a new split once
+// enough holders have their piece of the new split to unlock with it, so that
+// the key can be rebuilt while the new pieces are being delivered.
+//
+// A holder which has lost its piece is given a new piece of the same split,
+// computed from the pieces of the other holders. A holder which has been
+// unreachable for holderReplaceAfter is replaced by a node outside the
+// generation, and the key is split again so that its piece becomes useless.
+const (
+	replicationInterval   time.Duration = time.Second * 10
+	minReplicationBackoff time.Duration = time.Second * 5
+	maxReplicationBackoff time.Duration = time.Minute * 10
+	holderReplaceAfter    time.Duration = time.Hour
+)
+
+// Holders prove that they hold their piece without sending it. Only holders
+// of pieces made before pieces had commitments, or running a pfsd without the
+// VerifyKeyPiece RPC, are asked to send the whole piece back.
+var holderVerifyInterval = flag.Duration("key_piece_verify_interval", time.Hour,
+	"interval at which holders are asked to prove they hold the key pieces of this node. "+
+		"0 disables verification")
+
+// The RPCs used to replicate pieces, which tests replace
+var (
+	sendKeyPiece    = SendKeyPiece
+	requestKeyPiece = RequestKeyPiece
+	verifyKeyPiece  = VerifyKeyPiece
+)
+
+// HolderStatus describes a node holding a key piece of this node
+type HolderStatus struct {
+	UUID string
+	// Substitute holders are not members of the generation
+	Substitute   bool
+	Delivered    bool
+	VerifiedAt   time.Time
+	Failures     int
+	FailingSince time.Time
+	NextAttempt  time.Time
+}
+
+// GenerationStatus describes how well the key pieces of this node are
+// replicated in a generation
+type GenerationStatus struct {
+	Generation int64
+	Threshold  int64
+	// Pieces held by this node or by a holder which is not failing
+	Available       int64
+	UnderReplicated bool
+	Holders         []HolderStatus
+}
+
+// ReplicationStatus describes the replication of the key pieces of this node
+type ReplicationStatus struct {
+	Generations     []GenerationStatus
+	UnderReplicated int
+	SendFailures    uint64
+	VerifyFailures  uint64
+	Redistributions uint64
+}
+
+type holderState struct {
+	// The piece sent to the holder. Nil if the key was split before pfsd was
+	// started, in which case the piece can not be sent again.
+	piece        *keyman.KeyPiece
+	substitute   bool
+	delivered    bool
+	verifiedAt   time.Time
+	failures     int
+	failingSince time.Time
+	nextAttempt  time.Time
+}
+
+type generationState struct {
+	threshold int64
+	holders   map[string]*holderState
+	// The piece this node keeps of a split which is still being delivered
+	pending         *keyman.KeyPiece
+	complete        bool
+	underReplicated bool
+	noSubstitute    bool
+}
+
+type replicator struct {
+	lock        sync.Mutex
+	generations map[int64]*generationState
+	// runLock is held while replicating, and while replication is paused
+	runLock sync.Mutex
+
+	sendFailures    uint64
+	verifyFailures  uint64
+	redistributions uint64
+}
+
+var replication = &replicator{generations: make(map[int64]*generationState)}
+
+// GetReplicationStatus returns the state of the replication of the key pieces
+// of this node.
+func GetReplicationStatus() ReplicationStatus {
+	return replication.status()
+}
+
+func (r *replicator) status() ReplicationStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	status := ReplicationStatus{
+		SendFailures:    r.sendFailures,
+		VerifyFailures:  r.verifyFailures,
+		Redistributions: r.redistributions,
+	}
+	for g, gen := range r.generations {
+		genStatus := GenerationStatus{
+			Generation: g,
+			Threshold:  gen.threshold,
+			Available:  gen.available(),
+		}
+		genStatus.UnderReplicated = genStatus.Available < gen.threshold
+		if genStatus.UnderReplicated {
+			status.UnderReplicated++
+		}
+		for uuid, h := range gen.holders {
+			genStatus.Holders = append(genStatus.Holders, HolderStatus{
+				UUID:         uuid,
+				Substitute:   h.substitute,
+				Delivered:    h.delivered,
+				VerifiedAt:   h.verifiedAt,
+				Failures:     h.failures,
+				FailingSince: h.failingSince,
+				NextAttempt:  h.nextAttempt,
+			})
+		}
+		sort.Slice(genStatus.Holders, func(i, j int) bool {
+			return genStatus.Holders[i].UUID < genStatus.Holders[j].UUID
+		})
+		status.Generations = append(status.Generations, genStatus)
+	}
+	sort.Slice(status.Generations, func(i, j int) bool {
+		return status.Generations[i].Generation < status.Generations[j].Generation
+	})
+	return status
+}
+
+// available counts the pieces which could currently be used to unlock,
+// including the piece kept by this node.
+func (gen *generationState) available() int64 {
+	count := int64(1)
+	for _, h := range gen.holders {
+		if h.delivered && h.failingSince.IsZero() {
+			count++
+		}
+	}
+	return count
+}
+
+func (gen *generationState) sortedHolders() []string {
+	var uuids []string
+	for uuid := range gen.holders {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	return uuids
+}
+
+func backoff(failures int) time.Duration {
+	delay := minReplicationBackoff
+	for i := 1; i < failures && delay < maxReplicationBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxReplicationBackoff {
+		delay = maxReplicationBackoff
+	}
+	return delay
+}
+
+func (r *replicator) recordSuccess(h *holderState, verified bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	h.delivered = true
+	if verified {
+		h.verifiedAt = time.Now()
+	}
+	h.failures = 0
+	h.failingSince = time.Time{}
+	h.nextAttempt = time.Time{}
+}
+
+func (r *replicator) recordFailure(h *holderState, counter *uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	*counter++
+	h.failures++
+	if h.failingSince.IsZero() {
+		h.failingSince = time.Now()
+	}
+	h.nextAttempt = time.Now().Add(backoff(h.failures))
+}
+
+// PauseReplication waits for replication in progress to finish and stops it
+// until ResumeReplication is called, so that raft can be stopped.
+func PauseReplication() {
+	replication.runLock.Lock()
+}
+
+// ResumeReplication resumes replication paused by PauseReplication
+func ResumeReplication() {
+	replication.runLock.Unlock()
+}
+
+// run does everything which is due for the generations this node is part of.
+func (r *replicator) run(ksm *keyman.KeyStateMachine) {
+	r.runLock.Lock()
+	defer r.runLock.Unlock()
+	current := ksm.GetCurrentGeneration()
+	if current == -1 {
+		return
+	}
+	r.lock.Lock()
+	for g := range r.generations {
+		if g < current {
+			delete(r.generations, g)
+		}
+	}
+	r.lock.Unlock()
+	for _, held := range globals.HeldKeyPieces.ListPieces() {
+		if held.Generation >= current {
+			break
+		}
+		err := globals.HeldKeyPieces.DeleteGeneration(held.Generation)
+		if err != nil {
+			Log.Error("Unable to delete generation:", err)
+		}
+	}
+
+	for g := current; g <= ksm.GetInProgressGenertion(); g++ {
+		gen := r.track(ksm, g)
+		if gen == nil {
+			continue
+		}
+		r.replaceHolders(gen, g)
+		r.split(ksm, gen, g)
+		r.deliver(ksm, gen, g)
+		r.verify(gen, g)
+
+		r.lock.Lock()
+		available := gen.available()
+		if available < gen.threshold && !gen.underReplicated {
+			Log.Warnf("Generation %d is under-replicated: %d of %d required pieces available",
+				g, available, gen.threshold)
+		} else if available >= gen.threshold && gen.underReplicated {
+			Log.Infof("Generation %d is fully replicated again", g)
+		}
+		gen.underReplicated = available < gen.threshold
+		r.lock.Unlock()
+	}
+}
+
+// track returns the state of a generation which this node is a member of,
+// creating it from the key state machine if needed.
+func (r *replicator) track(ksm *keyman.KeyStateMachine, g int64) *generationState {
+	nodes, err := ksm.GetNodes(g)
+	r.lock.Lock()
+	gen, ok := r.generations[g]
+	if err != nil {
+		// The generation was aborted
+		delete(r.generations, g)
+	}
+	r.lock.Unlock()
+	if err != nil {
+		return nil
+	}
+	if ok {
+		return gen
+	}
+
+	member := false
+	for _, v := range nodes {
+		if v == globals.ThisNode.UUID {
+			member = true
+			break
+		}
+	}
+	if !member {
+		return nil
+	}
+	threshold, err := ksm.GetThreshold(g)
+	if err != nil {
+		Log.Warn("Unable to get threshold for generation", g, ":", err)
+		return nil
+	}
+	substitutes, err := ksm.GetHolders(g, globals.ThisNode.UUID)
+	if err != nil {
+		Log.Warn("Unable to get holders for generation", g, ":", err)
+		return nil
+	}
+
+	// Pieces sent before pfsd was started are assumed to have been delivered
+	// if the generation was completed, until they fail verification.
+	delivered := !ksm.NeedsReplication(globals.ThisNode.UUID, g)
+	gen = &generationState{
+		threshold: threshold,
+		holders:   make(map[string]*holderState),
+		complete:  delivered,
+	}
+	for _, v := range nodes {
+		if v != globals.ThisNode.UUID {
+			gen.holders[v] = &holderState{delivered: delivered}
+		}
+	}
+	for _, v := range substitutes {
+		if _, ok := gen.holders[v]; !ok {
+			gen.holders[v] = &holderState{substitute: true, delivered: delivered}
+		}
+	}
+
+	r.lock.Lock()
+	r.generations[g] = gen
+	r.lock.Unlock()
+	return gen
+}
+
+// split gives a piece to every holder of a generation which needs a piece that
+// is not known. Pieces are computed from the current split where possible,
+// and the key is only split again when that is not possible.
+func (r *replicator) split(ksm *keyman.KeyStateMachine, gen *generationState, g int64) {
+	ownPiece := globals.HeldKeyPieces.GetPiece(g, globals.ThisNode.UUID)
+	r.lock.Lock()
+	pending := gen.pending != nil
+	needed := ksm.NeedsReplication(globals.ThisNode.UUID, g) && ownPiece == nil && !pending
+	var missing []string
+	for _, uuid := range gen.sortedHolders() {
+		h := gen.holders[uuid]
+		if !h.delivered && h.piece == nil {
+			missing = append(missing, uuid)
+		}
+	}
+	r.lock.Unlock()
+	if !needed && len(missing) == 0 {
+		return
+	}
+	key := globals.GetEncryptionKey()
+	if key == nil {
+		Log.Verbosef("Unable to distribute key pieces of generation %d while locked", g)
+		return
+	}
+	if !needed && !pending && ownPiece != nil && r.extend(gen, g, ownPiece, missing) {
+		return
+	}
+
+	uuids := gen.sortedHolders()
+	Log.Info("Generating pieces.")
+	pieces, err := keyman.GeneratePieces(key, int64(len(uuids)+1), gen.threshold)
+	if err != nil {
+		Log.Error("Could not chunk key:", err)
+		return
+	}
+
+	// We always keep the first piece and distribute the rest. The first piece
+	// is stored once enough of the rest have been delivered.
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	gen.pending = pieces[0]
+	for i, uuid := range uuids {
+		h := gen.holders[uuid]
+		h.piece = pieces[i+1]
+		h.delivered = false
+		h.nextAttempt = time.Time{}
+	}
+}
+
+// extend computes new pieces of the current split for the missing holders,
+// from the piece kept by this node and the pieces of other holders. Pieces
+// which are not known are fetched from their holders. It returns false if not
+// enough pieces could be found.
+func (r *replicator) extend(gen *generationState, g int64, ownPiece *keyman.KeyPiece, missing []string) bool {
+	known := []*keyman.KeyPiece{ownPiece}
+	for _, uuid := range gen.sortedHolders() {
+		if int64(len(known)) >= gen.threshold {
+			break
+		}
+		h := gen.holders[uuid]
+		if !h.delivered {
+			continue
+		}
+		if h.piece == nil {
+			piece, err := requestKeyPiece(uuid, g)
+			if err != nil {
+				Log.Warnf("Unable to get key piece held by %s: %s", uuid, err)
+				continue
+			}
+			if err := keyman.VerifyPieceFrom(piece, ownPiece); err != nil {
+				Log.Warnf("Node %s does not hold a valid key piece of generation %d: %s", uuid, g, err)
+				continue
+			}
+			r.lock.Lock()
+			h.piece = piece
+			r.lock.Unlock()
+		}
+		known = append(known, h.piece)
+	}
+	if int64(len(known)) < gen.threshold {
+		return false
+	}
+
+	for _, uuid := range missing {
+		// Sequence numbers are random so that they do not collide with
+		// those of pieces which are not known.
+		seq, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+		if err != nil {
+			Log.Error("Could not generate piece sequence number:", err)
+			return false
+		}
+		piece, err := keyman.ExtendPieces(known[:gen.threshold], seq.Int64()+1<<32)
+		if err != nil {
+			Log.Warnf("Unable to compute key piece for %s: %s", uuid, err)
+			return false
+		}
+		r.lock.Lock()
+		h := gen.holders[uuid]
+		h.piece = piece
+		h.delivered = false
+		h.nextAttempt = time.Time{}
+		r.lock.Unlock()
+	}
+	return true
+}
+
+// deliver sends pieces which have not been delivered to holders whose backoff
+// has expired, and marks this node complete once enough pieces are held.
+func (r *replicator) deliver(ksm *keyman.KeyStateMachine, gen *generationState, g int64) {
+	for _, uuid := range gen.sortedHolders() {
+		h := gen.holders[uuid]
+		if h.delivered || h.piece == nil || time.Now().Before(h.nextAttempt) {
+			continue
+		}
+		// Substitute holders are recorded in the key state machine, so that
+		// they are asked for the piece when unlocking.
+		addElement := false
+		if h.substitute {
+			addElement = true
+			holders, err := ksm.GetHolders(g, globals.ThisNode.UUID)
+			if err == nil {
+				for _, v := range holders {
+					if v == uuid {
+						addElement = false
+					}
+				}
+			}
+		}
+		err := sendKeyPiece(uuid, g, h.piece, addElement)
+		if err != nil {
+			Log.Errorf("Error sending key piece to %s, retrying in %s: %s", uuid, backoff(h.failures+1), err)
+			r.recordFailure(h, &r.sendFailures)
+			continue
+		}
+		r.recordSuccess(h, true)
+	}
+
+	r.lock.Lock()
+	pending := gen.pending
+	if pending != nil && gen.available() < gen.threshold {
+		pending = nil
+	}
+	r.lock.Unlock()
+	if pending != nil {
+		err := globals.HeldKeyPieces.AddPiece(g, globals.ThisNode.UUID, pending)
+		if err != nil {
+			Log.Error("Could not store own key piece:", err)
+			return
+		}
+		r.lock.Lock()
+		if gen.pending == pending {
+			gen.pending = nil
+		}
+		r.lock.Unlock()
+	}
+
+	r.lock.Lock()
+	complete := gen.complete || gen.pending != nil || gen.available() < gen.threshold
+	r.lock.Unlock()
+	if complete || !ksm.NeedsReplication(globals.ThisNode.UUID, g) {
+		return
+	}
+	err := globals.RaftNetworkServer.RequestOwnerComplete(globals.ThisNode.UUID, g)
+	if err != nil {
+		Log.Error("Error marking generation complete:", err)
+		return
+	}
+	Log.Info("Successfully completed generation", g)
+	r.lock.Lock()
+	gen.complete = true
+	r.lock.Unlock()
+}
+
+// verify asks holders whose piece has not been checked recently to prove they
+// hold it, checking the proof against the piece kept by this node.
+func (r *replicator) verify(gen *generationState, g int64) {
+	if *holderVerifyInterval <= 0 {
+		return
+	}
+	ownPiece := globals.HeldKeyPieces.GetPiece(g, globals.ThisNode.UUID)
+	r.lock.Lock()
+	pending := gen.pending != nil
+	r.lock.Unlock()
+	if ownPiece == nil || pending {
+		return
+	}
+	for _, uuid := range gen.sortedHolders() {
+		h := gen.holders[uuid]
+		if !h.delivered || time.Since(h.verifiedAt) < *holderVerifyInterval ||
+			time.Now().Before(h.nextAttempt) {
+			continue
+		}
+		invalid, err := r.checkHolder(h, uuid, g, ownPiece)
+		if err != nil {
+			Log.Warnf("Unable to verify key piece held by %s: %s", uuid, err)
+			r.recordFailure(h, &r.verifyFailures)
+			continue
+		}
+		if invalid == nil {
+			r.recordSuccess(h, true)
+			continue
+		}
+
+		// The holder is reachable but does not have a valid piece. It gets the
+		// piece again, or a new piece of the split if the piece is not known.
+		Log.Warnf("Node %s does not hold a valid key piece of generation %d: %s", uuid, g, invalid)
+		r.lock.Lock()
+		r.verifyFailures++
+		h.delivered = false
+		h.failures = 0
+		h.failingSince = time.Time{}
+		h.nextAttempt = time.Time{}
+		if h.piece == nil {
+			r.redistributions++
+		}
+		r.lock.Unlock()
+	}
+}
+
+// checkHolder checks the piece of a holder. The holder is asked to prove it
+// holds the piece, or to send it if that can not be proven. invalid is the
+// reason the holder does not have a valid piece, and err the reason it could
+// not be asked.
+func (r *replicator) checkHolder(h *holderState, uuid string, g int64, ownPiece *keyman.KeyPiece) (invalid, err error) {
+	err = verifyKeyPiece(uuid, g, ownPiece)
+	switch err {
+	case nil:
+		return nil, nil
+	case ErrPieceNotFound, keyman.ErrInvalidProof:
+		return err, nil
+	case ErrPieceNotProvable:
+	default:
+		return nil, err
+	}
+
+	piece, err := requestKeyPiece(uuid, g)
+	if err == ErrPieceNotFound {
+		return err, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := keyman.VerifyPieceFrom(piece, ownPiece); err != nil {
+		return err, nil
+	}
+	r.lock.Lock()
+	if h.piece == nil {
+		h.piece = piece
+	}
+	r.lock.Unlock()
+	return nil, nil
+}
+
+// replaceHolders replaces holders which have been failing for too long with
+// nodes outside the generation. The key is split again for the new set of
+// holders, which also makes the piece of the replaced holder useless.
+func (r *replicator) replaceHolders(gen *generationState, g int64) {
+	for _, uuid := range gen.sortedHolders() {
+		h := gen.holders[uuid]
+		if h.failingSince.IsZero() || time.Since(h.failingSince) < holderReplaceAfter {
+			continue
+		}
+
+		substitute := ""
+		for _, node := range globals.Nodes.GetAll() {
+			if _, ok := gen.holders[node.UUID]; !ok && node.UUID != globals.ThisNode.UUID {
+				substitute = node.UUID
+				break
+			}
+		}
+		if substitute == "" {
+			if !gen.noSubstitute {
+				Log.Warnf("Node %s has been unreachable since %s but there is no node to replace it",
+					uuid, h.failingSince.Format(time.RFC3339))
+			}
+			r.lock.Lock()
+			gen.noSubstitute = true
+			r.lock.Unlock()
+			return
+		}
+
+		Log.Warnf("Replacing unreachable holder %s with %s in generation %d", uuid, substitute, g)
+		r.lock.Lock()
+		delete(gen.holders, uuid)
+		gen.holders[substitute] = &holderState{substitute: true}
+		for _, other := range gen.holders {
+			other.piece = nil
+			other.delivered = false
+		}
+		gen.noSubstitute = false
+		r.redistributions++
+		r.lock.Unlock()
+	}
+}
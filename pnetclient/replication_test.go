@@ -0,0 +1,259 @@
+// +build !integration
+
+package pnetclient
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pp2p/paranoid/logger"
+	"github.com/pp2p/pfsd/globals"
+	"github.com/pp2p/pfsd/keyman"
+)
+
+const (
+	testGeneration = 1
+	ownUUID        = "node-a"
+	holderB        = "node-b"
+	holderC        = "node-c"
+	outsiderUUID   = "node-d"
+)
+
+var errUnreachable = errors.New("node is unreachable")
+
+func TestMain(m *testing.M) {
+	Log = logger.New("pnetclient", "pfsd", os.DevNull)
+	globals.ThisNode = globals.Node{UUID: ownUUID}
+	os.Exit(m.Run())
+}
+
+// setupReplication returns a generation of this node whose pieces have been
+// split for holderB and holderC, and keeps the first piece as this node's.
+func setupReplication(t *testing.T) (*replicator, *generationState, []*keyman.KeyPiece) {
+	key, err := keyman.GenerateKey(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces, err := keyman.GeneratePieces(key, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	globals.HeldKeyPieces = globals.KeyPieceStore{
+		testGeneration: globals.KeyPieceMap{ownUUID: pieces[0]},
+	}
+	gen := &generationState{
+		threshold: 2,
+		holders: map[string]*holderState{
+			holderB: {piece: pieces[1]},
+			holderC: {piece: pieces[2]},
+		},
+		// Completing a generation needs raft
+		complete: true,
+	}
+	r := &replicator{generations: map[int64]*generationState{testGeneration: gen}}
+	return r, gen, pieces
+}
+
+// fakeRPCs replaces the RPCs used to replicate pieces until the returned
+// function is called.
+func fakeRPCs(send func(string, int64, *keyman.KeyPiece, bool) error,
+	request func(string, int64) (*keyman.KeyPiece, error),
+	verify func(string, int64, *keyman.KeyPiece) error) func() {
+	sendKeyPiece, requestKeyPiece, verifyKeyPiece = send, request, verify
+	return func() {
+		sendKeyPiece, requestKeyPiece, verifyKeyPiece = SendKeyPiece, RequestKeyPiece, VerifyKeyPiece
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{0, minReplicationBackoff},
+		{1, minReplicationBackoff},
+		{2, 2 * minReplicationBackoff},
+		{4, 8 * minReplicationBackoff},
+		{8, maxReplicationBackoff},
+		{100, maxReplicationBackoff},
+	}
+	for _, test := range tests {
+		if delay := backoff(test.failures); delay != test.delay {
+			t.Errorf("Backoff after %d failures is %s, expected %s", test.failures, delay, test.delay)
+		}
+	}
+}
+
+func TestRecordFailureAndSuccess(t *testing.T) {
+	r := &replicator{generations: make(map[int64]*generationState)}
+	h := &holderState{}
+
+	before := time.Now()
+	r.recordFailure(h, &r.sendFailures)
+	failingSince := h.failingSince
+	if failingSince.Before(before) || time.Now().Before(failingSince) {
+		t.Error("First failure recorded at", failingSince)
+	}
+	r.recordFailure(h, &r.sendFailures)
+	if h.failingSince != failingSince {
+		t.Error("Second failure moved the start of failures to", h.failingSince)
+	}
+	if h.failures != 2 || r.sendFailures != 2 {
+		t.Errorf("Recorded %d failures of the holder and %d send failures, expected 2", h.failures, r.sendFailures)
+	}
+	earliest, latest := before.Add(backoff(2)), time.Now().Add(backoff(2))
+	if h.nextAttempt.Before(earliest) || h.nextAttempt.After(latest) {
+		t.Errorf("Next attempt at %s, expected between %s and %s", h.nextAttempt, earliest, latest)
+	}
+
+	r.recordSuccess(h, false)
+	if !h.delivered || h.failures != 0 || !h.failingSince.IsZero() || !h.nextAttempt.IsZero() {
+		t.Errorf("Success did not reset the holder: %+v", h)
+	}
+	if !h.verifiedAt.IsZero() {
+		t.Error("Unverified success set the verification time")
+	}
+	before = time.Now()
+	r.recordSuccess(h, true)
+	if h.verifiedAt.Before(before) {
+		t.Error("Verified success did not set the verification time")
+	}
+}
+
+func TestDeliverBacksOff(t *testing.T) {
+	r, gen, pieces := setupReplication(t)
+	sent := make(map[string]int)
+	failing := map[string]bool{holderC: true}
+	defer fakeRPCs(func(uuid string, generation int64, piece *keyman.KeyPiece, addElement bool) error {
+		sent[uuid]++
+		if piece != gen.holders[uuid].piece || generation != testGeneration || addElement {
+			t.Errorf("Sent %s piece %d of generation %d, adding element %t", uuid, piece.Seq, generation, addElement)
+		}
+		if failing[uuid] {
+			return errUnreachable
+		}
+		return nil
+	}, nil, nil)()
+
+	r.deliver(nil, gen, testGeneration)
+	if !gen.holders[holderB].delivered || gen.holders[holderC].delivered {
+		t.Fatal("Expected only the piece of", holderB, "to be delivered")
+	}
+	if gen.holders[holderC].failures != 1 || r.sendFailures != 1 {
+		t.Error("Failure to send the piece of", holderC, "was not recorded")
+	}
+
+	// Delivered pieces are not sent again, and failed ones not before the
+	// backoff expires.
+	r.deliver(nil, gen, testGeneration)
+	if sent[holderB] != 1 || sent[holderC] != 1 {
+		t.Errorf("Pieces sent %v during backoff", sent)
+	}
+
+	failing[holderC] = false
+	gen.holders[holderC].nextAttempt = time.Now().Add(-time.Second)
+	r.deliver(nil, gen, testGeneration)
+	if sent[holderC] != 2 || !gen.holders[holderC].delivered || gen.holders[holderC].failures != 0 {
+		t.Error("Piece of", holderC, "was not delivered once the backoff expired")
+	}
+	if gen.holders[holderB].piece != pieces[1] {
+		t.Error("Delivering changed the piece of", holderB)
+	}
+}
+
+func TestReplaceHolders(t *testing.T) {
+	r, gen, _ := setupReplication(t)
+	failingSince := time.Now().Add(-holderReplaceAfter - time.Minute)
+	gen.holders[holderB].delivered = true
+	gen.holders[holderC].delivered = true
+	gen.holders[holderC].failingSince = failingSince
+
+	// There is no node outside the generation to replace the holder with
+	r.replaceHolders(gen, testGeneration)
+	if _, ok := gen.holders[holderC]; !ok || !gen.noSubstitute {
+		t.Fatal("Holder was replaced without a node to replace it with")
+	}
+
+	outsider := globals.Node{UUID: outsiderUUID}
+	globals.Nodes.Add(outsider)
+	defer globals.Nodes.Remove(outsider)
+
+	// Holders which have not been failing for long enough are kept
+	gen.holders[holderC].failingSince = time.Now().Add(-holderReplaceAfter + time.Minute)
+	r.replaceHolders(gen, testGeneration)
+	if _, ok := gen.holders[holderC]; !ok {
+		t.Fatal("Holder was replaced before", holderReplaceAfter)
+	}
+
+	gen.holders[holderC].failingSince = failingSince
+	r.replaceHolders(gen, testGeneration)
+	if _, ok := gen.holders[holderC]; ok {
+		t.Fatal("Unreachable holder was not replaced")
+	}
+	substitute, ok := gen.holders[outsiderUUID]
+	if !ok || !substitute.substitute {
+		t.Fatal("Unreachable holder was not replaced by", outsiderUUID)
+	}
+	if gen.noSubstitute || r.redistributions != 1 {
+		t.Errorf("Replacement not recorded: missing substitute %t, %d redistributions", gen.noSubstitute, r.redistributions)
+	}
+	// The key is split again, as the replaced holder still has its piece
+	for uuid, h := range gen.holders {
+		if h.piece != nil || h.delivered {
+			t.Errorf("Holder %s kept its piece of the old split", uuid)
+		}
+	}
+}
+
+func TestVerifyHolders(t *testing.T) {
+	r, gen, pieces := setupReplication(t)
+	gen.holders[holderB].delivered = true
+	gen.holders[holderC].delivered = true
+	gen.holders[holderC].piece = nil
+
+	var requested []string
+	proofs := map[string]error{holderB: nil, holderC: ErrPieceNotProvable}
+	defer fakeRPCs(nil, func(uuid string, generation int64) (*keyman.KeyPiece, error) {
+		requested = append(requested, uuid)
+		return pieces[2], nil
+	}, func(uuid string, generation int64, ownPiece *keyman.KeyPiece) error {
+		if ownPiece != pieces[0] {
+			t.Error("Proof checked against another piece than this node's")
+		}
+		return proofs[uuid]
+	})()
+
+	// Only pieces which can not be proven are fetched
+	r.verify(gen, testGeneration)
+	if len(requested) != 1 || requested[0] != holderC {
+		t.Errorf("Requested the pieces of %v, expected only %s", requested, holderC)
+	}
+	for uuid, h := range gen.holders {
+		if h.verifiedAt.IsZero() {
+			t.Errorf("Piece of %s was not verified", uuid)
+		}
+	}
+	if gen.holders[holderC].piece != pieces[2] {
+		t.Error("Fetched piece was not kept")
+	}
+
+	// A holder which does not answer is backed off, and one with an invalid
+	// piece is given the piece again.
+	proofs[holderB], proofs[holderC] = errUnreachable, keyman.ErrInvalidProof
+	for _, h := range gen.holders {
+		h.verifiedAt = time.Time{}
+	}
+	r.verify(gen, testGeneration)
+	if b := gen.holders[holderB]; !b.delivered || b.failures != 1 || b.nextAttempt.IsZero() {
+		t.Errorf("Unreachable holder was not backed off: %+v", b)
+	}
+	if c := gen.holders[holderC]; c.delivered || c.failures != 0 {
+		t.Errorf("Holder with an invalid piece will not be given it again: %+v", c)
+	}
+	if r.verifyFailures != 2 || r.redistributions != 0 {
+		t.Errorf("Recorded %d verify failures and %d redistributions, expected 2 and 0",
+			r.verifyFailures, r.redistributions)
+	}
+}
@@ -6,12 +6,17 @@ import (
 	"math/big"
 
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 
 	pb "github.com/pp2p/paranoid/proto/paranoidnetwork"
 	"github.com/pp2p/pfsd/globals"
 	"github.com/pp2p/pfsd/keyman"
 )
 
+// ErrPieceNotFound is returned when a node does not hold the requested piece
+var ErrPieceNotFound = errors.New("node does not hold the key piece")
+
 // RequestKeyPiece from a node based on its UUID
 func RequestKeyPiece(uuid string, generation int64) (*keyman.KeyPiece, error) {
 	node, err := globals.Nodes.GetNode(uuid)
@@ -38,6 +43,10 @@ func RequestKeyPiece(uuid string, generation int64) (*keyman.KeyPiece, error) {
 		Generation: generation,
 	},
 	)
+	if grpc.Code(err) == codes.NotFound {
+		Log.Warn("KeyPiece not held by", node)
+		return nil, ErrPieceNotFound
+	}
 	if err != nil {
 		Log.Warn("Failed requesting KeyPiece from", node, "Error:", err)
 		return nil, fmt.Errorf("failed requesting KeyPiece from %s: %s", node, err)
@@ -0,0 +1,48 @@
+package pnetclient
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/context"
+
+	"github.com/pp2p/pfsd/globals"
+	"github.com/pp2p/pfsd/keyman"
+	kpb "github.com/pp2p/pfsd/proto/keynetwork"
+)
+
+// GetThreshold asks the given nodes in turn for the number of key pieces
+// needed to unlock with a generation, and for the threshold policy of the
+// cluster, until one of them answers.
+func GetThreshold(uuids []string, generation int64) (int64, keyman.ThresholdPolicy, error) {
+	for _, uuid := range uuids {
+		node, err := globals.Nodes.GetNode(uuid)
+		if err != nil {
+			Log.Error("GetThreshold: could not find node details for", uuid)
+			continue
+		}
+		conn, err := Dial(node)
+		if err != nil {
+			Log.Error("GetThreshold: failed to dial", node)
+			continue
+		}
+
+		client := kpb.NewKeyNetworkClient(conn)
+		resp, err := client.GetThreshold(context.Background(), &kpb.ThresholdRequest{
+			Uuid:       globals.ThisNode.UUID,
+			CommonName: globals.ThisNode.CommonName,
+			Generation: generation,
+		})
+		conn.Close()
+		if err != nil {
+			Log.Error("Error requesting threshold of generation", generation, "from", node, ":", err)
+			continue
+		}
+		policy, err := keyman.ParseThresholdPolicy(resp.Policy)
+		if err != nil {
+			return 0, keyman.ThresholdPolicy{}, fmt.Errorf("%s sent an invalid threshold policy: %s", node, err)
+		}
+		return resp.Threshold, policy, nil
+	}
+	return 0, keyman.ThresholdPolicy{}, errors.New("unable to get threshold, no peer has returned okay")
+}
@@ -0,0 +1,72 @@
+package pnetclient
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/pp2p/pfsd/globals"
+	"github.com/pp2p/pfsd/keyman"
+	kpb "github.com/pp2p/pfsd/proto/keynetwork"
+)
+
+// ErrPieceNotProvable is returned when the holding of a piece can not be
+// proven, because the piece was made before pieces had commitments or the
+// holder runs a pfsd without the VerifyKeyPiece RPC.
+var ErrPieceNotProvable = errors.New("holding of the key piece can not be proven")
+
+// proofNonceSize is the size of the nonces sent to holders
+const proofNonceSize = 32
+
+// VerifyKeyPiece asks a node to prove that it holds the key piece of this node
+// for a generation, without it sending the piece. The proof is checked against
+// the commitments of ownPiece, the piece of the same split kept by this node.
+func VerifyKeyPiece(uuid string, generation int64, ownPiece *keyman.KeyPiece) error {
+	if len(ownPiece.Commitments) == 0 {
+		return ErrPieceNotProvable
+	}
+	node, err := globals.Nodes.GetNode(uuid)
+	if err != nil {
+		return errors.New("could not find node details")
+	}
+	nonce := make([]byte, proofNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("could not generate nonce: %s", err)
+	}
+
+	conn, err := Dial(node)
+	if err != nil {
+		return fmt.Errorf("failed to dial %s: %s", node, err)
+	}
+	defer conn.Close()
+
+	client := kpb.NewKeyNetworkClient(conn)
+	resp, err := client.VerifyKeyPiece(context.Background(), &kpb.KeyPieceProofRequest{
+		Uuid:       globals.ThisNode.UUID,
+		CommonName: globals.ThisNode.CommonName,
+		Generation: generation,
+		Nonce:      nonce,
+	})
+	switch grpc.Code(err) {
+	case codes.OK:
+	case codes.NotFound:
+		Log.Warn("KeyPiece not held by", node)
+		return ErrPieceNotFound
+	case codes.FailedPrecondition, codes.Unimplemented:
+		return ErrPieceNotProvable
+	default:
+		return fmt.Errorf("failed verifying KeyPiece held by %s: %s", node, err)
+	}
+
+	proof := &keyman.PieceProof{
+		Seq:        resp.Seq,
+		Commitment: new(big.Int).SetBytes(resp.Commitment),
+		Response:   resp.Response,
+	}
+	return keyman.VerifyPieceProof(proof, ownPiece.Commitments, nonce)
+}
@@ -0,0 +1,191 @@
+package pnetserver
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"github.com/pp2p/pfsd/globals"
+)
+
+// peerCommonName returns the common name of the verified client certificate
+// presented on the connection the request arrived on.
+func peerCommonName(ctx context.Context) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", errors.New("no peer information for request")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return "", errors.New("request was not made over TLS")
+	}
+	chains := tlsInfo.State.VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return "", errors.New("no verified client certificate presented")
+	}
+	return chains[0][0].Subject.CommonName, nil
+}
+
+// verifyPeer checks that the client certificate of the caller belongs to the
+// node it claims to be. The common name the caller claims must be the one on
+// its certificate, as it is what gets recorded for the node. A member of the
+// raft cluster, or a node which has pinged this one before, must then present
+// a certificate for the common name it was recorded with. Any other node must
+// present a certificate whose common name is its UUID. Requests are not
+// checked unless pfsd was started with a peer certificate authority.
+func verifyPeer(ctx context.Context, uuid, commonName string) error {
+	return checkPeer(ctx, uuid, commonName, false)
+}
+
+// verifyNewPeer is verifyPeer for pings, which are how nodes first become
+// known. A node not recorded yet is accepted with any certificate and is then
+// recorded with its common name, so later requests claiming its UUID must use
+// the same certificate.
+func verifyNewPeer(ctx context.Context, uuid, commonName string) error {
+	return checkPeer(ctx, uuid, commonName, true)
+}
+
+func checkPeer(ctx context.Context, uuid, commonName string, allowUnknown bool) error {
+	if globals.Certificates == nil || !globals.Certificates.VerifiesPeers() {
+		return nil
+	}
+
+	cn, err := peerCommonName(ctx)
+	if err != nil {
+		Log.Warn("Rejecting request claiming to be from", uuid, ":", err)
+		return grpc.Errorf(codes.Unauthenticated, "client certificate required: %s", err)
+	}
+	if cn != commonName {
+		Log.Warnf("Rejecting request claiming to be from %s (%s) made with certificate for %s",
+			uuid, commonName, cn)
+		return grpc.Errorf(codes.PermissionDenied, "certificate for %s does not match claimed common name %s",
+			cn, commonName)
+	}
+
+	recorded, known := recordedCommonName(uuid)
+	switch {
+	case known && recorded != cn:
+		Log.Warnf("Rejecting request claiming to be from %s made with certificate for %s, node is known as %s",
+			uuid, cn, recorded)
+		return grpc.Errorf(codes.PermissionDenied, "certificate for %s does not match node %s", cn, uuid)
+	case !known && !allowUnknown && cn != uuid:
+		Log.Warnf("Rejecting request from unknown node %s made with certificate for %s", uuid, cn)
+		return grpc.Errorf(codes.PermissionDenied, "node %s is not known and certificate is for %s", uuid, cn)
+	}
+	return nil
+}
+
+// recordedCommonName returns the common name a node was added to the raft
+// cluster with or, failing that, the one it was first seen with.
+func recordedCommonName(uuid string) (string, bool) {
+	if globals.RaftNetworkServer != nil {
+		for _, node := range globals.RaftNetworkServer.State.Configuration.GetPeersList() {
+			if node.NodeID == uuid && node.CommonName != "" {
+				return node.CommonName, true
+			}
+		}
+	}
+	if node, err := globals.Nodes.GetNode(uuid); err == nil && node.CommonName != "" {
+		return node.CommonName, true
+	}
+	return "", false
+}
+
+// authorizeKeyRelease checks that the caller owns the key pieces it asks for.
+// The caller's certificate must match the common name the owner was added to
+// the raft cluster with, which was itself checked when the owner joined. Raft
+// is not running while this node is locked, so the common name the owner
+// sent the piece with is used instead. A piece received before owners were
+// recorded, and not given one by RecordPieceOwners since, is only released to
+// a certificate whose common name is the owner's UUID, as with unknown nodes
+// in checkPeer.
+// Without a peer certificate authority the caller can not be authenticated, so
+// pieces are only released if pfsd was started with insecure_key_release.
+func authorizeKeyRelease(ctx context.Context, generation int64, uuid, commonName string) error {
+	if globals.Certificates == nil || !globals.Certificates.VerifiesPeers() {
+		if globals.InsecureKeyRelease {
+			return nil
+		}
+		return grpc.Errorf(codes.FailedPrecondition,
+			"peers can not be authenticated without a peer certificate authority")
+	}
+	if err := verifyPeer(ctx, uuid, commonName); err != nil {
+		return err
+	}
+
+	cn, err := peerCommonName(ctx)
+	if err != nil {
+		return grpc.Errorf(codes.Unauthenticated, "client certificate required: %s", err)
+	}
+	if globals.RaftNetworkServer == nil {
+		piece := globals.HeldKeyPieces.GetPiece(generation, uuid)
+		if piece == nil {
+			return grpc.Errorf(codes.Unavailable, "cluster membership is not yet known")
+		}
+		if piece.OwnerCommonName == "" {
+			if cn != uuid {
+				Log.Warnf("Refusing key piece of %s to certificate for %s: the piece does not record "+
+					"its owner, so only a certificate for %s is accepted until raft is running", uuid, cn, uuid)
+				return grpc.Errorf(codes.PermissionDenied,
+					"key piece of %s does not record its owner and certificate is for %s", uuid, cn)
+			}
+			return nil
+		}
+		if piece.OwnerCommonName != cn {
+			return grpc.Errorf(codes.PermissionDenied, "node %s sent its key piece as %s, not %s",
+				uuid, piece.OwnerCommonName, cn)
+		}
+		return nil
+	}
+	for _, node := range globals.RaftNetworkServer.State.Configuration.GetPeersList() {
+		if node.NodeID != uuid {
+			continue
+		}
+		if node.CommonName != cn {
+			return grpc.Errorf(codes.PermissionDenied, "node %s joined the cluster as %s, not %s",
+				uuid, node.CommonName, cn)
+		}
+		return nil
+	}
+	return grpc.Errorf(codes.PermissionDenied, "node %s is not a member of the cluster", uuid)
+}
+
+// RecordPieceOwners gives every held key piece which does not record the
+// common name of its owner the one the owner was added to the raft cluster
+// with. Pieces received before owners were recorded can then be released to
+// their owner while raft is not running.
+func RecordPieceOwners() error {
+	if globals.RaftNetworkServer == nil {
+		return nil
+	}
+	owners := make(map[string]string)
+	for _, node := range globals.RaftNetworkServer.State.Configuration.GetPeersList() {
+		if node.CommonName != "" {
+			owners[node.NodeID] = node.CommonName
+		}
+	}
+	return globals.HeldKeyPieces.RecordOwnerCommonNames(owners)
+}
+
+// auditKeyRelease records the outcome of every request for a key piece.
+func auditKeyRelease(ctx context.Context, generation int64, owner string, err error) {
+	addr := "unknown"
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		addr = p.Addr.String()
+	}
+	cn, cnErr := peerCommonName(ctx)
+	if cnErr != nil {
+		cn = "none"
+	}
+	if err != nil {
+		AuditLog.Warnf("Refused key piece: generation %d, owner %s, peer %s, certificate %s: %s",
+			generation, owner, addr, cn, err)
+	} else {
+		AuditLog.Infof("Released key piece: generation %d, owner %s, peer %s, certificate %s",
+			generation, owner, addr, cn)
+	}
+}
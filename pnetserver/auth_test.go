@@ -0,0 +1,211 @@
+// +build !integration
+
+package pnetserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"github.com/pp2p/paranoid/logger"
+	"github.com/pp2p/pfsd/certstore"
+	"github.com/pp2p/pfsd/globals"
+	"github.com/pp2p/pfsd/keyman"
+)
+
+const (
+	knownUUID     = "known-uuid"
+	unknownUUID   = "unknown-uuid"
+	legacyUUID    = "legacy-uuid"
+	missingUUID   = "missing-uuid"
+	knownCN       = "known.example.com"
+	otherCN       = "other.example.com"
+	keyGeneration = 1
+)
+
+func TestMain(m *testing.M) {
+	Log = logger.New("pnetserver", "pfsd", os.DevNull)
+	AuditLog = logger.New("keyaudit", "pfsd", os.DevNull)
+	certstore.Log = logger.New("certstore", "pfsd", os.DevNull)
+	os.Exit(m.Run())
+}
+
+// peerCA returns a certificate store which verifies peers.
+func peerCA(t *testing.T) *certstore.Store {
+	dir, err := ioutil.TempDir("", "pnetserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := certstore.New(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.LoadPeerCA(certFile); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// peerContext returns the context of a request made with a verified client
+// certificate for cn, or without TLS if cn is empty.
+func peerContext(cn string) context.Context {
+	if cn == "" {
+		return peer.NewContext(context.Background(), &peer.Peer{})
+	}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{
+			State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+		},
+	})
+}
+
+// setupAuth sets up a node which knows knownUUID as knownCN and holds a piece
+// sent by knownUUID and one received before owners were recorded from
+// legacyUUID. Raft is not running, as while the node is locked.
+func setupAuth(t *testing.T, verifyPeers, insecureRelease bool) func() {
+	certificates, heldPieces := globals.Certificates, globals.HeldKeyPieces
+	globals.Certificates = nil
+	if verifyPeers {
+		globals.Certificates = peerCA(t)
+	}
+	globals.InsecureKeyRelease = insecureRelease
+	globals.HeldKeyPieces = globals.KeyPieceStore{
+		keyGeneration: globals.KeyPieceMap{
+			knownUUID:  &keyman.KeyPiece{OwnerCommonName: knownCN},
+			legacyUUID: &keyman.KeyPiece{},
+		},
+	}
+	known := globals.Node{UUID: knownUUID, CommonName: knownCN}
+	globals.Nodes.Add(known)
+
+	return func() {
+		globals.Certificates, globals.HeldKeyPieces = certificates, heldPieces
+		globals.InsecureKeyRelease = false
+		globals.Nodes.Remove(known)
+	}
+}
+
+func TestCheckPeer(t *testing.T) {
+	tests := []struct {
+		name         string
+		verifyPeers  bool
+		certCN       string
+		uuid         string
+		commonName   string
+		allowUnknown bool
+		code         codes.Code
+	}{
+		{"no CA", false, "", unknownUUID, otherCN, false, codes.OK},
+		{"no client certificate", true, "", knownUUID, knownCN, false, codes.Unauthenticated},
+		{"known node", true, knownCN, knownUUID, knownCN, false, codes.OK},
+		{"known node with another certificate", true, otherCN, knownUUID, otherCN, false, codes.PermissionDenied},
+		{"claimed common name mismatch", true, otherCN, knownUUID, knownCN, false, codes.PermissionDenied},
+		{"unknown node with certificate for its UUID", true, unknownUUID, unknownUUID, unknownUUID, false, codes.OK},
+		{"unknown node", true, otherCN, unknownUUID, otherCN, false, codes.PermissionDenied},
+		{"unknown node pinging", true, otherCN, unknownUUID, otherCN, true, codes.OK},
+		{"known node pinging with another certificate", true, otherCN, knownUUID, otherCN, true, codes.PermissionDenied},
+	}
+	for _, test := range tests {
+		cleanup := setupAuth(t, test.verifyPeers, false)
+		err := checkPeer(peerContext(test.certCN), test.uuid, test.commonName, test.allowUnknown)
+		if code := grpc.Code(err); code != test.code {
+			t.Errorf("%s: expected %s, got %s: %v", test.name, test.code, code, err)
+		}
+		cleanup()
+	}
+}
+
+func TestAuthorizeKeyRelease(t *testing.T) {
+	tests := []struct {
+		name            string
+		verifyPeers     bool
+		insecureRelease bool
+		certCN          string
+		uuid            string
+		commonName      string
+		code            codes.Code
+	}{
+		{"no CA", false, false, knownCN, knownUUID, knownCN, codes.FailedPrecondition},
+		{"no CA with insecure release", false, true, "", knownUUID, knownCN, codes.OK},
+		{"owner", true, false, knownCN, knownUUID, knownCN, codes.OK},
+		{"owner with another certificate", true, false, otherCN, knownUUID, otherCN, codes.PermissionDenied},
+		{"claimed common name mismatch", true, false, otherCN, knownUUID, knownCN, codes.PermissionDenied},
+		{"no client certificate", true, false, "", knownUUID, knownCN, codes.Unauthenticated},
+		{"unknown node", true, false, otherCN, unknownUUID, otherCN, codes.PermissionDenied},
+		{"no piece held", true, false, missingUUID, missingUUID, missingUUID, codes.Unavailable},
+		{"legacy piece with certificate for its owner", true, false, legacyUUID, legacyUUID, legacyUUID, codes.OK},
+		{"legacy piece with another certificate", true, false, otherCN, legacyUUID, otherCN, codes.PermissionDenied},
+	}
+	for _, test := range tests {
+		cleanup := setupAuth(t, test.verifyPeers, test.insecureRelease)
+		err := authorizeKeyRelease(peerContext(test.certCN), keyGeneration, test.uuid, test.commonName)
+		if code := grpc.Code(err); code != test.code {
+			t.Errorf("%s: expected %s, got %s: %v", test.name, test.code, code, err)
+		}
+		cleanup()
+	}
+}
+
+func TestLegacyPieceKnownOwner(t *testing.T) {
+	cleanup := setupAuth(t, true, false)
+	defer cleanup()
+	// A legacy piece is not released on the strength of the common name its
+	// owner pinged with, as any node can ping first.
+	pinged := globals.Node{UUID: legacyUUID, CommonName: otherCN}
+	globals.Nodes.Add(pinged)
+	defer globals.Nodes.Remove(pinged)
+
+	err := authorizeKeyRelease(peerContext(otherCN), keyGeneration, legacyUUID, otherCN)
+	if code := grpc.Code(err); code != codes.PermissionDenied {
+		t.Errorf("Expected %s, got %s: %v", codes.PermissionDenied, code, err)
+	}
+}
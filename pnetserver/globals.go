@@ -11,3 +11,6 @@ type ParanoidServer struct{}
 
 // Log used by pnetserver
 var Log *logger.ParanoidLogger
+
+// AuditLog records every request for a key piece held by this node
+var AuditLog *logger.ParanoidLogger
@@ -14,6 +14,9 @@ import (
 
 // JoinCluster receives requests from nodes asking to join raft cluster
 func (s *ParanoidServer) JoinCluster(ctx context.Context, req *pb.JoinClusterRequest) (*pb.EmptyMessage, error) {
+	if err := verifyPeer(ctx, req.Uuid, req.CommonName); err != nil {
+		return &pb.EmptyMessage{}, err
+	}
 	if req.PoolPassword == "" {
 		if len(globals.PoolPasswordHash) != 0 {
 			return &pb.EmptyMessage{}, errors.New("cluster is password protected but no password was given")
@@ -32,6 +35,9 @@ func (s *ParanoidServer) JoinCluster(ctx context.Context, req *pb.JoinClusterReq
 		NodeID:     req.Uuid,
 	}
 	Log.Infof("Got Ping from Node:", node)
+	if globals.RaftNetworkServer == nil {
+		return &pb.EmptyMessage{}, errors.New("unable to add node to raft cluster: this node is locked")
+	}
 	err := globals.RaftNetworkServer.RequestAddNodeToConfiguration(node)
 	if err != nil {
 		return &pb.EmptyMessage{}, fmt.Errorf("unable to add node to raft cluster: %v", err)
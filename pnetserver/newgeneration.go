@@ -13,6 +13,10 @@ import (
 // NewGeneration receives requests from nodes asking to create a new KeyPiece
 // generation in preparation for joining the cluster.
 func (s *ParanoidServer) NewGeneration(ctx context.Context, req *pb.NewGenerationRequest) (*pb.NewGenerationResponse, error) {
+	requester := req.GetRequestingNode()
+	if err := verifyPeer(ctx, requester.Uuid, requester.CommonName); err != nil {
+		return &pb.NewGenerationResponse{}, err
+	}
 	if req.PoolPassword == "" {
 		if len(globals.PoolPasswordHash) != 0 {
 			return &pb.NewGenerationResponse{}, grpc.Errorf(codes.InvalidArgument,
@@ -27,6 +31,10 @@ func (s *ParanoidServer) NewGeneration(ctx context.Context, req *pb.NewGeneratio
 		}
 	}
 
+	if globals.RaftNetworkServer == nil {
+		return &pb.NewGenerationResponse{}, grpc.Errorf(codes.Unavailable,
+			"unable to create new generation: this node is locked")
+	}
 	Log.Info("Requesting new generation")
 	generationNumber, peers, err := globals.RaftNetworkServer.RequestNewGeneration(req.GetRequestingNode().Uuid)
 	if err != nil {
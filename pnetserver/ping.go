@@ -9,6 +9,9 @@ import (
 
 // Ping implements the Ping RPC
 func (s *ParanoidServer) Ping(ctx context.Context, req *pb.Node) (*pb.EmptyMessage, error) {
+	if err := verifyNewPeer(ctx, req.Uuid, req.CommonName); err != nil {
+		return &pb.EmptyMessage{}, err
+	}
 	node := globals.Node{
 		IP:         req.Ip,
 		Port:       req.Port,
@@ -17,6 +20,9 @@ func (s *ParanoidServer) Ping(ctx context.Context, req *pb.Node) (*pb.EmptyMessa
 	}
 	Log.Infof("Got Ping from Node:", node)
 	globals.Nodes.Add(node)
-	globals.RaftNetworkServer.ChangeNodeLocation(req.Uuid, req.Ip, req.Port)
+	// Raft is not running while the filesystem is locked
+	if globals.RaftNetworkServer != nil {
+		globals.RaftNetworkServer.ChangeNodeLocation(req.Uuid, req.Ip, req.Port)
+	}
 	return &pb.EmptyMessage{}, nil
 }
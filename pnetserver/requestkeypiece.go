@@ -9,14 +9,21 @@ import (
 	"github.com/pp2p/pfsd/globals"
 )
 
-// RequestKeyPiece implements the RequestKeyPiece RPC
+// RequestKeyPiece implements the RequestKeyPiece RPC. Pieces are only released
+// to their owner, and every request is recorded in the audit log.
 func (s *ParanoidServer) RequestKeyPiece(ctx context.Context, req *pb.KeyPieceRequest) (*pb.KeyPiece, error) {
+	if err := authorizeKeyRelease(ctx, req.Generation, req.Node.Uuid, req.Node.CommonName); err != nil {
+		auditKeyRelease(ctx, req.Generation, req.Node.Uuid, err)
+		return &pb.KeyPiece{}, err
+	}
 	key := globals.HeldKeyPieces.GetPiece(req.Generation, req.Node.Uuid)
 	if key == nil {
 		Log.Warn("Key not found for node", req.Node)
 		err := grpc.Errorf(codes.NotFound, "Key not found for node %v", req.Node)
+		auditKeyRelease(ctx, req.Generation, req.Node.Uuid, err)
 		return &pb.KeyPiece{}, err
 	}
+	auditKeyRelease(ctx, req.Generation, req.Node.Uuid, nil)
 	keyProto := &pb.KeyPiece{
 		Data:              key.Data,
 		ParentFingerprint: key.ParentFingerprint[:],
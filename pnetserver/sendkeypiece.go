@@ -15,6 +15,10 @@ import (
 
 // SendKeyPiece implements the SendKeyPiece RPC
 func (s *ParanoidServer) SendKeyPiece(ctx context.Context, req *pb.KeyPieceSend) (*pb.SendKeyPieceResponse, error) {
+	owner := req.Key.GetOwnerNode()
+	if err := verifyPeer(ctx, owner.Uuid, owner.CommonName); err != nil {
+		return &pb.SendKeyPieceResponse{}, err
+	}
 	var prime big.Int
 	prime.SetBytes(req.Key.Prime)
 	// We must convert a slice to an array
@@ -25,6 +29,10 @@ func (s *ParanoidServer) SendKeyPiece(ctx context.Context, req *pb.KeyPieceSend)
 		ParentFingerprint: fingerArray,
 		Prime:             &prime,
 		Seq:               req.Key.Seq,
+		OwnerCommonName:   owner.CommonName,
+	}
+	if err := keyman.CheckPiece(piece); err != nil {
+		return &pb.SendKeyPieceResponse{}, grpc.Errorf(codes.InvalidArgument, "invalid key piece: %s", err)
 	}
 	raftOwner := &raftpb.Node{
 		Ip:         req.Key.OwnerNode.Ip,
@@ -0,0 +1,26 @@
+package pnetserver
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/pp2p/pfsd/keyman"
+	kpb "github.com/pp2p/pfsd/proto/keynetwork"
+)
+
+// GetThreshold implements the GetThreshold RPC
+func (s *ParanoidServer) GetThreshold(ctx context.Context, req *kpb.ThresholdRequest) (*kpb.ThresholdResponse, error) {
+	if err := verifyPeer(ctx, req.Uuid, req.CommonName); err != nil {
+		return &kpb.ThresholdResponse{}, err
+	}
+	threshold, err := keyman.StateMachine.GetThreshold(req.Generation)
+	if err != nil {
+		return &kpb.ThresholdResponse{}, grpc.Errorf(codes.NotFound,
+			"unable to get threshold of generation %d: %s", req.Generation, err)
+	}
+	return &kpb.ThresholdResponse{
+		Threshold: threshold,
+		Policy:    keyman.StateMachine.GetThresholdPolicy().String(),
+	}, nil
+}
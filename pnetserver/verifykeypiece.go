@@ -0,0 +1,39 @@
+package pnetserver
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/pp2p/pfsd/globals"
+	"github.com/pp2p/pfsd/keyman"
+	kpb "github.com/pp2p/pfsd/proto/keynetwork"
+)
+
+// VerifyKeyPiece implements the VerifyKeyPiece RPC. The owner of a piece is
+// sent a proof that this node holds it, which does not reveal the piece.
+func (s *ParanoidServer) VerifyKeyPiece(ctx context.Context, req *kpb.KeyPieceProofRequest) (*kpb.KeyPieceProof, error) {
+	if err := verifyPeer(ctx, req.Uuid, req.CommonName); err != nil {
+		return &kpb.KeyPieceProof{}, err
+	}
+	if len(req.Nonce) < keyman.MinProofNonceSize {
+		return &kpb.KeyPieceProof{}, grpc.Errorf(codes.InvalidArgument,
+			"nonce must be at least %d bytes", keyman.MinProofNonceSize)
+	}
+	piece := globals.HeldKeyPieces.GetPiece(req.Generation, req.Uuid)
+	if piece == nil {
+		return &kpb.KeyPieceProof{}, grpc.Errorf(codes.NotFound,
+			"key piece of %s for generation %d not found", req.Uuid, req.Generation)
+	}
+	proof, err := keyman.ProvePiece(piece, req.Nonce)
+	if err != nil {
+		// Pieces made before commitments were added can not be proven
+		return &kpb.KeyPieceProof{}, grpc.Errorf(codes.FailedPrecondition,
+			"unable to prove key piece of %s: %s", req.Uuid, err)
+	}
+	return &kpb.KeyPieceProof{
+		Seq:        proof.Seq,
+		Commitment: proof.Commitment.Bytes(),
+		Response:   proof.Response,
+	}, nil
+}
@@ -0,0 +1,80 @@
+// +build !integration
+
+package pnetserver
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/pp2p/pfsd/globals"
+	"github.com/pp2p/pfsd/keyman"
+	kpb "github.com/pp2p/pfsd/proto/keynetwork"
+)
+
+func TestVerifyKeyPiece(t *testing.T) {
+	cleanup := setupAuth(t, true, false)
+	defer cleanup()
+
+	key, err := keyman.GenerateKey(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces, err := keyman.GeneratePieces(key, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces[1].OwnerCommonName = knownCN
+	globals.HeldKeyPieces[keyGeneration+1] = globals.KeyPieceMap{knownUUID: pieces[1]}
+
+	server := &ParanoidServer{}
+	nonce := bytes.Repeat([]byte{1}, keyman.MinProofNonceSize)
+	resp, err := server.VerifyKeyPiece(peerContext(knownCN), &kpb.KeyPieceProofRequest{
+		Uuid:       knownUUID,
+		CommonName: knownCN,
+		Generation: keyGeneration + 1,
+		Nonce:      nonce,
+	})
+	if err != nil {
+		t.Fatal("Unable to get proof:", err)
+	}
+	proof := &keyman.PieceProof{
+		Seq:        resp.Seq,
+		Commitment: new(big.Int).SetBytes(resp.Commitment),
+		Response:   resp.Response,
+	}
+	if err := keyman.VerifyPieceProof(proof, pieces[0].Commitments, nonce); err != nil {
+		t.Error("Proof does not verify:", err)
+	}
+	if err := keyman.VerifyPieceProof(proof, pieces[0].Commitments, bytes.Repeat([]byte{2}, len(nonce))); err == nil {
+		t.Error("Proof verifies for another nonce")
+	}
+
+	tests := []struct {
+		name       string
+		certCN     string
+		uuid       string
+		generation int64
+		nonce      []byte
+		code       codes.Code
+	}{
+		{"another certificate", otherCN, knownUUID, keyGeneration + 1, nonce, codes.PermissionDenied},
+		{"short nonce", knownCN, knownUUID, keyGeneration + 1, nonce[1:], codes.InvalidArgument},
+		{"no piece held", knownCN, knownUUID, keyGeneration + 2, nonce, codes.NotFound},
+		{"piece without commitments", knownCN, knownUUID, keyGeneration, nonce, codes.FailedPrecondition},
+	}
+	for _, test := range tests {
+		_, err := server.VerifyKeyPiece(peerContext(test.certCN), &kpb.KeyPieceProofRequest{
+			Uuid:       test.uuid,
+			CommonName: test.certCN,
+			Generation: test.generation,
+			Nonce:      test.nonce,
+		})
+		if code := grpc.Code(err); code != test.code {
+			t.Errorf("%s: expected %s, got %s: %v", test.name, test.code, code, err)
+		}
+	}
+}
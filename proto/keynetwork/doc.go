@@ -0,0 +1,5 @@
+// Package keynetwork holds the gRPC service pfsd nodes use for requests about
+// key pieces which are not part of the ParanoidNetwork protocol.
+package keynetwork
+
+//go:generate protoc -I .. --go_out=plugins=grpc:.. ../keynetwork/keynetwork.proto
@@ -0,0 +1,404 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: keynetwork/keynetwork.proto
+
+package keynetwork
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type KeyPieceProofRequest struct {
+	Uuid                 string   `protobuf:"bytes,1,opt,name=uuid,proto3" json:"uuid,omitempty"`
+	CommonName           string   `protobuf:"bytes,2,opt,name=common_name,json=commonName,proto3" json:"common_name,omitempty"`
+	Generation           int64    `protobuf:"varint,3,opt,name=generation,proto3" json:"generation,omitempty"`
+	Nonce                []byte   `protobuf:"bytes,4,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *KeyPieceProofRequest) Reset()         { *m = KeyPieceProofRequest{} }
+func (m *KeyPieceProofRequest) String() string { return proto.CompactTextString(m) }
+func (*KeyPieceProofRequest) ProtoMessage()    {}
+func (*KeyPieceProofRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_c7db66274bfcbe51, []int{0}
+}
+
+func (m *KeyPieceProofRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_KeyPieceProofRequest.Unmarshal(m, b)
+}
+func (m *KeyPieceProofRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_KeyPieceProofRequest.Marshal(b, m, deterministic)
+}
+func (m *KeyPieceProofRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_KeyPieceProofRequest.Merge(m, src)
+}
+func (m *KeyPieceProofRequest) XXX_Size() int {
+	return xxx_messageInfo_KeyPieceProofRequest.Size(m)
+}
+func (m *KeyPieceProofRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_KeyPieceProofRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_KeyPieceProofRequest proto.InternalMessageInfo
+
+func (m *KeyPieceProofRequest) GetUuid() string {
+	if m != nil {
+		return m.Uuid
+	}
+	return ""
+}
+
+func (m *KeyPieceProofRequest) GetCommonName() string {
+	if m != nil {
+		return m.CommonName
+	}
+	return ""
+}
+
+func (m *KeyPieceProofRequest) GetGeneration() int64 {
+	if m != nil {
+		return m.Generation
+	}
+	return 0
+}
+
+func (m *KeyPieceProofRequest) GetNonce() []byte {
+	if m != nil {
+		return m.Nonce
+	}
+	return nil
+}
+
+type KeyPieceProof struct {
+	Seq                  int64    `protobuf:"varint,1,opt,name=seq,proto3" json:"seq,omitempty"`
+	Commitment           []byte   `protobuf:"bytes,2,opt,name=commitment,proto3" json:"commitment,omitempty"`
+	Response             []byte   `protobuf:"bytes,3,opt,name=response,proto3" json:"response,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *KeyPieceProof) Reset()         { *m = KeyPieceProof{} }
+func (m *KeyPieceProof) String() string { return proto.CompactTextString(m) }
+func (*KeyPieceProof) ProtoMessage()    {}
+func (*KeyPieceProof) Descriptor() ([]byte, []int) {
+	return fileDescriptor_c7db66274bfcbe51, []int{1}
+}
+
+func (m *KeyPieceProof) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_KeyPieceProof.Unmarshal(m, b)
+}
+func (m *KeyPieceProof) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_KeyPieceProof.Marshal(b, m, deterministic)
+}
+func (m *KeyPieceProof) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_KeyPieceProof.Merge(m, src)
+}
+func (m *KeyPieceProof) XXX_Size() int {
+	return xxx_messageInfo_KeyPieceProof.Size(m)
+}
+func (m *KeyPieceProof) XXX_DiscardUnknown() {
+	xxx_messageInfo_KeyPieceProof.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_KeyPieceProof proto.InternalMessageInfo
+
+func (m *KeyPieceProof) GetSeq() int64 {
+	if m != nil {
+		return m.Seq
+	}
+	return 0
+}
+
+func (m *KeyPieceProof) GetCommitment() []byte {
+	if m != nil {
+		return m.Commitment
+	}
+	return nil
+}
+
+func (m *KeyPieceProof) GetResponse() []byte {
+	if m != nil {
+		return m.Response
+	}
+	return nil
+}
+
+type ThresholdRequest struct {
+	Uuid                 string   `protobuf:"bytes,1,opt,name=uuid,proto3" json:"uuid,omitempty"`
+	CommonName           string   `protobuf:"bytes,2,opt,name=common_name,json=commonName,proto3" json:"common_name,omitempty"`
+	Generation           int64    `protobuf:"varint,3,opt,name=generation,proto3" json:"generation,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ThresholdRequest) Reset()         { *m = ThresholdRequest{} }
+func (m *ThresholdRequest) String() string { return proto.CompactTextString(m) }
+func (*ThresholdRequest) ProtoMessage()    {}
+func (*ThresholdRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_c7db66274bfcbe51, []int{2}
+}
+
+func (m *ThresholdRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ThresholdRequest.Unmarshal(m, b)
+}
+func (m *ThresholdRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ThresholdRequest.Marshal(b, m, deterministic)
+}
+func (m *ThresholdRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ThresholdRequest.Merge(m, src)
+}
+func (m *ThresholdRequest) XXX_Size() int {
+	return xxx_messageInfo_ThresholdRequest.Size(m)
+}
+func (m *ThresholdRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ThresholdRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ThresholdRequest proto.InternalMessageInfo
+
+func (m *ThresholdRequest) GetUuid() string {
+	if m != nil {
+		return m.Uuid
+	}
+	return ""
+}
+
+func (m *ThresholdRequest) GetCommonName() string {
+	if m != nil {
+		return m.CommonName
+	}
+	return ""
+}
+
+func (m *ThresholdRequest) GetGeneration() int64 {
+	if m != nil {
+		return m.Generation
+	}
+	return 0
+}
+
+type ThresholdResponse struct {
+	Threshold            int64    `protobuf:"varint,1,opt,name=threshold,proto3" json:"threshold,omitempty"`
+	Policy               string   `protobuf:"bytes,2,opt,name=policy,proto3" json:"policy,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ThresholdResponse) Reset()         { *m = ThresholdResponse{} }
+func (m *ThresholdResponse) String() string { return proto.CompactTextString(m) }
+func (*ThresholdResponse) ProtoMessage()    {}
+func (*ThresholdResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_c7db66274bfcbe51, []int{3}
+}
+
+func (m *ThresholdResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ThresholdResponse.Unmarshal(m, b)
+}
+func (m *ThresholdResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ThresholdResponse.Marshal(b, m, deterministic)
+}
+func (m *ThresholdResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ThresholdResponse.Merge(m, src)
+}
+func (m *ThresholdResponse) XXX_Size() int {
+	return xxx_messageInfo_ThresholdResponse.Size(m)
+}
+func (m *ThresholdResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ThresholdResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ThresholdResponse proto.InternalMessageInfo
+
+func (m *ThresholdResponse) GetThreshold() int64 {
+	if m != nil {
+		return m.Threshold
+	}
+	return 0
+}
+
+func (m *ThresholdResponse) GetPolicy() string {
+	if m != nil {
+		return m.Policy
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterType((*KeyPieceProofRequest)(nil), "keynetwork.KeyPieceProofRequest")
+	proto.RegisterType((*KeyPieceProof)(nil), "keynetwork.KeyPieceProof")
+	proto.RegisterType((*ThresholdRequest)(nil), "keynetwork.ThresholdRequest")
+	proto.RegisterType((*ThresholdResponse)(nil), "keynetwork.ThresholdResponse")
+}
+
+func init() { proto.RegisterFile("keynetwork/keynetwork.proto", fileDescriptor_c7db66274bfcbe51) }
+
+var fileDescriptor_c7db66274bfcbe51 = []byte{
+	// 308 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xb4, 0x92, 0xc1, 0x4e, 0xf2, 0x40,
+	0x10, 0xc7, 0xd9, 0xaf, 0x7c, 0x44, 0xc6, 0x6a, 0x70, 0x42, 0x4c, 0x45, 0xd4, 0xa6, 0x27, 0x4e,
+	0x98, 0xe8, 0x43, 0x18, 0x43, 0x44, 0xb2, 0x31, 0xde, 0x8c, 0xc1, 0x32, 0xc0, 0x06, 0xba, 0x03,
+	0xdb, 0x25, 0xa6, 0x47, 0xdf, 0xc7, 0x87, 0x34, 0x6c, 0x0b, 0x54, 0x23, 0x47, 0x6f, 0x33, 0xff,
+	0x99, 0xec, 0x6f, 0x66, 0xfe, 0x0b, 0xe7, 0x33, 0xca, 0x34, 0xd9, 0x77, 0x36, 0xb3, 0xeb, 0x5d,
+	0xd8, 0x5d, 0x18, 0xb6, 0x8c, 0xb0, 0x53, 0xa2, 0x0f, 0x01, 0xcd, 0x1e, 0x65, 0x03, 0x45, 0x31,
+	0x0d, 0x0c, 0xf3, 0x58, 0xd2, 0x72, 0x45, 0xa9, 0x45, 0x84, 0xea, 0x6a, 0xa5, 0x46, 0x81, 0x08,
+	0x45, 0xa7, 0x2e, 0x5d, 0x8c, 0x57, 0x70, 0x18, 0x73, 0x92, 0xb0, 0x7e, 0xd5, 0xc3, 0x84, 0x82,
+	0x7f, 0xae, 0x04, 0xb9, 0xd4, 0x1f, 0x26, 0x84, 0x97, 0x00, 0x13, 0xd2, 0x64, 0x86, 0x56, 0xb1,
+	0x0e, 0xbc, 0x50, 0x74, 0x3c, 0x59, 0x52, 0xb0, 0x09, 0xff, 0x35, 0xeb, 0x98, 0x82, 0x6a, 0x28,
+	0x3a, 0xbe, 0xcc, 0x93, 0xe8, 0x05, 0x8e, 0xbe, 0x8d, 0x80, 0x0d, 0xf0, 0x52, 0x5a, 0x3a, 0xb4,
+	0x27, 0xd7, 0xe1, 0xfa, 0xe1, 0x35, 0x46, 0xd9, 0x84, 0xb4, 0x75, 0x60, 0x5f, 0x96, 0x14, 0x6c,
+	0xc1, 0x81, 0xa1, 0x74, 0xc1, 0x3a, 0x25, 0x87, 0xf5, 0xe5, 0x36, 0x8f, 0x26, 0xd0, 0x78, 0x9a,
+	0x1a, 0x4a, 0xa7, 0x3c, 0x1f, 0xfd, 0xe5, 0x76, 0xd1, 0x3d, 0x9c, 0x94, 0x40, 0x39, 0x1d, 0xdb,
+	0x50, 0xb7, 0x1b, 0xb1, 0xd8, 0x68, 0x27, 0xe0, 0x29, 0xd4, 0x16, 0x3c, 0x57, 0x71, 0x56, 0xe0,
+	0x8a, 0xec, 0xe6, 0x53, 0x00, 0xf4, 0x28, 0xeb, 0xe7, 0x2e, 0xe1, 0x23, 0x1c, 0x3f, 0x93, 0x51,
+	0xe3, 0x6c, 0x73, 0x27, 0x0c, 0xbb, 0x25, 0x5b, 0x7f, 0x33, 0xb0, 0x75, 0xb6, 0xb7, 0x23, 0xaa,
+	0xe0, 0x03, 0xf8, 0x77, 0x64, 0xb7, 0xd3, 0x62, 0xbb, 0xdc, 0xfc, 0xf3, 0x5a, 0xad, 0x8b, 0x3d,
+	0xd5, 0xe2, 0xc0, 0x95, 0xb7, 0x9a, 0xfb, 0x58, 0xb7, 0x5f, 0x03, 0x00, 0xd5, 0xf8, 0x7a, 0x23,
+	0x77, 0x02, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// KeyNetworkClient is the client API for KeyNetwork service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type KeyNetworkClient interface {
+	// Proves that the node holds the key piece of the caller for a generation,
+	// without revealing the piece.
+	VerifyKeyPiece(ctx context.Context, in *KeyPieceProofRequest, opts ...grpc.CallOption) (*KeyPieceProof, error)
+	// Returns the number of key pieces needed to unlock with a generation, and
+	// the threshold policy of the cluster. A node joining the cluster splits
+	// its key with it before its key state has the generation.
+	GetThreshold(ctx context.Context, in *ThresholdRequest, opts ...grpc.CallOption) (*ThresholdResponse, error)
+}
+
+type keyNetworkClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewKeyNetworkClient(cc grpc.ClientConnInterface) KeyNetworkClient {
+	return &keyNetworkClient{cc}
+}
+
+func (c *keyNetworkClient) VerifyKeyPiece(ctx context.Context, in *KeyPieceProofRequest, opts ...grpc.CallOption) (*KeyPieceProof, error) {
+	out := new(KeyPieceProof)
+	err := c.cc.Invoke(ctx, "/keynetwork.KeyNetwork/VerifyKeyPiece", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyNetworkClient) GetThreshold(ctx context.Context, in *ThresholdRequest, opts ...grpc.CallOption) (*ThresholdResponse, error) {
+	out := new(ThresholdResponse)
+	err := c.cc.Invoke(ctx, "/keynetwork.KeyNetwork/GetThreshold", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// KeyNetworkServer is the server API for KeyNetwork service.
+type KeyNetworkServer interface {
+	// Proves that the node holds the key piece of the caller for a generation,
+	// without revealing the piece.
+	VerifyKeyPiece(context.Context, *KeyPieceProofRequest) (*KeyPieceProof, error)
+	// Returns the number of key pieces needed to unlock with a generation, and
+	// the threshold policy of the cluster. A node joining the cluster splits
+	// its key with it before its key state has the generation.
+	GetThreshold(context.Context, *ThresholdRequest) (*ThresholdResponse, error)
+}
+
+// UnimplementedKeyNetworkServer can be embedded to have forward compatible implementations.
+type UnimplementedKeyNetworkServer struct {
+}
+
+func (*UnimplementedKeyNetworkServer) VerifyKeyPiece(ctx context.Context, req *KeyPieceProofRequest) (*KeyPieceProof, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method VerifyKeyPiece not implemented")
+}
+func (*UnimplementedKeyNetworkServer) GetThreshold(ctx context.Context, req *ThresholdRequest) (*ThresholdResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetThreshold not implemented")
+}
+
+func RegisterKeyNetworkServer(s *grpc.Server, srv KeyNetworkServer) {
+	s.RegisterService(&_KeyNetwork_serviceDesc, srv)
+}
+
+func _KeyNetwork_VerifyKeyPiece_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KeyPieceProofRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyNetworkServer).VerifyKeyPiece(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/keynetwork.KeyNetwork/VerifyKeyPiece",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyNetworkServer).VerifyKeyPiece(ctx, req.(*KeyPieceProofRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyNetwork_GetThreshold_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ThresholdRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyNetworkServer).GetThreshold(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/keynetwork.KeyNetwork/GetThreshold",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyNetworkServer).GetThreshold(ctx, req.(*ThresholdRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _KeyNetwork_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "keynetwork.KeyNetwork",
+	HandlerType: (*KeyNetworkServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "VerifyKeyPiece",
+			Handler:    _KeyNetwork_VerifyKeyPiece_Handler,
+		},
+		{
+			MethodName: "GetThreshold",
+			Handler:    _KeyNetwork_GetThreshold_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "keynetwork/keynetwork.proto",
+}
@@ -0,0 +1,179 @@
+// recovery.go contains the functions used to rebuild the key of a filesystem
+// from backup shares when too few nodes are left to unlock it
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/pp2p/paranoid/logger"
+	"github.com/pp2p/pfsd/globals"
+	"github.com/pp2p/pfsd/keyman"
+)
+
+var errNotFilesystemKey = errors.New("recovered key is not the key of this filesystem")
+
+// keyRecovered is set when the key was rebuilt from backup shares, in which
+// case the filesystem does not need to be unlocked.
+var keyRecovered bool
+
+// recoveryRequested reports whether the key should be rebuilt from backup
+// shares.
+func recoveryRequested() bool {
+	return *recoverKey || *recoveryShareFiles != ""
+}
+
+// withoutRecoveryFlags returns the command line of a restarted pfsd. The key
+// only needs to be recovered once, and a restarted pfsd has no terminal to
+// type shares in at, so the recovery flags are removed.
+func withoutRecoveryFlags(args []string) []string {
+	kept := []string{args[0]}
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			// The remaining arguments are not flags
+			return append(kept, args[i:]...)
+		}
+		name := strings.TrimLeft(arg, "-")
+		hasValue := false
+		if j := strings.Index(name, "="); j != -1 {
+			name, hasValue = name[:j], true
+		}
+		takesValue := false
+		if f := flag.Lookup(name); f != nil && !hasValue {
+			boolFlag, ok := f.Value.(interface {
+				IsBoolFlag() bool
+			})
+			takesValue = !ok || !boolFlag.IsBoolFlag()
+		}
+		if name == "recover_key" || name == "recovery_share_files" {
+			if takesValue {
+				i++
+			}
+			continue
+		}
+		kept = append(kept, arg)
+		if takesValue && i+1 < len(args) {
+			i++
+			kept = append(kept, args[i])
+		}
+	}
+	return kept
+}
+
+// readBackupShareFile returns the shares in a file, one per line. Blank lines
+// are ignored.
+func readBackupShareFile(shareFile string) ([]*keyman.BackupShare, error) {
+	file, err := os.Open(shareFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var shares []*keyman.BackupShare
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		share, err := keyman.DecodeBackupShare(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", shareFile, err)
+		}
+		shares = append(shares, share)
+	}
+	return shares, scanner.Err()
+}
+
+// promptBackupShares asks for backup shares on the terminal until enough have
+// been entered to recover the key.
+func promptBackupShares() ([]*keyman.BackupShare, error) {
+	var shares []*keyman.BackupShare
+	for len(shares) == 0 || int64(len(shares)) < shares[0].RequiredShares {
+		input, ok, err := promptSecret(fmt.Sprintf("Backup share %d: ", len(shares)+1))
+		if err != nil {
+			return nil, fmt.Errorf("could not read backup share: %v", err)
+		}
+		if !ok {
+			return nil, errors.New("backup shares must be given with recovery_share_files when stdin is not a terminal")
+		}
+		share, err := keyman.DecodeBackupShare(string(input))
+		zeroBytes(input)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid backup share:", err)
+			continue
+		}
+		shares = append(shares, share)
+	}
+	return shares, nil
+}
+
+// recoverKeyFromShares rebuilds the key of the filesystem from backup shares
+// read from recovery_share_files or typed in at a prompt.
+func recoverKeyFromShares() (*keyman.Key, error) {
+	var shares []*keyman.BackupShare
+	if *recoveryShareFiles != "" {
+		for _, shareFile := range strings.Split(*recoveryShareFiles, ",") {
+			fileShares, err := readBackupShareFile(strings.TrimSpace(shareFile))
+			if err != nil {
+				return nil, fmt.Errorf("could not read backup shares: %v", err)
+			}
+			shares = append(shares, fileShares...)
+		}
+	} else {
+		var err error
+		shares, err = promptBackupShares()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keyman.RecoverFromBackupShares(shares)
+}
+
+// checkRecoveredKey makes sure a recovered key is the key of this filesystem,
+// or either key of a rotation in progress. Attributes saved before the
+// fingerprint of the key was kept only allow checking the key against the
+// piece this node holds of its current generation.
+func checkRecoveredKey() error {
+	fingerprint := globals.GetEncryptionKey().GetFingerprint()
+	state, err := readRotationState()
+	if err != nil {
+		return fmt.Errorf("unable to read key rotation state: %s", err)
+	}
+	if state != nil {
+		if !bytes.Equal(fingerprint[:], state.OldFingerprint) && !bytes.Equal(fingerprint[:], state.NewFingerprint) {
+			return errNotFilesystemKey
+		}
+		return nil
+	}
+
+	attributes, err := globals.ReadFileSystemAttributes()
+	if err != nil {
+		return fmt.Errorf("unable to read file system attributes: %s", err)
+	}
+	if len(attributes.KeyFingerprint) != 0 {
+		if !bytes.Equal(fingerprint[:], attributes.KeyFingerprint) {
+			return errNotFilesystemKey
+		}
+		return nil
+	}
+	var piece *keyman.KeyPiece
+	if keyman.StateMachine != nil {
+		piece = globals.HeldKeyPieces.GetPiece(keyman.StateMachine.GetCurrentGeneration(), globals.ThisNode.UUID)
+	}
+	if piece == nil {
+		log.Warn("The fingerprint of the key of this filesystem is not known, unable to check the recovered key")
+		return nil
+	}
+	if piece.ParentFingerprint != fingerprint {
+		return errNotFilesystemKey
+	}
+	return nil
+}
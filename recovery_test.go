@@ -0,0 +1,162 @@
+// +build !integration
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/pp2p/pfsd/globals"
+	"github.com/pp2p/pfsd/keyman"
+)
+
+func TestWithoutRecoveryFlags(t *testing.T) {
+	args := []string{"pfsd", "-paranoid_dir", "/tmp/pfs", "-recover_key", "-recovery_share_files", "a,b",
+		"-mount_dir=/tmp/mnt", "--recovery_share_files=c", "-allow_other", "-recover_key=true"}
+	expected := []string{"pfsd", "-paranoid_dir", "/tmp/pfs", "-mount_dir=/tmp/mnt", "-allow_other"}
+	if restart := withoutRecoveryFlags(args); !reflect.DeepEqual(restart, expected) {
+		t.Error("Incorrect restart arguments. Expected:", expected, "Got:", restart)
+	}
+}
+
+// setupRecoveredKey creates the paranoid directory of a networked filesystem
+// whose attributes hold fingerprint, using key as if it had been recovered.
+func setupRecoveredKey(t *testing.T, key *keyman.Key, fingerprint []byte) func() {
+	dir, err := ioutil.TempDir("", "pfsdrecovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path.Join(dir, "meta"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	globals.ParanoidDir = dir
+	attributes := &globals.FileSystemAttributes{Encrypted: true, KeyGenerated: true, KeyFingerprint: fingerprint}
+	if err := globals.SaveFileSystemAttributes(attributes); err != nil {
+		t.Fatal(err)
+	}
+	globals.SetEncryptionKey(key)
+	keyman.StateMachine = keyman.NewKSM(dir)
+	return func() {
+		os.RemoveAll(dir)
+		globals.SetEncryptionKey(nil)
+		keyman.StateMachine = nil
+	}
+}
+
+func generateKeys(t *testing.T, n int) []*keyman.Key {
+	var keys []*keyman.Key
+	for i := 0; i < n; i++ {
+		key, err := keyman.GenerateKey(32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestCheckRecoveredKey(t *testing.T) {
+	keys := generateKeys(t, 2)
+	fingerprint := keys[0].GetFingerprint()
+	tests := []struct {
+		name        string
+		key         *keyman.Key
+		fingerprint []byte
+		ok          bool
+	}{
+		{"key of the filesystem", keys[0], fingerprint[:], true},
+		{"another key", keys[1], fingerprint[:], false},
+		{"no fingerprint or piece", keys[1], nil, true},
+	}
+	for _, test := range tests {
+		cleanup := setupRecoveredKey(t, test.key, test.fingerprint)
+		if err := checkRecoveredKey(); (err == nil) != test.ok {
+			t.Errorf("%s: expected the key to be accepted: %t, got error %v", test.name, test.ok, err)
+		}
+		cleanup()
+	}
+}
+
+func TestCheckRecoveredKeyWithoutFingerprint(t *testing.T) {
+	keys := generateKeys(t, 2)
+	cleanup := setupRecoveredKey(t, keys[1], nil)
+	defer cleanup()
+	pieces, err := keyman.GeneratePieces(keys[0], 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	heldPieces := globals.HeldKeyPieces
+	defer func() { globals.HeldKeyPieces = heldPieces }()
+	globals.HeldKeyPieces = globals.KeyPieceStore{
+		keyman.StateMachine.GetCurrentGeneration(): globals.KeyPieceMap{globals.ThisNode.UUID: pieces[0]},
+	}
+
+	if err := checkRecoveredKey(); err != errNotFilesystemKey {
+		t.Error("Expected the key not matching the piece of this node to be refused, got:", err)
+	}
+	globals.SetEncryptionKey(keys[0])
+	if err := checkRecoveredKey(); err != nil {
+		t.Error("Key matching the piece of this node was refused:", err)
+	}
+}
+
+func TestCheckRecoveredKeyDuringRotation(t *testing.T) {
+	keys := generateKeys(t, 3)
+	fingerprint := keys[0].GetFingerprint()
+	cleanup := setupRecoveredKey(t, keys[0], fingerprint[:])
+	defer cleanup()
+	state, err := newRotationState(keys[0], keys[1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range keys {
+		globals.SetEncryptionKey(key)
+		if err := checkRecoveredKey(); (err == nil) != (i < 2) {
+			t.Errorf("Key %d of a rotation from key 0 to 1 accepted: %t, error %v", i, i < 2, err)
+		}
+	}
+}
+
+func TestFingerprintRecorded(t *testing.T) {
+	keys := generateKeys(t, 2)
+	cleanup := setupRecoveredKey(t, keys[0], nil)
+	defer cleanup()
+
+	checkFingerprint := func(key *keyman.Key) {
+		attributes, err := globals.ReadFileSystemAttributes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fingerprint := key.GetFingerprint()
+		if !bytes.Equal(attributes.KeyFingerprint, fingerprint[:]) {
+			t.Error("Fingerprint of the key in use was not recorded")
+		}
+	}
+	if err := resumeKeyRotation(nil); err != nil {
+		t.Fatal("Unable to resume key rotation:", err)
+	}
+	checkFingerprint(keys[0])
+
+	// The fingerprint of the new key replaces the old one once the files
+	// have been converted.
+	state, err := newRotationState(keys[0], keys[1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Converted = true
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumeKeyRotation(nil); err != nil {
+		t.Fatal("Unable to resume key rotation:", err)
+	}
+	checkFingerprint(keys[1])
+}
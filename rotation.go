@@ -0,0 +1,794 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pp2p/paranoid/libpfs/commands"
+	"github.com/pp2p/paranoid/libpfs/encryption"
+	"github.com/pp2p/paranoid/libpfs/returncodes"
+	log "github.com/pp2p/paranoid/logger"
+	"github.com/pp2p/pfsd/durable"
+	"github.com/pp2p/pfsd/globals"
+	"github.com/pp2p/pfsd/keyman"
+	"github.com/pp2p/pfsd/pnetclient"
+)
+
+// Rotating the key replaces the key the files stored by this node are
+// encrypted with. libpfs uses a single cipher for every command, so rotation
+// is offline: the filesystem is locked while the files are re-encrypted, and
+// raft is stopped on this node so that no committed entries are applied in the
+// meantime. A rotation which fails is retried until it succeeds or pfsd stops.
+//
+// Every file is read with the old key into a journal and then written again
+// with the new one. Progress is recorded in meta/key_rotation, which holds the
+// new key sealed under the old one and the old key sealed under the new one,
+// so that a restart can resume with whichever key unlocks the filesystem.
+// Until the rotation has finished either key can therefore be derived from
+// the other. Only the contents of regular files are rewritten.
+//
+// Once the files have been converted, the new key of a networked node is
+// shared through a new generation of the same members. The old key is only
+// forgotten once that generation is current.
+const (
+	rotationStateMagic   = "PFKR"
+	rotationStateVersion = byte(1)
+	rotationChunkSize    = 1 << 20
+	rotationKEKDomain    = "pfsd key rotation"
+	// Interval at which a networked node checks whether the generation of
+	// the new key is current
+	rotationCheckInterval time.Duration = time.Second * 10
+	// Backoff between attempts to finish a rotation which failed
+	minRotationRetryInterval time.Duration = time.Second * 30
+	maxRotationRetryInterval time.Duration = time.Minute * 10
+)
+
+var errRotationInProgress = errors.New("a key rotation is already in progress")
+
+// rotationLock is held while a rotation is started or resumed, and while the
+// passphrase of the key is changed
+var rotationLock sync.Mutex
+
+type rotationState struct {
+	OldFingerprint []byte `json:"old_fingerprint"`
+	NewFingerprint []byte `json:"new_fingerprint"`
+	// The new key sealed under the old one, and the old key under the new one
+	SealedNewKey []byte `json:"sealed_new_key"`
+	SealedOldKey []byte `json:"sealed_old_key"`
+	// The new key wrapped with the passphrase of a filesystem with networking
+	// disabled, replacing the one in the attributes once the files have been
+	// converted
+	WrappedKey *keyman.WrappedKey `json:"wrapped_key,omitempty"`
+	// The last file converted, in sorted order
+	Done string `json:"done,omitempty"`
+	// The file whose contents are in the journal, and its times
+	Journaled      string    `json:"journaled,omitempty"`
+	JournaledAtime time.Time `json:"journaled_atime"`
+	JournaledMtime time.Time `json:"journaled_mtime"`
+	Converted      bool      `json:"converted"`
+	// Whether a generation has been requested to share the new key
+	GenerationRequested bool `json:"generation_requested"`
+}
+
+func rotationStatePath() string {
+	return path.Join(globals.ParanoidDir, "meta", "key_rotation")
+}
+
+func rotationJournalPath() string {
+	return path.Join(globals.ParanoidDir, "meta", "key_rotation_journal")
+}
+
+// rotationDonePath is the log of the files which have been converted. It is
+// used to notice hard links to a file which has already been converted.
+func rotationDonePath() string {
+	return path.Join(globals.ParanoidDir, "meta", "key_rotation_done")
+}
+
+// rotationKEK derives the key-encryption-key used to seal data with key
+// during a rotation.
+func rotationKEK(key *keyman.Key) []byte {
+	sum := sha256.Sum256(append([]byte(rotationKEKDomain), key.GetBytes()...))
+	return sum[:]
+}
+
+func newRotationState(oldKey, newKey *keyman.Key, wrapped *keyman.WrappedKey) (*rotationState, error) {
+	oldFingerprint := oldKey.GetFingerprint()
+	newFingerprint := newKey.GetFingerprint()
+	sealedNewKey, err := keyman.Seal(rotationKEK(oldKey), newKey.GetBytes(), newFingerprint[:])
+	if err != nil {
+		return nil, err
+	}
+	sealedOldKey, err := keyman.Seal(rotationKEK(newKey), oldKey.GetBytes(), oldFingerprint[:])
+	if err != nil {
+		return nil, err
+	}
+	return &rotationState{
+		OldFingerprint: oldFingerprint[:],
+		NewFingerprint: newFingerprint[:],
+		SealedNewKey:   sealedNewKey,
+		SealedOldKey:   sealedOldKey,
+		WrappedKey:     wrapped,
+	}, nil
+}
+
+// keys returns the old and new key of the rotation, given either of them.
+func (state *rotationState) keys(current *keyman.Key) (oldKey, newKey *keyman.Key, err error) {
+	fingerprint := current.GetFingerprint()
+	switch {
+	case bytes.Equal(fingerprint[:], state.OldFingerprint):
+		data, err := keyman.Open(rotationKEK(current), state.SealedNewKey, state.NewFingerprint)
+		if err != nil {
+			return nil, nil, err
+		}
+		newKey, err := keyman.NewKey(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return current, newKey, nil
+	case bytes.Equal(fingerprint[:], state.NewFingerprint):
+		data, err := keyman.Open(rotationKEK(current), state.SealedOldKey, state.OldFingerprint)
+		if err != nil {
+			return nil, nil, err
+		}
+		oldKey, err := keyman.NewKey(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return oldKey, current, nil
+	}
+	return nil, nil, errors.New("the key of this filesystem is neither the old nor the new key of the rotation")
+}
+
+func readRotationState() (*rotationState, error) {
+	data, err := ioutil.ReadFile(rotationStatePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	version, payload, err := keyman.DecodeFile(rotationStateMagic, data)
+	if err != nil {
+		return nil, err
+	}
+	if version != rotationStateVersion {
+		return nil, fmt.Errorf("unsupported key rotation state version %d", version)
+	}
+	state := &rotationState{}
+	if err := json.Unmarshal(payload, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (state *rotationState) save() error {
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	data := keyman.EncodeFile(rotationStateMagic, rotationStateVersion, payload)
+	return durable.WriteFile(rotationStatePath(), data, 0600)
+}
+
+func removeRotationState() error {
+	for _, file := range []string{rotationStatePath(), rotationJournalPath(), rotationDonePath()} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return durable.SyncDir(path.Join(globals.ParanoidDir, "meta"))
+}
+
+// useKey makes libpfs and pfsd use key
+func useKey(key *keyman.Key) error {
+	cipherB, err := encryption.GenerateAESCipherBlock(key.GetBytes())
+	if err != nil {
+		return fmt.Errorf("unable to generate cipher block: %s", err)
+	}
+	encryption.SetCipher(cipherB)
+	globals.SetEncryptionKey(key)
+	return nil
+}
+
+// recordKeyFingerprint keeps the fingerprint of the key in use in the file
+// system attributes, so that a key recovered from backup shares can be
+// checked. attributes which are given are saved by the caller.
+func recordKeyFingerprint(attributes *globals.FileSystemAttributes) error {
+	fingerprint := globals.GetEncryptionKey().GetFingerprint()
+	save := attributes == nil
+	if save {
+		var err error
+		attributes, err = globals.ReadFileSystemAttributes()
+		if err != nil {
+			return err
+		}
+	}
+	if bytes.Equal(attributes.KeyFingerprint, fingerprint[:]) {
+		return nil
+	}
+	attributes.KeyFingerprint = fingerprint[:]
+	if !save {
+		return nil
+	}
+	return globals.SaveFileSystemAttributes(attributes)
+}
+
+func commandError(command string, code returncodes.Code, err error) error {
+	if err != nil {
+		return fmt.Errorf("%s failed: %s", command, err)
+	}
+	return fmt.Errorf("%s failed with code %d", command, code)
+}
+
+// listRegularFiles returns the regular files below dir.
+func listRegularFiles(dir string) ([]string, error) {
+	code, names, err := commands.ReadDirCommand(globals.ParanoidDir, dir)
+	if code != returncodes.OK {
+		return nil, commandError("readdir of "+dir, code, err)
+	}
+	var files []string
+	for _, name := range names {
+		if dir != "" {
+			name = dir + "/" + name
+		}
+		code, stats, err := commands.StatCommand(globals.ParanoidDir, name)
+		if code != returncodes.OK {
+			return nil, commandError("stat of "+name, code, err)
+		}
+		switch uint32(stats.Mode) & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			children, err := listRegularFiles(name)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, children...)
+		case syscall.S_IFREG:
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
+
+// readFile calls fn with the contents of a file in chunks, as decrypted with
+// the cipher libpfs currently uses.
+func readFile(name string, fn func(chunk []byte) error) error {
+	for off := int64(0); ; {
+		code, data, err := commands.ReadCommand(globals.ParanoidDir, name, off, rotationChunkSize)
+		if code != returncodes.OK {
+			return commandError("read of "+name, code, err)
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+		off += int64(len(data))
+	}
+}
+
+func journalAdditionalData(name string, index uint64) []byte {
+	ad := make([]byte, len(name)+8)
+	copy(ad, name)
+	binary.BigEndian.PutUint64(ad[len(name):], index)
+	return ad
+}
+
+// journalFile reads a file with the old key into the journal, sealed under
+// the new key.
+func journalFile(name string, kek []byte) error {
+	f, err := os.OpenFile(rotationJournalPath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var index uint64
+	err = readFile(name, func(chunk []byte) error {
+		sealed, err := keyman.Seal(kek, chunk, journalAdditionalData(name, index))
+		if err != nil {
+			return err
+		}
+		index++
+		if err := binary.Write(f, binary.BigEndian, uint32(len(sealed))); err != nil {
+			return err
+		}
+		_, err = f.Write(sealed)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return durable.SyncDir(path.Join(globals.ParanoidDir, "meta"))
+}
+
+// restoreFile writes the contents of a file in the journal with the new key.
+// It returns a MAC of the contents, used to recognise hard links to the file.
+func restoreFile(name string, kek []byte) ([]byte, error) {
+	f, err := os.Open(rotationJournalPath())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	code, err := commands.TruncateCommand(globals.ParanoidDir, name, 0)
+	if code != returncodes.OK {
+		return nil, commandError("truncate of "+name, code, err)
+	}
+	mac := hmac.New(sha256.New, kek)
+	var off int64
+	for index := uint64(0); ; index++ {
+		var length uint32
+		err := binary.Read(f, binary.BigEndian, &length)
+		if err == io.EOF {
+			return mac.Sum(nil), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		sealed := make([]byte, length)
+		if _, err := io.ReadFull(f, sealed); err != nil {
+			return nil, err
+		}
+		chunk, err := keyman.Open(kek, sealed, journalAdditionalData(name, index))
+		if err != nil {
+			return nil, err
+		}
+		code, bytesWritten, err := commands.WriteCommand(globals.ParanoidDir, name, off, int64(len(chunk)), chunk)
+		if code != returncodes.OK {
+			return nil, commandError("write of "+name, code, err)
+		}
+		if bytesWritten != len(chunk) {
+			return nil, fmt.Errorf("short write of %s: %d of %d bytes", name, bytesWritten, len(chunk))
+		}
+		mac.Write(chunk)
+		off += int64(len(chunk))
+	}
+}
+
+// fileMAC returns a MAC of the contents of a file as read with the new key.
+func fileMAC(name string, kek []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, kek)
+	err := readFile(name, func(chunk []byte) error {
+		mac.Write(chunk)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mac.Sum(nil), nil
+}
+
+// readDoneLog returns the MACs of the files converted so far by size.
+func readDoneLog() (map[int64][][]byte, error) {
+	done := make(map[int64][][]byte)
+	data, err := ioutil.ReadFile(rotationDonePath())
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A record cut short by a crash is ignored, along with the file it was
+	// for, which is then recorded again once it has been converted again.
+	const recordLen = 8 + sha256.Size
+	for ; len(data) >= recordLen; data = data[recordLen:] {
+		size := int64(binary.BigEndian.Uint64(data))
+		done[size] = append(done[size], data[8:recordLen])
+	}
+	return done, nil
+}
+
+func appendDoneLog(size int64, mac []byte) error {
+	f, err := os.OpenFile(rotationDonePath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	record := make([]byte, 8, 8+len(mac))
+	binary.BigEndian.PutUint64(record, uint64(size))
+	if _, err := f.Write(append(record, mac...)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// reencryptFiles converts the files which have not been converted yet from
+// the old key to the new one, calling progress before each file. libpfs is
+// left using the new key.
+func reencryptFiles(state *rotationState, oldKey, newKey *keyman.Key, progress func(converted, total int)) error {
+	oldCipher, err := encryption.GenerateAESCipherBlock(oldKey.GetBytes())
+	if err != nil {
+		return fmt.Errorf("unable to generate cipher block: %s", err)
+	}
+	newCipher, err := encryption.GenerateAESCipherBlock(newKey.GetBytes())
+	if err != nil {
+		return fmt.Errorf("unable to generate cipher block: %s", err)
+	}
+	kek := rotationKEK(newKey)
+
+	files, err := listRegularFiles("")
+	if err != nil {
+		return err
+	}
+	// Files are converted in sorted order, so that those after the last one
+	// converted are those left.
+	sort.Strings(files)
+	start := 0
+	if state.Done != "" {
+		start = sort.SearchStrings(files, state.Done)
+		if start < len(files) && files[start] == state.Done {
+			start++
+		}
+	}
+	done, err := readDoneLog()
+	if err != nil {
+		return err
+	}
+
+	for i := start; i < len(files); i++ {
+		select {
+		case _, ok := <-globals.Quit:
+			if !ok {
+				return errUnlockStopped
+			}
+		default:
+		}
+		name := files[i]
+		progress(i, len(files))
+
+		if name != state.Journaled {
+			encryption.SetCipher(newCipher)
+			code, stats, err := commands.StatCommand(globals.ParanoidDir, name)
+			if code != returncodes.OK {
+				return commandError("stat of "+name, code, err)
+			}
+			// A hard link to a file which has already been converted reads
+			// as that file with the new key.
+			linked := false
+			if macs := done[stats.Length]; len(macs) > 0 {
+				mac, err := fileMAC(name, kek)
+				if err != nil {
+					return err
+				}
+				for _, v := range macs {
+					if hmac.Equal(v, mac) {
+						linked = true
+						break
+					}
+				}
+			}
+			if !linked {
+				encryption.SetCipher(oldCipher)
+				if err := journalFile(name, kek); err != nil {
+					return fmt.Errorf("unable to journal %s: %s", name, err)
+				}
+				state.Journaled = name
+				state.JournaledAtime = stats.Atime
+				state.JournaledMtime = stats.Mtime
+				if err := state.save(); err != nil {
+					return err
+				}
+			}
+		}
+
+		encryption.SetCipher(newCipher)
+		if state.Journaled == name {
+			mac, err := restoreFile(name, kek)
+			if err != nil {
+				return fmt.Errorf("unable to rewrite %s: %s", name, err)
+			}
+			code, err := commands.UtimesCommand(globals.ParanoidDir, name, &state.JournaledAtime, &state.JournaledMtime)
+			if code != returncodes.OK {
+				return commandError("utimes of "+name, code, err)
+			}
+			code, stats, err := commands.StatCommand(globals.ParanoidDir, name)
+			if code != returncodes.OK {
+				return commandError("stat of "+name, code, err)
+			}
+			if err := appendDoneLog(stats.Length, mac); err != nil {
+				return err
+			}
+			done[stats.Length] = append(done[stats.Length], mac)
+		}
+		state.Done = name
+		state.Journaled = ""
+		if err := state.save(); err != nil {
+			return err
+		}
+	}
+
+	encryption.SetCipher(newCipher)
+	state.Converted = true
+	return state.save()
+}
+
+// rotateKey starts rotating the key of this node. Filesystems with networking
+// disabled need the passphrase, with which the new key is wrapped.
+func rotateKey(passphrase []byte) error {
+	if !globals.Encrypted || !globals.KeyGenerated {
+		return errors.New("filesystem has no encryption key")
+	}
+	oldKey := globals.GetEncryptionKey()
+	if oldKey == nil || globals.Locked() {
+		return errors.New("filesystem is locked")
+	}
+
+	rotationLock.Lock()
+	defer rotationLock.Unlock()
+	state, err := readRotationState()
+	if err != nil {
+		return fmt.Errorf("unable to read key rotation state: %s", err)
+	}
+	if state != nil {
+		return errRotationInProgress
+	}
+
+	newKey, err := keyman.GenerateKey(32)
+	if err != nil {
+		return fmt.Errorf("unable to generate encryption key: %s", err)
+	}
+	var wrapped *keyman.WrappedKey
+	if globals.NetworkOff {
+		attributes, err := globals.ReadFileSystemAttributes()
+		if err != nil {
+			return fmt.Errorf("unable to read file system attributes: %s", err)
+		}
+		if attributes.WrappedKey == nil {
+			return errors.New("no encryption key is stored for this filesystem")
+		}
+		if _, err := keyman.UnwrapKey(attributes.WrappedKey, passphrase); err != nil {
+			return errors.New("passphrase is incorrect")
+		}
+		wrapped, err = keyman.WrapKey(newKey, passphrase)
+		if err != nil {
+			return fmt.Errorf("unable to wrap encryption key: %s", err)
+		}
+	}
+	state, err = newRotationState(oldKey, newKey, wrapped)
+	if err != nil {
+		return fmt.Errorf("unable to seal keys: %s", err)
+	}
+	if err := state.save(); err != nil {
+		return fmt.Errorf("unable to save key rotation state: %s", err)
+	}
+
+	log.Info("Rotating the encryption key")
+	globals.LockOperations("rotating the encryption key")
+	globals.Wait.Add(1)
+	go runKeyRotation(state, oldKey, newKey)
+	return nil
+}
+
+// beginPassphraseChange is called before the passphrase of the key is changed.
+// It refuses while a rotation is in progress, and holds rotationLock until the
+// function it returns is called, so that a rotation does not wrap the new key
+// with a passphrase which is being replaced.
+func beginPassphraseChange() (func(), error) {
+	rotationLock.Lock()
+	state, err := readRotationState()
+	if err != nil {
+		rotationLock.Unlock()
+		return nil, fmt.Errorf("unable to read key rotation state: %s", err)
+	}
+	if state != nil {
+		rotationLock.Unlock()
+		return nil, errRotationInProgress
+	}
+	return rotationLock.Unlock, nil
+}
+
+// runKeyRotation converts the files of a rotation started by rotateKey, which
+// has locked the filesystem. Failures are retried with a backoff while the
+// filesystem stays locked. If pfsd is stopped first, the rotation is resumed
+// when it is next started.
+func runKeyRotation(state *rotationState, oldKey, newKey *keyman.Key) {
+	defer globals.Wait.Done()
+	if !globals.NetworkOff {
+		pnetclient.PauseReplication()
+		defer pnetclient.ResumeReplication()
+	}
+	raftStopped := globals.NetworkOff
+	delay := minRotationRetryInterval
+	for {
+		var err error
+		if !raftStopped {
+			err = stopRaft()
+			raftStopped = err == nil
+		}
+		if err == nil && !state.Converted {
+			err = reencryptFiles(state, oldKey, newKey, func(converted, total int) {
+				globals.SetLockState(true, fmt.Sprintf("rotating the encryption key: %d of %d files converted",
+					converted, total))
+			})
+		}
+		if err == nil {
+			err = completeKeyRotation(state, newKey, nil)
+		}
+		if err == nil {
+			break
+		}
+		if err == errUnlockStopped {
+			return
+		}
+		log.Errorf("Key rotation failed, retrying in %s: %s", delay, err)
+		globals.SetLockState(true, fmt.Sprintf("key rotation failed, retrying in %s: %s", delay, err))
+		select {
+		case _, ok := <-globals.Quit:
+			if !ok {
+				return
+			}
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxRotationRetryInterval {
+			delay = maxRotationRetryInterval
+		}
+	}
+
+	if !globals.NetworkOff {
+		if err := restartWithRaft(); err != nil {
+			if err != errUnlockStopped {
+				log.Fatal("Unable to start raft:", err)
+			}
+			return
+		}
+	}
+	globals.SetLockState(false, "")
+	log.Info("Files re-encrypted with the new key")
+	if !globals.NetworkOff {
+		globals.Wait.Add(1)
+		go finishKeyRotation()
+	}
+}
+
+// resumeKeyRotation finishes converting the files of a rotation which was
+// interrupted, or records the fingerprint of the key if there is none. It is
+// called before raft is started or the filesystem mounted, once the key is
+// known. attributes are those being loaded at startup, if the key was
+// unwrapped with the passphrase.
+func resumeKeyRotation(attributes *globals.FileSystemAttributes) error {
+	rotationLock.Lock()
+	defer rotationLock.Unlock()
+	state, err := readRotationState()
+	if err != nil {
+		return fmt.Errorf("unable to read key rotation state: %s", err)
+	}
+	if state == nil {
+		return recordKeyFingerprint(attributes)
+	}
+	oldKey, newKey, err := state.keys(globals.GetEncryptionKey())
+	if err != nil {
+		return err
+	}
+	if !state.Converted {
+		log.Info("Resuming key rotation")
+		err := reencryptFiles(state, oldKey, newKey, func(converted, total int) {
+			if converted%1000 == 0 {
+				log.Infof("Key rotation: %d of %d files converted", converted, total)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return completeKeyRotation(state, newKey, attributes)
+}
+
+// completeKeyRotation switches to the new key once the files have been
+// converted, and records its fingerprint. With networking disabled the new key
+// replaces the wrapped one and the rotation is over.
+func completeKeyRotation(state *rotationState, newKey *keyman.Key, attributes *globals.FileSystemAttributes) error {
+	if err := useKey(newKey); err != nil {
+		return err
+	}
+	if !globals.NetworkOff {
+		return recordKeyFingerprint(nil)
+	}
+	if state.WrappedKey == nil {
+		return errors.New("key rotation state has no wrapped key")
+	}
+	if attributes == nil {
+		var err error
+		attributes, err = globals.ReadFileSystemAttributes()
+		if err != nil {
+			return err
+		}
+	}
+	attributes.WrappedKey = state.WrappedKey
+	attributes.KeyFingerprint = state.NewFingerprint
+	if err := globals.SaveFileSystemAttributes(attributes); err != nil {
+		return err
+	}
+	if err := removeRotationState(); err != nil {
+		return err
+	}
+	log.Info("Key rotation finished")
+	return nil
+}
+
+// finishKeyRotation shares the new key of a networked node through a new
+// generation, and forgets the old key once that generation is current.
+func finishKeyRotation() {
+	defer globals.Wait.Done()
+	ticker := time.NewTicker(rotationCheckInterval)
+	defer ticker.Stop()
+	for {
+		state, err := readRotationState()
+		if err != nil {
+			log.Error("Unable to read key rotation state:", err)
+		} else if state == nil || advanceKeyRotation(state) {
+			return
+		}
+		select {
+		case _, ok := <-globals.Quit:
+			if !ok {
+				return
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// advanceKeyRotation requests the generation of the new key if it has not
+// been, and returns true once it is current.
+func advanceKeyRotation(state *rotationState) bool {
+	if !state.GenerationRequested {
+		srvLock.Lock()
+		server := globals.RaftNetworkServer
+		srvLock.Unlock()
+		if server == nil {
+			return false
+		}
+		_, _, err := server.RequestNewGeneration(globals.ThisNode.UUID)
+		if err != nil {
+			log.Warn("Unable to start a generation for the new key:", err)
+			return false
+		}
+		state.GenerationRequested = true
+		if err := state.save(); err != nil {
+			log.Error("Unable to save key rotation state:", err)
+			return false
+		}
+	}
+
+	generation := keyman.StateMachine.GetCurrentGeneration()
+	piece := globals.HeldKeyPieces.GetPiece(generation, globals.ThisNode.UUID)
+	if piece == nil || !bytes.Equal(piece.ParentFingerprint[:], state.NewFingerprint) {
+		return false
+	}
+	rotationLock.Lock()
+	defer rotationLock.Unlock()
+	if err := removeRotationState(); err != nil {
+		log.Error("Unable to remove key rotation state:", err)
+		return false
+	}
+	log.Info("Key rotation finished, generation", generation, "shares the new key")
+	return true
+}
+
+// keyRotationPending reports whether a rotation of this networked node is
+// waiting for the generation of the new key.
+func keyRotationPending() bool {
+	state, err := readRotationState()
+	if err != nil {
+		log.Error("Unable to read key rotation state:", err)
+		return false
+	}
+	return state != nil
+}
@@ -0,0 +1,341 @@
+// +build integration
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pp2p/paranoid/libpfs/commands"
+	"github.com/pp2p/paranoid/libpfs/encryption"
+	"github.com/pp2p/paranoid/libpfs/returncodes"
+	"github.com/pp2p/paranoid/logger"
+	"github.com/pp2p/pfsd/globals"
+	"github.com/pp2p/pfsd/keyman"
+)
+
+var rotationTestTime = time.Date(2016, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+// rotationTestFiles are the contents of the files created for a rotation.
+// Hard links are not listed, and read as the file they link to.
+func rotationTestFiles() map[string][]byte {
+	big := make([]byte, rotationChunkSize+rotationChunkSize/2)
+	for i := range big {
+		big[i] = byte(i * 7)
+	}
+	return map[string][]byte{
+		"big":   big,
+		"dir/b": []byte("contents of b"),
+		"empty": {},
+		"small": []byte("small file"),
+	}
+}
+
+// rotationTestLinks maps hard links to the files they link to. "dir/link" is
+// converted after its file, and "a-link" before it.
+var rotationTestLinks = map[string]string{
+	"dir/link": "big",
+	"a-link":   "small",
+}
+
+// setupRotation creates a filesystem encrypted with a new key, holding the
+// test files, and returns the key.
+func setupRotation(t *testing.T) (*keyman.Key, func()) {
+	dir, err := ioutil.TempDir("", "pfsdrotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands.Log = logger.New("pfsdrotation", "pfsdrotation", os.DevNull)
+	if _, err := commands.InitCommand(dir); err != nil {
+		t.Fatal(err)
+	}
+	globals.ParanoidDir = dir
+	encryption.Encrypted = true
+	quit := globals.Quit
+	globals.Quit = make(chan bool)
+
+	oldKey, err := keyman.GenerateKey(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := useKey(oldKey); err != nil {
+		t.Fatal(err)
+	}
+	check := func(command string, code returncodes.Code, err error) {
+		if code != returncodes.OK {
+			t.Fatal(commandError(command, code, err))
+		}
+	}
+	code, err := commands.MkdirCommand(dir, "dir", 0700)
+	check("mkdir", code, err)
+	for name, data := range rotationTestFiles() {
+		code, err := commands.CreatCommand(dir, name, 0600)
+		check("creat of "+name, code, err)
+		code, _, err = commands.WriteCommand(dir, name, 0, int64(len(data)), data)
+		check("write of "+name, code, err)
+		code, err = commands.UtimesCommand(dir, name, &rotationTestTime, &rotationTestTime)
+		check("utimes of "+name, code, err)
+	}
+	for link, name := range rotationTestLinks {
+		code, err := commands.LinkCommand(dir, name, link)
+		check("link of "+name, code, err)
+	}
+
+	return oldKey, func() {
+		os.RemoveAll(dir)
+		encryption.Encrypted = false
+		globals.Quit = quit
+		globals.SetEncryptionKey(nil)
+	}
+}
+
+func readTestFile(t *testing.T, name string) []byte {
+	var data []byte
+	err := readFile(name, func(chunk []byte) error {
+		data = append(data, chunk...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// checkRotatedFiles checks that every file reads as before with newKey, and
+// that the times of the files have been kept.
+func checkRotatedFiles(t *testing.T, newKey *keyman.Key) {
+	if err := useKey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	files := rotationTestFiles()
+	for link, name := range rotationTestLinks {
+		files[link] = files[name]
+	}
+	for name, expected := range files {
+		if data := readTestFile(t, name); !bytes.Equal(data, expected) {
+			t.Errorf("%s reads as %d bytes which do not match its %d bytes", name, len(data), len(expected))
+		}
+		code, stats, err := commands.StatCommand(globals.ParanoidDir, name)
+		if code != returncodes.OK {
+			t.Fatal(commandError("stat of "+name, code, err))
+		}
+		if !stats.Mtime.Equal(rotationTestTime) {
+			t.Errorf("Modification time of %s changed to %s", name, stats.Mtime)
+		}
+	}
+}
+
+func newTestRotation(t *testing.T, oldKey *keyman.Key) (*rotationState, *keyman.Key) {
+	newKey, err := keyman.GenerateKey(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := newRotationState(oldKey, newKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+	return state, newKey
+}
+
+func noProgress(converted, total int) {}
+
+func TestReencryptFiles(t *testing.T) {
+	oldKey, cleanup := setupRotation(t)
+	defer cleanup()
+	state, newKey := newTestRotation(t, oldKey)
+
+	if err := reencryptFiles(state, oldKey, newKey, noProgress); err != nil {
+		t.Fatal("Unable to re-encrypt files:", err)
+	}
+	checkRotatedFiles(t, newKey)
+
+	saved, err := readRotationState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.Converted || saved.Journaled != "" {
+		t.Errorf("Rotation state not saved as converted: %+v", saved)
+	}
+	if err := useKey(oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if data := readTestFile(t, "dir/b"); bytes.Equal(data, rotationTestFiles()["dir/b"]) {
+		t.Error("dir/b can still be read with the old key")
+	}
+}
+
+func TestReencryptHardLinks(t *testing.T) {
+	oldKey, cleanup := setupRotation(t)
+	defer cleanup()
+	state, newKey := newTestRotation(t, oldKey)
+
+	if err := reencryptFiles(state, oldKey, newKey, noProgress); err != nil {
+		t.Fatal("Unable to re-encrypt files:", err)
+	}
+	// The contents shared by a hard link and its file are converted once, and
+	// recorded once in the done log.
+	done, err := readDoneLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range rotationTestFiles() {
+		if len(data) != 0 && len(done[int64(len(data))]) != 1 {
+			t.Errorf("%s is recorded %d times in the done log", name, len(done[int64(len(data))]))
+		}
+	}
+	checkRotatedFiles(t, newKey)
+}
+
+func TestRotationJournal(t *testing.T) {
+	oldKey, cleanup := setupRotation(t)
+	defer cleanup()
+	_, newKey := newTestRotation(t, oldKey)
+	kek := rotationKEK(newKey)
+
+	if err := journalFile("big", kek); err != nil {
+		t.Fatal("Unable to journal file:", err)
+	}
+	if err := useKey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	mac, err := restoreFile("big", kek)
+	if err != nil {
+		t.Fatal("Unable to restore file from the journal:", err)
+	}
+	if data := readTestFile(t, "big"); !bytes.Equal(data, rotationTestFiles()["big"]) {
+		t.Error("File restored from the journal does not match")
+	}
+	fileMac, err := fileMAC("big", kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mac, fileMac) {
+		t.Error("MAC of the restored file does not match the MAC of its contents")
+	}
+
+	// A journal which has been tampered with, or which was journaled for
+	// another file, is not restored.
+	journal, err := ioutil.ReadFile(rotationJournalPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restoreFile("small", kek); err == nil {
+		t.Error("Journal of big was restored to small")
+	}
+	journal[len(journal)-1] ^= 1
+	if err := ioutil.WriteFile(rotationJournalPath(), journal, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restoreFile("big", kek); err == nil {
+		t.Error("Journal which was tampered with was restored")
+	}
+}
+
+func TestResumeRotationAfterCrash(t *testing.T) {
+	oldKey, cleanup := setupRotation(t)
+	defer cleanup()
+	state, newKey := newTestRotation(t, oldKey)
+
+	// pfsd stops after two files have been converted, which are a-link and
+	// big, and so small as well
+	err := reencryptFiles(state, oldKey, newKey, func(converted, total int) {
+		if converted == 1 {
+			close(globals.Quit)
+		}
+	})
+	if err != errUnlockStopped {
+		t.Fatal("Expected the rotation to stop. Got:", err)
+	}
+	globals.Quit = make(chan bool)
+
+	// and crashes when it is next started, while a file is being rewritten
+	// from the journal
+	files, err := listRegularFiles("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	next := files[sort.SearchStrings(files, state.Done)+1]
+	if next != "dir/b" {
+		t.Fatalf("Expected dir/b to be converted next, not %s", next)
+	}
+	if err := useKey(oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := journalFile(next, rotationKEK(newKey)); err != nil {
+		t.Fatal(err)
+	}
+	state.Journaled = next
+	state.JournaledAtime, state.JournaledMtime = rotationTestTime, rotationTestTime
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+	if code, err := commands.TruncateCommand(globals.ParanoidDir, next, 1); code != returncodes.OK {
+		t.Fatal(commandError("truncate of "+next, code, err))
+	}
+
+	// It is started again with either key
+	for _, key := range []*keyman.Key{oldKey, newKey} {
+		saved, err := readRotationState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.Done != state.Done || saved.Journaled != next {
+			t.Fatalf("Rotation state saved as done up to %q with %q journaled", saved.Done, saved.Journaled)
+		}
+		resumedOld, resumedNew, err := saved.keys(key)
+		if err != nil {
+			t.Fatal("Unable to get the keys of the rotation:", err)
+		}
+		if resumedOld.GetFingerprint() != oldKey.GetFingerprint() ||
+			resumedNew.GetFingerprint() != newKey.GetFingerprint() {
+			t.Fatal("Keys of the rotation do not match")
+		}
+	}
+	saved, err := readRotationState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reencryptFiles(saved, oldKey, newKey, noProgress); err != nil {
+		t.Fatal("Unable to resume rotation:", err)
+	}
+	checkRotatedFiles(t, newKey)
+}
+
+func TestDoneLogTruncatedRecord(t *testing.T) {
+	_, cleanup := setupRotation(t)
+	defer cleanup()
+
+	mac := bytes.Repeat([]byte{1}, 32)
+	if err := appendDoneLog(10, mac); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendDoneLog(20, mac); err != nil {
+		t.Fatal(err)
+	}
+	// A crash while appending leaves part of a record
+	f, err := os.OpenFile(rotationDonePath(), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 30, 1})
+	f.Close()
+
+	done, err := readDoneLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 2 || len(done[10]) != 1 || len(done[20]) != 1 || len(done[30]) != 0 {
+		t.Error("Unexpected done log:", done)
+	}
+	if !bytes.Equal(done[10][0], mac) {
+		t.Error("MAC read from the done log does not match")
+	}
+}
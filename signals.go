@@ -26,25 +26,53 @@ func stopAllServices() {
 	globals.HeldKeyPieces.SaveToDisk()
 
 	if !globals.NetworkOff {
-		close(globals.RaftNetworkServer.Quit)
+		srvLock.Lock()
+		// Raft is not started while the filesystem is locked
+		if globals.RaftNetworkServer != nil {
+			close(globals.RaftNetworkServer.Quit)
+		}
 		srv.Stop()
-		globals.RaftNetworkServer.Wait.Wait()
+		if globals.RaftNetworkServer != nil {
+			globals.RaftNetworkServer.Wait.Wait()
+		}
+		srvLock.Unlock()
 	}
 
 	globals.Wait.Wait()
 }
 
-// HandleSignals listens for SIGTERM and SIGHUP, and dispatches to handler
-// functions when a signal is received.
+// HandleSignals listens for SIGTERM, SIGHUP and SIGUSR1, and dispatches to
+// handler functions when a signal is received. It returns once pfsd has been
+// stopped or restarted.
 func HandleSignals() {
 	incoming := make(chan os.Signal, 1)
-	signal.Notify(incoming, syscall.SIGHUP, syscall.SIGTERM)
-	sig := <-incoming
-	switch sig {
-	case syscall.SIGHUP:
-		handleSIGHUP()
-	case syscall.SIGTERM:
-		handleSIGTERM()
+	signal.Notify(incoming, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGUSR1)
+	for {
+		sig := <-incoming
+		switch sig {
+		case syscall.SIGHUP:
+			handleSIGHUP()
+			return
+		case syscall.SIGTERM:
+			handleSIGTERM()
+			return
+		case syscall.SIGUSR1:
+			handleSIGUSR1()
+		}
+	}
+}
+
+func handleSIGUSR1() {
+	log.Info("SIGUSR1 received. Reloading TLS certificate.")
+	if globals.Certificates == nil {
+		log.Warn("TLS is not enabled, there is no certificate to reload")
+		return
+	}
+	err := globals.Certificates.Reload()
+	if err != nil {
+		log.Error("Unable to reload TLS certificate:", err)
+	} else {
+		log.Info("TLS certificate reloaded.")
 	}
 }
 
@@ -52,15 +80,25 @@ func handleSIGHUP() {
 	log.Info("SIGHUP received. Restarting.")
 	stopAllServices()
 	log.Info("All services stopped. Forking process.")
+	files := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}
+	secrets, err := restartSecretsPipe()
+	if err != nil {
+		log.Error("Could not hand secrets to the restarted PFSD instance:", err)
+	}
+	if secrets != nil {
+		defer secrets.Close()
+		files = append(files, secrets.Fd())
+	}
 	execSpec := &syscall.ProcAttr{
-		Env: os.Environ(),
+		Env:   restartEnv(secrets != nil),
+		Files: files,
 	}
 	pathToSelf, err := osext.Executable()
 	if err != nil {
 		log.Warn("Could not get path to self:", err)
 		pathToSelf = os.Args[0]
 	}
-	fork, err := syscall.ForkExec(pathToSelf, os.Args, execSpec)
+	fork, err := syscall.ForkExec(pathToSelf, withoutRecoveryFlags(os.Args), execSpec)
 	if err != nil {
 		log.Error("Could not fork child PFSD instance:", err)
 	} else {
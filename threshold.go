@@ -0,0 +1,59 @@
+package main
+
+import (
+	log "github.com/pp2p/paranoid/logger"
+	"github.com/pp2p/pfsd/globals"
+	"github.com/pp2p/pfsd/keyman"
+	"github.com/pp2p/pfsd/pnetclient"
+)
+
+// useClusterThresholdPolicy makes the key state machine use the threshold
+// policy of this filesystem if it has no generations yet. Otherwise the policy
+// stored with the generations is the one of the cluster, which this node takes
+// over, as it may have joined with another policy.
+func useClusterThresholdPolicy() {
+	policy := keyman.StateMachine.SetThresholdPolicy(globals.ThresholdPolicy)
+	if err := adoptThresholdPolicy(policy); err != nil {
+		log.Fatal("Unable to use the threshold policy of the cluster:", err)
+	}
+}
+
+// adoptThresholdPolicy makes policy the threshold policy of this filesystem,
+// saving it in the file system attributes so that it is used after a restart.
+func adoptThresholdPolicy(policy keyman.ThresholdPolicy) error {
+	if policy == globals.ThresholdPolicy {
+		return nil
+	}
+	log.Warnf("Using the threshold policy %s of the cluster instead of %s", policy, globals.ThresholdPolicy)
+	attributes, err := globals.ReadFileSystemAttributes()
+	if err != nil {
+		return err
+	}
+	attributes.ThresholdPolicy = policy
+	if err := globals.SaveFileSystemAttributes(attributes); err != nil {
+		return err
+	}
+	globals.ThresholdPolicy = policy
+	return nil
+}
+
+// generationThreshold returns the number of key pieces needed to unlock with a
+// generation this node is joining. The key state of this node only has the
+// generation once it has joined raft, so until then the threshold and the
+// policy of the cluster are asked of the peers in the generation.
+func generationThreshold(generation int64, peers []string) (int64, error) {
+	if threshold, err := keyman.StateMachine.GetThreshold(generation); err == nil {
+		return threshold, nil
+	}
+	threshold, policy, err := getThreshold(peers, generation)
+	if err != nil {
+		return 0, err
+	}
+	if err := adoptThresholdPolicy(keyman.StateMachine.SetThresholdPolicy(policy)); err != nil {
+		return 0, err
+	}
+	return threshold, nil
+}
+
+// getThreshold asks peers for the threshold of a generation. Tests replace it.
+var getThreshold = pnetclient.GetThreshold
@@ -0,0 +1,162 @@
+// +build !integration
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pp2p/paranoid/logger"
+	"github.com/pp2p/pfsd/globals"
+	"github.com/pp2p/pfsd/keyman"
+	"github.com/pp2p/pfsd/pnetclient"
+)
+
+func parsePolicy(t *testing.T, s string) keyman.ThresholdPolicy {
+	policy, err := keyman.ParseThresholdPolicy(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+// setupThresholdPolicy creates a paranoid directory for an encrypted
+// filesystem with the given threshold policy, and a key state machine
+// without generations.
+func setupThresholdPolicy(t *testing.T, policy keyman.ThresholdPolicy) func() {
+	dir, err := ioutil.TempDir("", "pfsdthreshold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path.Join(dir, "meta"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	keyman.Log = logger.New("keyman", "pfsd", os.DevNull)
+	globals.ParanoidDir = dir
+	err = globals.SaveFileSystemAttributes(&globals.FileSystemAttributes{Encrypted: true, ThresholdPolicy: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	globals.ThresholdPolicy = policy
+	keyman.StateMachine = keyman.NewKSM(dir)
+	return func() {
+		os.RemoveAll(dir)
+		globals.ThresholdPolicy = keyman.ThresholdPolicy{}
+		keyman.StateMachine = nil
+	}
+}
+
+// clusterKeyState writes the key state of a cluster using policy, whose last
+// generation was created for this node to join, as raft would install it on
+// this node.
+func clusterKeyState(t *testing.T, policy keyman.ThresholdPolicy) {
+	dir, err := ioutil.TempDir("", "pfsdcluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(path.Join(dir, "meta"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	cluster := keyman.NewKSM(dir)
+	cluster.SetThresholdPolicy(policy)
+	for _, node := range []string{"node-a", "node-b", "node-c"} {
+		if _, _, err := cluster.NewGeneration(node); err != nil {
+			t.Fatal("Unable to create generation:", err)
+		}
+	}
+	err = keyman.StateMachine.UpdateFromStateFile(path.Join(dir, "meta", keyman.KsmFileName))
+	if err != nil {
+		t.Fatal("Unable to update key state:", err)
+	}
+	if err := keyman.StateMachine.SerialiseToPFSDir(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// restartThresholdPolicy loads the threshold policy as pfsd does when it is
+// started again, and returns the policy saved in the attributes.
+func restartThresholdPolicy(t *testing.T) keyman.ThresholdPolicy {
+	attributes, err := globals.ReadFileSystemAttributes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	globals.ThresholdPolicy = attributes.ThresholdPolicy
+	keyman.StateMachine, err = keyman.NewKSMFromPFSDir(globals.ParanoidDir)
+	if err != nil {
+		t.Fatal("Unable to load key state:", err)
+	}
+	useClusterThresholdPolicy()
+
+	attributes, err = globals.ReadFileSystemAttributes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attributes.ThresholdPolicy
+}
+
+func TestJoinWithAnotherPolicyThenRestart(t *testing.T) {
+	own, cluster := parsePolicy(t, "fixed:1"), parsePolicy(t, "fraction:2/3")
+	cleanup := setupThresholdPolicy(t, own)
+	defer cleanup()
+
+	var asked []string
+	getThreshold = func(uuids []string, generation int64) (int64, keyman.ThresholdPolicy, error) {
+		asked = uuids
+		return 2, cluster, nil
+	}
+	defer func() { getThreshold = pnetclient.GetThreshold }()
+
+	peers := []string{"node-a", "node-b"}
+	threshold, err := generationThreshold(2, peers)
+	if err != nil {
+		t.Fatal("Unable to get threshold:", err)
+	}
+	if threshold != 2 || len(asked) != len(peers) {
+		t.Errorf("Got threshold %d from %v, expected 2 from %v", threshold, asked, peers)
+	}
+	if globals.ThresholdPolicy != cluster || keyman.StateMachine.GetThresholdPolicy() != cluster {
+		t.Errorf("Joined with policy %s and key state policy %s, expected %s",
+			globals.ThresholdPolicy, keyman.StateMachine.GetThresholdPolicy(), cluster)
+	}
+
+	clusterKeyState(t, cluster)
+	if saved := restartThresholdPolicy(t); saved != cluster || globals.ThresholdPolicy != cluster {
+		t.Errorf("Restarted with policy %s and saved %s, expected %s", globals.ThresholdPolicy, saved, cluster)
+	}
+
+	// Once joined the threshold comes from the key state
+	asked = nil
+	if threshold, err := generationThreshold(2, peers); err != nil || threshold != 2 || asked != nil {
+		t.Errorf("Got threshold %d from %v: %v", threshold, asked, err)
+	}
+}
+
+func TestRestartWithClusterPolicy(t *testing.T) {
+	// Nodes which joined before the policy was taken over when joining only
+	// have the policy of the cluster in their key state.
+	own, cluster := parsePolicy(t, "fixed:1"), parsePolicy(t, "allbut:1")
+	cleanup := setupThresholdPolicy(t, own)
+	defer cleanup()
+	clusterKeyState(t, cluster)
+
+	if saved := restartThresholdPolicy(t); saved != cluster || globals.ThresholdPolicy != cluster {
+		t.Errorf("Restarted with policy %s and saved %s, expected %s", globals.ThresholdPolicy, saved, cluster)
+	}
+}
+
+func TestRestartWithoutGenerations(t *testing.T) {
+	own := parsePolicy(t, "fixed:1")
+	cleanup := setupThresholdPolicy(t, own)
+	defer cleanup()
+	if err := keyman.StateMachine.SerialiseToPFSDir(); err != nil {
+		t.Fatal(err)
+	}
+
+	if saved := restartThresholdPolicy(t); saved != own || keyman.StateMachine.GetThresholdPolicy() != own {
+		t.Errorf("Restarted with key state policy %s and saved %s, expected %s",
+			keyman.StateMachine.GetThresholdPolicy(), saved, own)
+	}
+}